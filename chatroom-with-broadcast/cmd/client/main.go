@@ -1,11 +1,21 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+
 	"github.com/Caesarsage/chatroom/internal/chatroom"
 )
 
 func main() {
+	cfg := chatroom.DefaultClientConfig()
+	flag.StringVar(&cfg.Addr, "addr", cfg.Addr, "chat server address")
+	flag.BoolVar(&cfg.TLS, "tls", false, "connect with TLS")
+	flag.StringVar(&cfg.TLSCAFile, "tls-ca", "", "PEM CA to trust instead of the system roots")
+	flag.StringVar(&cfg.TLSCertFile, "tls-cert", "", "PEM client certificate for mutual TLS")
+	flag.StringVar(&cfg.TLSKeyFile, "tls-key", "", "PEM private key for -tls-cert")
+	flag.Parse()
+
 	fmt.Println("Starting client from cmd/client...")
-	chatroom.StartClient()
+	chatroom.StartClientWithConfig(cfg)
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Caesarsage/chatroom/pkg/devcert"
+)
+
+// gencert creates a self-signed development certificate for the chat server
+// and, optionally, client certificates for mutual TLS.
+func main() {
+	hosts := flag.String("hosts", "localhost,127.0.0.1", "comma-separated hosts the server certificate is valid for")
+	outDir := flag.String("out", "certs", "directory to write the PEM files to")
+	client := flag.String("client", "", "also create a client certificate for this username")
+	flag.Parse()
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		fmt.Println("Error creating output directory:", err)
+		os.Exit(1)
+	}
+
+	certPath := filepath.Join(*outDir, "server.crt")
+	keyPath := filepath.Join(*outDir, "server.key")
+
+	if _, err := os.Stat(certPath); os.IsNotExist(err) {
+		if err := devcert.GenerateServer(strings.Split(*hosts, ","), certPath, keyPath); err != nil {
+			fmt.Println("Error generating server certificate:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s and %s\n", certPath, keyPath)
+	} else {
+		fmt.Printf("Using existing %s\n", certPath)
+	}
+
+	if *client != "" {
+		clientCert := filepath.Join(*outDir, *client+".crt")
+		clientKey := filepath.Join(*outDir, *client+".key")
+		if err := devcert.GenerateClient(*client, certPath, keyPath, clientCert, clientKey); err != nil {
+			fmt.Println("Error generating client certificate:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %s and %s\n", clientCert, clientKey)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 
@@ -8,7 +10,16 @@ import (
 )
 
 func main() {
+	cfg, err := chatroom.LoadServerConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
 	fmt.Println("Starting server from cmd/server...")
-	chatroom.StartServer()
+	chatroom.StartServerWithConfig(cfg)
 	os.Exit(0)
 }
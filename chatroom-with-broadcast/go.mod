@@ -1,3 +1,5 @@
 module github.com/Caesarsage/chatroom
 
 go 1.23.2
+
+require golang.org/x/crypto v0.40.0
@@ -0,0 +1,147 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	accountsFile      = "accounts.json"
+	minPasswordLength = 8
+)
+
+var (
+	errInvalidLogin   = errors.New("invalid username or password")
+	errAccountExists  = errors.New("that username is already registered")
+	errPasswordLength = fmt.Errorf("passwords must be %d to 72 bytes long", minPasswordLength)
+)
+
+// Account is a registered username. Only registered users can log in under
+// its name.
+type Account struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"password_hash"` // bcrypt, salted
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// registerAccount creates an account for username with password.
+func (cr *ChatRoom) registerAccount(username, password string) error {
+	if len(password) < minPasswordLength || len(password) > 72 {
+		return errPasswordLength
+	}
+
+	// Hash outside the lock; bcrypt is deliberately slow
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	cr.accountsMu.Lock()
+	defer cr.accountsMu.Unlock()
+
+	if _, exists := cr.accounts[username]; exists {
+		return errAccountExists
+	}
+
+	cr.accounts[username] = &Account{
+		Username:     username,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now(),
+	}
+	fmt.Printf("Registered account %s\n", username)
+	return cr.saveAccounts()
+}
+
+// checkPassword verifies a login. Unknown users and wrong passwords get the
+// same error.
+func (cr *ChatRoom) checkPassword(username, password string) error {
+	cr.accountsMu.Lock()
+	account, exists := cr.accounts[username]
+	cr.accountsMu.Unlock()
+
+	if !exists {
+		return errInvalidLogin
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return errInvalidLogin
+	}
+	return nil
+}
+
+// hasAccount reports whether username is registered and therefore protected.
+func (cr *ChatRoom) hasAccount(username string) bool {
+	cr.accountsMu.Lock()
+	defer cr.accountsMu.Unlock()
+
+	_, exists := cr.accounts[username]
+	return exists
+}
+
+func (cr *ChatRoom) loadAccounts() error {
+	data, err := os.ReadFile(filepath.Join(cr.dataDir, accountsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return err
+	}
+
+	cr.accountsMu.Lock()
+	defer cr.accountsMu.Unlock()
+
+	for _, account := range accounts {
+		cr.accounts[account.Username] = account
+	}
+
+	fmt.Printf("Loaded %d accounts\n", len(accounts))
+	return nil
+}
+
+// saveAccounts atomically rewrites the accounts file. Callers must hold
+// accountsMu.
+func (cr *ChatRoom) saveAccounts() error {
+	accounts := make([]*Account, 0, len(cr.accounts))
+	for _, account := range cr.accounts {
+		accounts = append(accounts, account)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(cr.dataDir, accountsFile), data)
+}
+
+// handleRegisterCommand handles "/register <password>", registering the
+// client's current username.
+func (cr *ChatRoom) handleRegisterCommand(client *Client, args []string) {
+	if len(args) != 2 {
+		client.sendError("Usage: /register <password>")
+		return
+	}
+
+	if err := cr.registerAccount(client.username, args[1]); err != nil {
+		client.sendError(fmt.Sprintf("Registration failed: %v", err))
+		return
+	}
+	client.mu.Lock()
+	client.authenticated = true
+	client.mu.Unlock()
+
+	// Tokens handed out while the name was a guest's must not log in to the
+	// account
+	session := cr.renewSession(client.username)
+	client.sendAck(fmt.Sprintf("Registered %s. Log in next time with login:%s:<password>\nYour new reconnect token: %s",
+		client.username, client.username, session.ReconnectToken))
+}
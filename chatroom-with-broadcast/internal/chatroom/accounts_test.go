@@ -0,0 +1,109 @@
+package chatroom
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAccounts(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+
+	conn, reader := connectPipe(t, cr)
+	conn.Write([]byte("register:alice:correct horse\n"))
+	expectLine(t, reader, "Welcome, alice!", "alice")
+	conn.Close()
+	waitUntilDisconnected(t, cr, "alice")
+	cr.shutdown()
+
+	// The name is now protected and the account survives a restart
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom after restart: %v", err)
+	}
+	go restarted.Run()
+	closeAtCleanup(t, restarted)
+
+	conn, reader = connectPipe(t, restarted)
+	conn.Write([]byte("alice\n"))
+	expectLine(t, reader, "alice is registered. Password:", "guest")
+	conn.Write([]byte("wrong password\n"))
+	expectLine(t, reader, "Invalid username or password", "guest")
+
+	conn, reader = connectPipe(t, restarted)
+	conn.Write([]byte("reconnect:alice:not-the-token\n"))
+	expectLine(t, reader, "Invalid reconnect token", "guest")
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatal("connection stayed open after a bad reconnect token")
+	}
+
+	conn, reader = connectPipe(t, restarted)
+	conn.Write([]byte("login:alice:correct horse\n"))
+	expectLine(t, reader, "Welcome, alice!", "alice")
+	conn.Close()
+	waitUntilDisconnected(t, restarted, "alice")
+
+	// Guests are turned away when accounts are required
+	restarted.requireAuth = true
+	conn, reader = connectPipe(t, restarted)
+	conn.Write([]byte("bob\n"))
+	expectLine(t, reader, "requires an account", "bob")
+}
+
+func TestRegisteringAGuestName(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+	closeAtCleanup(t, cr)
+
+	// tokenOf returns the reconnect token in a token line
+	tokenOf := func(line string) string {
+		return strings.TrimSpace(line[strings.LastIndex(line, ":")+1:])
+	}
+
+	guest, guestReader := connectPipe(t, cr)
+	guest.Write([]byte("carol\n"))
+	guestToken := tokenOf(expectLine(t, guestReader, "reconnect:carol:", "carol"))
+	expectLine(t, guestReader, "Welcome, carol!", "carol")
+	syncHub(cr)
+
+	// Nobody can register the name while carol is using it...
+	conn, reader := connectPipe(t, cr)
+	conn.Write([]byte("register:carol:my password\n"))
+	expectLine(t, reader, "Username already connected", "mallory")
+	if cr.hasAccount("carol") {
+		t.Fatal("a connected guest's name was registered")
+	}
+
+	// ...nor get her token by taking the name once she is gone
+	guest.Close()
+	waitUntilDisconnected(t, cr, "carol")
+	conn, reader = connectPipe(t, cr)
+	conn.Write([]byte("carol\n"))
+	if token := tokenOf(expectLine(t, reader, "reconnect:carol:", "mallory")); token == guestToken {
+		t.Fatal("a new connection was handed the previous guest's token")
+	}
+	expectLine(t, reader, "Welcome, carol!", "mallory")
+	if cr.validateReconnectToken("carol", guestToken) {
+		t.Fatal("the previous guest's token still works")
+	}
+
+	// Registering a name replaces the token it had as a guest
+	conn.Write([]byte("/token\n"))
+	oldToken := tokenOf(expectLine(t, reader, "reconnect:carol:", "carol"))
+	conn.Write([]byte("/register correct-horse\n"))
+	expectLine(t, reader, "Registered carol", "carol")
+	newToken := tokenOf(expectLine(t, reader, "new reconnect token", "carol"))
+	if newToken == oldToken || cr.validateReconnectToken("carol", oldToken) {
+		t.Fatal("the guest token still works after registering")
+	}
+
+	conn.Close()
+	waitUntilDisconnected(t, cr, "carol")
+}
@@ -0,0 +1,221 @@
+package chatroom
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultChannel = "global"
+
+	kindJoin  = "join"
+	kindPart  = "part"
+	kindTopic = "topic"
+)
+
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+func newChannel(name string) *Channel {
+	return &Channel{
+		Name:    name,
+		Members: make(map[string]bool),
+	}
+}
+
+// normalizeChannelName turns user input like "#Go" into the stored name "go".
+func normalizeChannelName(name string) string {
+	return strings.ToLower(strings.TrimPrefix(name, "#"))
+}
+
+// isMember reports whether username belongs to channel. Everyone is a member
+// of the default channel, and the two participants of a private channel are
+// its only members.
+func (cr *ChatRoom) isMember(channel, username string) bool {
+	if channel == defaultChannel {
+		return true
+	}
+	if a, b, ok := privateParticipants(channel); ok {
+		return username == a || username == b
+	}
+
+	cr.channelsMu.Lock()
+	defer cr.channelsMu.Unlock()
+
+	ch, exists := cr.channels[channel]
+	return exists && ch.Members[username]
+}
+
+// memberChannels returns the channels username belongs to, sorted.
+func (cr *ChatRoom) memberChannels(username string) []string {
+	cr.channelsMu.Lock()
+	defer cr.channelsMu.Unlock()
+
+	channels := []string{defaultChannel}
+	for name, ch := range cr.channels {
+		if name != defaultChannel && ch.Members[username] {
+			channels = append(channels, name)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// applyChannelEvent folds a join, part or topic message into the channel
+// state. It is used both live and when replaying the snapshot and WAL, so it
+// must be idempotent.
+func (cr *ChatRoom) applyChannelEvent(msg Message) {
+	if msg.Kind != kindJoin && msg.Kind != kindPart && msg.Kind != kindTopic {
+		return
+	}
+
+	cr.channelsMu.Lock()
+	defer cr.channelsMu.Unlock()
+
+	ch, exists := cr.channels[msg.Channel]
+	if !exists {
+		ch = newChannel(msg.Channel)
+		cr.channels[msg.Channel] = ch
+	}
+
+	switch msg.Kind {
+	case kindJoin:
+		ch.Members[msg.From] = true
+	case kindPart:
+		delete(ch.Members, msg.From)
+	case kindTopic:
+		ch.Topic = msg.Content
+	}
+}
+
+// handleJoinCommand handles "/join #name": it joins the channel if needed and
+// makes it the client's current channel.
+func (cr *ChatRoom) handleJoinCommand(client *Client, args []string) {
+	if len(args) < 2 {
+		client.sendError("Usage: /join #channel")
+		return
+	}
+
+	channel := normalizeChannelName(args[1])
+	if !channelNamePattern.MatchString(channel) {
+		client.sendError("Channel names are 1-32 characters of a-z, 0-9, _ and -")
+		return
+	}
+
+	if cr.isMember(channel, client.username) {
+		client.setChannel(channel)
+		client.sendAck(fmt.Sprintf("Now talking in #%s", channel))
+		return
+	}
+
+	client.setChannel(channel)
+	cr.broadcast <- Message{
+		From:    client.username,
+		Channel: channel,
+		Kind:    kindJoin,
+	}
+}
+
+// handlePartCommand handles "/part [#name]", defaulting to the current channel.
+func (cr *ChatRoom) handlePartCommand(client *Client, args []string) {
+	channel := client.currentChannel()
+	if len(args) > 1 {
+		channel = normalizeChannelName(args[1])
+	}
+
+	if channel == defaultChannel {
+		client.sendError(fmt.Sprintf("You can't leave #%s", defaultChannel))
+		return
+	}
+
+	if !cr.isMember(channel, client.username) {
+		client.sendError(fmt.Sprintf("You are not in #%s", channel))
+		return
+	}
+
+	if client.currentChannel() == channel {
+		client.setChannel(defaultChannel)
+	}
+
+	cr.broadcast <- Message{
+		From:    client.username,
+		Channel: channel,
+		Kind:    kindPart,
+	}
+}
+
+// handleTopicCommand handles "/topic [#name] [text]": without text it shows
+// the topic, otherwise it sets it.
+func (cr *ChatRoom) handleTopicCommand(client *Client, args []string) {
+	channel := client.currentChannel()
+	args = args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "#") {
+		channel = normalizeChannelName(args[0])
+		args = args[1:]
+	}
+
+	if !cr.isMember(channel, client.username) {
+		client.sendError(fmt.Sprintf("You are not in #%s", channel))
+		return
+	}
+
+	if len(args) == 0 {
+		cr.channelsMu.Lock()
+		topic := cr.channels[channel].Topic
+		cr.channelsMu.Unlock()
+
+		if topic == "" {
+			client.sendSystem(fmt.Sprintf("No topic is set for #%s", channel))
+		} else {
+			client.sendSystem(fmt.Sprintf("Topic for #%s: %s", channel, topic))
+		}
+		return
+	}
+
+	cr.broadcast <- Message{
+		From:    client.username,
+		Content: strings.Join(args, " "),
+		Channel: channel,
+		Kind:    kindTopic,
+	}
+}
+
+// sendChannelList sends every known channel with its member count and topic.
+// The client's own channels are marked, the current one with a "*".
+func (cr *ChatRoom) sendChannelList(client *Client) {
+	current := client.currentChannel()
+
+	cr.channelsMu.Lock()
+	names := make([]string, 0, len(cr.channels))
+	for name := range cr.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := "Channels:\n"
+	for _, name := range names {
+		ch := cr.channels[name]
+
+		marker := " "
+		if name == current {
+			marker = "*"
+		} else if name == defaultChannel || ch.Members[client.username] {
+			marker = "+"
+		}
+
+		members := fmt.Sprintf("%d members", len(ch.Members))
+		if name == defaultChannel {
+			members = "everyone"
+		}
+
+		list += fmt.Sprintf(" %s #%s (%s)", marker, name, members)
+		if ch.Topic != "" {
+			list += " - " + ch.Topic
+		}
+		list += "\n"
+	}
+	cr.channelsMu.Unlock()
+
+	client.sendSystem(list)
+}
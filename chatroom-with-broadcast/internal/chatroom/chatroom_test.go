@@ -1,13 +1,32 @@
 package chatroom
 
 import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
 	"strings"
 	"testing"
 	"time"
 )
 
+func TestMain(m *testing.M) {
+	// Tests that need a slow client make one; random ones only add flakiness
+	slowClientFraction = 0
+	os.Exit(m.Run())
+}
+
 func TestBroadcast(t *testing.T) {
-	cr, _ := NewChatRoom("./testdata")
+	// Opening the room writes to its data directory, so work on a copy of
+	// the fixtures
+	dir := t.TempDir()
+	if err := os.CopyFS(dir, os.DirFS("testdata")); err != nil {
+		t.Fatal(err)
+	}
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
 	defer cr.shutdown()
 
 	go cr.Run()
@@ -15,11 +34,11 @@ func TestBroadcast(t *testing.T) {
 	// Create mock clients
 	client1 := &Client{
 		username: "Alice",
-		outgoing: make(chan string, 10),
+		outgoing: make(chan Event, 10),
 	}
 	client2 := &Client{
 		username: "Bob",
-		outgoing: make(chan string, 10),
+		outgoing: make(chan Event, 10),
 	}
 
 	// Join clients
@@ -28,14 +47,14 @@ func TestBroadcast(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Broadcast message
-	cr.broadcast <- "[Alice]: Hello!"
+	cr.broadcast <- Message{From: "Alice", Content: "Hello!"}
 
 	// Verify both receive it (ignore join/history noise)
 	expectMessageContains(t, client1.outgoing, "Hello!", "Client1")
 	expectMessageContains(t, client2.outgoing, "Hello!", "Client2")
 }
 
-func expectMessageContains(t *testing.T, ch <-chan string, substr, label string) {
+func expectMessageContains(t *testing.T, ch <-chan Event, substr, label string) {
 	t.Helper()
 
 	timeout := time.After(1 * time.Second)
@@ -43,9 +62,9 @@ func expectMessageContains(t *testing.T, ch <-chan string, substr, label string)
 
 	for {
 		select {
-		case msg := <-ch:
-			last = msg
-			if strings.Contains(msg, substr) {
+		case event := <-ch:
+			last = event.Text()
+			if strings.Contains(last, substr) {
 				return
 			}
 		case <-timeout:
@@ -56,3 +75,302 @@ func expectMessageContains(t *testing.T, ch <-chan string, substr, label string)
 		}
 	}
 }
+
+func TestChannels(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+
+	alice := &Client{username: "Alice", outgoing: make(chan Event, 10)}
+	bob := &Client{username: "Bob", outgoing: make(chan Event, 10)}
+	cr.join <- alice
+	cr.join <- bob
+
+	handleCommand(alice, cr, "/join #Go")
+	expectMessageContains(t, alice.outgoing, "Alice joined #go", "Alice")
+	handleCommand(alice, cr, "/topic gophers only")
+	expectMessageContains(t, alice.outgoing, "gophers only", "Alice")
+
+	cr.broadcast <- Message{From: "Alice", Content: "secret plans", Channel: alice.currentChannel()}
+	cr.broadcast <- Message{From: "Bob", Content: "hello everyone"}
+	expectMessageContains(t, alice.outgoing, "#go [Alice]: secret plans", "Alice")
+	for msg := ""; !strings.Contains(msg, "hello everyone"); {
+		select {
+		case event := <-bob.outgoing:
+			msg = event.Text()
+			if strings.Contains(msg, "secret plans") {
+				t.Fatalf("Bob received a message from a channel he is not in: %q", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Bob didn't receive the message in #global")
+		}
+	}
+
+	// Membership and topic come back from the WAL after a restart
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom after restart: %v", err)
+	}
+	if !restarted.isMember("go", "Alice") || restarted.isMember("go", "Bob") {
+		t.Fatalf("membership of #go not restored: %+v", restarted.channels["go"].Members)
+	}
+	if topic := restarted.channels["go"].Topic; topic != "gophers only" {
+		t.Fatalf("topic of #go = %q, want %q", topic, "gophers only")
+	}
+
+	// ...and from the snapshot once the WAL has been folded into it
+	if err := restarted.createSnapshot(); err != nil {
+		t.Fatalf("createSnapshot: %v", err)
+	}
+	fromSnapshot, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom from snapshot: %v", err)
+	}
+	if !fromSnapshot.isMember("go", "Alice") || fromSnapshot.channels["go"].Topic != "gophers only" {
+		t.Fatalf("channel state not restored from snapshot: %+v", fromSnapshot.channels["go"])
+	}
+}
+
+func TestSessionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+
+	session := cr.createSession("Alice")
+	cr.createSession("Bob")
+
+	// Bob disappeared long ago; his session must not come back
+	cr.sessionsMu.Lock()
+	cr.sessions["Bob"].LastSeen = time.Now().Add(-2 * defaultSessionTTL)
+	cr.saveSessions()
+	cr.sessionsMu.Unlock()
+
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatalf("NewChatRoom after restart: %v", err)
+	}
+	if !restarted.validateReconnectToken("Alice", session.ReconnectToken) {
+		t.Fatal("Alice's reconnect token was not accepted after a restart")
+	}
+	if _, exists := restarted.sessions["Bob"]; exists {
+		t.Fatal("Bob's expired session was loaded")
+	}
+}
+
+func TestReconnectReplaysMissedMessages(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+
+	cursor := cr.createSession("Alice").LastMessageID
+	for _, text := range []string{"first", "second", "third"} {
+		cr.broadcast <- Message{From: "Bob", Content: text}
+	}
+
+	alice := &Client{
+		username:      "Alice",
+		outgoing:      make(chan Event, 10),
+		resuming:      true,
+		lastMessageID: cursor,
+	}
+	cr.join <- alice
+	expectMessageContains(t, alice.outgoing, "You missed 3 messages", "Alice")
+	expectMessageContains(t, alice.outgoing, "Alice joined the chat", "Alice")
+
+	// Only the newest messages fit; the rest are reported as skipped
+	alice.mu.Lock()
+	alice.lastMessageID = cursor
+	alice.mu.Unlock()
+	cr.replayMissed(alice, 3)
+	select {
+	case event := <-alice.outgoing:
+		replay := event.Text()
+		if !strings.Contains(replay, "1 more messages were skipped") ||
+			strings.Contains(replay, "first") || !strings.Contains(replay, "third") {
+			t.Fatalf("unexpected replay: %q", replay)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Alice didn't receive the replay")
+	}
+}
+
+func TestReplayAfterUnwrittenFrames(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+	closeAtCleanup(t, cr)
+
+	alice, aliceReader := connectPipe(t, cr)
+	alice.Write([]byte("alice\n"))
+	token := expectLine(t, aliceReader, "reconnect:alice:", "alice")
+	token = strings.TrimSpace(token[strings.LastIndex(token, ":")+1:])
+	expectLine(t, aliceReader, "Welcome, alice!", "alice")
+
+	// alice stops reading, so what bob sends stays in her queue
+	bob, bobReader := connectPipe(t, cr)
+	bob.Write([]byte("bob\n"))
+	expectLine(t, bobReader, "Welcome, bob!", "bob")
+	bob.Write([]byte("one\ntwo\n/msg alice psst\n"))
+	expectLine(t, bobReader, "Message sent to alice", "bob")
+
+	alice.Close()
+	waitUntilDisconnected(t, cr, "alice")
+
+	// Nothing queued was written, so all of it is replayed, DM included
+	alice, aliceReader = connectPipe(t, cr)
+	alice.Write([]byte("reconnect:alice:" + token + "\n"))
+	expectLine(t, aliceReader, "You missed", "alice")
+	expectLine(t, aliceReader, "[bob]: one", "alice")
+	expectLine(t, aliceReader, "[bob]: two", "alice")
+	expectLine(t, aliceReader, "psst", "alice")
+
+	alice.Close()
+	bob.Close()
+	waitUntilDisconnected(t, cr, "alice")
+	waitUntilDisconnected(t, cr, "bob")
+}
+
+func TestJSONProtocol(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+
+	server, conn := net.Pipe()
+	go handleClient(server, cr)
+
+	// Let the server finish saving the session before the data dir goes away
+	t.Cleanup(func() {
+		conn.Close()
+		waitUntilDisconnected(t, cr, "Alice")
+	})
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatalf("reading prompt: %v", err)
+	}
+
+	// nextFrame reads frames until one of the wanted type arrives, or returns
+	// the next frame if frameType is empty
+	nextFrame := func(frameType string) Event {
+		t.Helper()
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				t.Fatalf("waiting for %s frame: %v", frameType, err)
+			}
+			var ev Event
+			if err := json.Unmarshal(line, &ev); err != nil {
+				t.Fatalf("server sent a non-JSON line %q: %v", line, err)
+			}
+			if frameType == "" || ev.Type == frameType {
+				return ev
+			}
+		}
+	}
+
+	conn.Write([]byte(`{"type":"hello","username":"Alice"}` + "\n"))
+	if welcome := nextFrame(frameSystem); welcome.Seq != 0 || welcome.Timestamp.IsZero() {
+		t.Fatalf("unexpected handshake frame: %+v", welcome)
+	}
+	nextFrame(frameHistoryBatch)
+
+	// The ack and the broadcast may arrive in either order
+	conn.Write([]byte(`{"type":"message","ref":"m1","content":"status: ok"}` + "\n"))
+	var ack, msg *Event
+	for ack == nil || msg == nil {
+		ev := nextFrame("")
+		switch ev.Type {
+		case frameAck:
+			ack = &ev
+		case frameMessage:
+			if ev.Message.From != "system" {
+				msg = &ev
+			}
+		}
+	}
+	if ack.Ref != "m1" {
+		t.Fatalf("ack ref = %q, want %q", ack.Ref, "m1")
+	}
+	if msg.Message.From != "Alice" || msg.Message.Content != "status: ok" || msg.Seq == 0 {
+		t.Fatalf("unexpected message frame: %+v %+v", msg, msg.Message)
+	}
+
+	conn.Write([]byte(`{"type":"command","content":"/users"}` + "\n"))
+	if list := nextFrame(frameUserList); len(list.Users) != 1 || list.Users[0].Username != "Alice" {
+		t.Fatalf("unexpected user list: %+v", list.Users)
+	}
+}
+
+// waitUntilDisconnected waits for the server to finish tearing down username's
+// connection, including saving their session and storing their leave notice.
+func waitUntilDisconnected(t *testing.T, cr *ChatRoom, username string) {
+	t.Helper()
+
+	// A client is welcomed once the hub has taken its join, so this first
+	// waits for the join to be handled
+	syncHub(cr)
+	deadline := time.Now().Add(time.Second)
+	for cr.isUsernameConnected(username) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is still connected", username)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The client is removed before its leave notice is broadcast
+	syncHub(cr)
+}
+
+// syncHub returns once cr's hub has finished the event it was handling.
+func syncHub(cr *ChatRoom) {
+	cr.leave <- &Client{} // a leave for a client that never joined does nothing
+}
+
+// closeAtCleanup shuts cr down when the test ends, before its temp dir is
+// removed. Tests must wait for their clients to disconnect first, or the hub
+// may still be writing.
+func closeAtCleanup(t *testing.T, cr *ChatRoom) {
+	t.Cleanup(cr.shutdown)
+}
+
+// connectPipe starts a server-side handleClient on one end of an in-memory
+// connection and returns the other end, with a reader positioned after the
+// username prompt.
+func connectPipe(t *testing.T, cr *ChatRoom) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	server, conn := net.Pipe()
+	go handleClient(server, cr)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	expectLine(t, reader, "Enter username", "client")
+	return conn, reader
+}
+
+// expectLine reads lines until one contains substr and returns it.
+func expectLine(t *testing.T, reader *bufio.Reader, substr, label string) string {
+	t.Helper()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s didn't receive a line containing %q: %v", label, substr, err)
+		}
+		if strings.Contains(line, substr) {
+			return line
+		}
+	}
+}
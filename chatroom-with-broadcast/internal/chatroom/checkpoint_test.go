@@ -0,0 +1,87 @@
+package chatroom
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// checkpointSteps are the crashPoint steps of createSnapshot, in order.
+var checkpointSteps = []string{"rotated", "snapshot-written", "snapshot-renamed", "wal-compacted"}
+
+// TestCheckpointCrashHelper is run in a child process by
+// TestCheckpointSurvivesCrash. It writes some messages, checkpoints twice and
+// exits abruptly at the requested step of the second checkpoint, logging one
+// more message at every step to race with it.
+func TestCheckpointCrashHelper(t *testing.T) {
+	dir, crashAt := os.Getenv("CHECKPOINT_DIR"), os.Getenv("CHECKPOINT_CRASH_AT")
+	if dir == "" {
+		t.Skip("only run by TestCheckpointSurvivesCrash")
+	}
+
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		cr.handleBroadcast(Message{From: "alice", Content: fmt.Sprintf("before %d", i)})
+	}
+	if err := cr.createSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 3; i < 6; i++ {
+		cr.handleBroadcast(Message{From: "alice", Content: fmt.Sprintf("before %d", i)})
+	}
+
+	crashPoint = func(step string) {
+		cr.handleBroadcast(Message{From: "bob", Content: "during " + step})
+		if step == crashAt {
+			os.Exit(3)
+		}
+	}
+	cr.createSnapshot()
+	t.Fatalf("didn't crash at %q", crashAt)
+}
+
+func TestCheckpointSurvivesCrash(t *testing.T) {
+	for i, step := range checkpointSteps {
+		t.Run(step, func(t *testing.T) {
+			dir := t.TempDir()
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestCheckpointCrashHelper$")
+			cmd.Env = append(os.Environ(), "CHECKPOINT_DIR="+dir, "CHECKPOINT_CRASH_AT="+step)
+			var exitErr *exec.ExitError
+			if err := cmd.Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+				t.Fatalf("helper didn't crash as expected: %v", err)
+			}
+
+			cr, err := NewChatRoom(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cr.wal.Close()
+
+			// Every message comes back exactly once, in order
+			var want []string
+			for j := 0; j < 6; j++ {
+				want = append(want, fmt.Sprintf("before %d", j))
+			}
+			for _, s := range checkpointSteps[:i+1] {
+				want = append(want, "during "+s)
+			}
+
+			var got []string
+			for j, msg := range cr.windowMessages() {
+				if msg.ID != j {
+					t.Fatalf("message %d has ID %d", j, msg.ID)
+				}
+				got = append(got, msg.Content)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("recovered %q\nwant      %q", got, want)
+			}
+		})
+	}
+}
@@ -2,53 +2,142 @@ package chatroom
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
+// reconnectTimeout is how long the client keeps trying to reach a server
+// that restarted.
+const reconnectTimeout = 30 * time.Second
+
 // StartClient connects to the local chat server and relays stdin/stdout.
 func StartClient() {
-	conn, err := net.Dial("tcp", ":9000")
+	StartClientWithConfig(DefaultClientConfig())
+}
+
+// StartClientWithConfig connects to the chat server described by cfg and
+// relays stdin/stdout. When the server shuts down it hands out a reconnect
+// token, and the client uses it to resume the session on the server that
+// replaces it.
+func StartClientWithConfig(cfg ClientConfig) {
+	tlsConfig, err := clientTLSConfig(cfg)
+	if err != nil {
+		fmt.Println("Error configuring TLS:", err)
+		return
+	}
 
+	dial := func() (net.Conn, error) {
+		if tlsConfig != nil {
+			return tls.Dial("tcp", cfg.Addr, tlsConfig)
+		}
+		return net.Dial("tcp", cfg.Addr)
+	}
+
+	conn, err := dial()
 	if err != nil {
 		fmt.Println("Error connecting to server:", err)
 		return
 	}
-	defer conn.Close()
 
 	fmt.Println("Connected to chat server")
 
-	// Start reading from server (in background)
+	// Read input from user in the background. Lines typed while reconnecting
+	// wait here.
+	input := make(chan string)
 	go func() {
-		reader := bufio.NewReader(conn)
+		inputReader := bufio.NewReader(os.Stdin)
 		for {
-			message, err := reader.ReadString('\n') // Waits for Enter key
+			message, err := inputReader.ReadString('\n') // Waits for Enter key
 			if err != nil {
-				fmt.Println("Disconnected from server.")
-				os.Exit(0)
+				close(input)
+				return
+			}
+			message = strings.TrimSpace(message)
+			if message != "" {
+				input <- message
 			}
-			fmt.Print("\r" + message)
-			fmt.Print(">> ")
 		}
 	}()
 
-	// Read input from user and send to server
-	inputReader := bufio.NewReader(os.Stdin)
-
 	fmt.Println("Welcome to the chat server!")
+	fmt.Print(">> ")
 
 	for {
-		fmt.Print(">> ")
-		message, _ := inputReader.ReadString('\n') // Waits for Enter key
-		message = strings.TrimSpace(message)
+		reconnect := relay(conn, input)
+		conn.Close()
+		if reconnect == "" {
+			fmt.Println("Disconnected from server.")
+			return
+		}
+
+		fmt.Println("\rReconnecting...")
+		conn, err = redial(dial)
+		if err != nil {
+			fmt.Println("Error reconnecting to server:", err)
+			return
+		}
+		conn.Write([]byte(reconnect + "\n"))
+	}
+}
 
-		if message == "" {
-			continue
+// relay prints lines from the server and sends the user's lines to it until
+// the connection ends. If the server said it was shutting down, relay returns
+// the reconnect line it gave out.
+func relay(conn net.Conn, input <-chan string) string {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(conn)
+		for {
+			message, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- message
 		}
+	}()
 
-		// Write/Send message to the server
-		conn.Write([]byte(message + "\n"))
+	var reconnect string
+	for {
+		select {
+		case message, ok := <-lines:
+			if !ok {
+				return reconnect
+			}
+			fmt.Print("\r" + message)
+			fmt.Print(">> ")
+			if _, line, found := strings.Cut(message, "Reconnect with "); found {
+				reconnect = strings.TrimSuffix(strings.TrimSpace(line), " ***")
+			}
+		case message, ok := <-input:
+			if !ok {
+				input = nil // stdin is closed; keep printing what arrives
+				continue
+			}
+			// Write/Send message to the server
+			conn.Write([]byte(message + "\n"))
+		}
+	}
+}
+
+// redial retries dial with backoff until it succeeds or reconnectTimeout
+// passes.
+func redial(dial func() (net.Conn, error)) (net.Conn, error) {
+	deadline := time.Now().Add(reconnectTimeout)
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := dial()
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("gave up after %s: %w", reconnectTimeout, err)
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, 2*time.Second)
 	}
 }
@@ -0,0 +1,483 @@
+package chatroom
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Cluster federation
+//
+// Nodes form a full mesh: each node dials every peer and sends its own
+// events over that outbound link - the messages it assigned IDs to, DMs
+// included, and its list of connected users. Inbound links are only read
+// from. Every node stores every message, so history and replays work the
+// same on all of them.
+//
+// Message IDs stay globally unique because each node only assigns IDs that
+// are congruent to its node ID modulo maxClusterNodes, and they stay ordered
+// because every node moves its counter past any ID it sees (a Lamport
+// clock). Messages are stored and replayed in ID order.
+//
+// Both ends of a link prove they know the cluster secret: each sends a nonce
+// and the other answers with an HMAC of it, its node ID and, with TLS, the
+// TLS session, so the proof can't be replayed or relayed. With TLS the links
+// are encrypted, but certificates aren't checked; the secret authenticates.
+// A node only accepts messages whose IDs the sending node could assign.
+
+// maxClusterNodes bounds node IDs and is the stride between the IDs a node
+// assigns.
+const maxClusterNodes = 64
+
+// Frame types exchanged between nodes.
+const (
+	peerHello    = "hello"    // dialer -> acceptor: who is connecting
+	peerSync     = "sync"     // acceptor -> dialer: who answered, its proof, and what it has already
+	peerAuth     = "auth"     // dialer -> acceptor: the dialer's proof
+	peerMessage  = "message"  // a message the sending node assigned an ID to
+	peerPresence = "presence" // the full list of users connected to the sending node
+	peerDown     = "down"     // internal: the inbound link from a node was lost
+)
+
+// peerFrame is one JSON line on a peer link.
+type peerFrame struct {
+	Type    string   `json:"type"`
+	Node    int      `json:"node"`
+	Since   int      `json:"since,omitempty"`   // sync: newest ID already held from the dialing node
+	Message *Message `json:"message,omitempty"` // message
+	Users   []string `json:"users,omitempty"`   // presence
+	Nonce   string   `json:"nonce,omitempty"`   // hello and sync: the challenge for the other end
+	Auth    string   `json:"auth,omitempty"`    // sync and auth: the answer to the other end's nonce
+}
+
+// peerQueueSize is how many frames are buffered for a peer that is slow or
+// unreachable. A link whose queue overflows is closed, and the reconnect
+// catches the peer up on the messages that didn't fit.
+const peerQueueSize = 1024
+
+// cluster is a node's view of its peers.
+type cluster struct {
+	nodeID    int
+	listener  net.Listener
+	secret    string
+	tlsConfig *tls.Config // for dialing peers; nil without TLS
+
+	mu    sync.Mutex
+	links []*peerLink
+	byID  map[int]*peerLink // links whose peer has answered
+}
+
+// peerLink is the outbound connection to one peer.
+type peerLink struct {
+	addr  string
+	queue chan peerFrame
+
+	mu   sync.Mutex
+	conn net.Conn // while connected
+}
+
+// joinCluster makes cr node nodeID of a cluster: it accepts peer links on
+// listener and keeps a link open to every address in peers, authenticating
+// both with secret. A non-nil tlsConfig serves the links over TLS. It must
+// be called before Run.
+func (cr *ChatRoom) joinCluster(nodeID int, listener net.Listener, peers []string, secret string, tlsConfig *tls.Config) error {
+	if nodeID < 0 || nodeID >= maxClusterNodes {
+		return fmt.Errorf("node ID %d out of range [0, %d)", nodeID, maxClusterNodes)
+	}
+	if secret == "" {
+		return errors.New("a cluster secret is required")
+	}
+
+	c := &cluster{
+		nodeID: nodeID,
+		secret: secret,
+		byID:   make(map[int]*peerLink),
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		c.tlsConfig = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+			// Peers are authenticated by the secret, bound to the session
+			InsecureSkipVerify: true,
+		}
+	}
+	c.listener = listener
+	cr.cluster = c
+
+	go cr.acceptPeers(listener)
+	for _, addr := range peers {
+		link := &peerLink{addr: addr, queue: make(chan peerFrame, peerQueueSize)}
+		cr.cluster.links = append(cr.cluster.links, link)
+		go cr.runPeerLink(link)
+	}
+
+	fmt.Printf("Cluster node %d listening for peers on %s\n", nodeID, listener.Addr())
+	return nil
+}
+
+// idStride is the distance between two IDs assigned by the same node. With
+// Raft every node assigns the same IDs in log order, so there is no stride.
+func (cr *ChatRoom) idStride() int {
+	if cr.cluster == nil || cr.raft != nil {
+		return 1
+	}
+	return maxClusterNodes
+}
+
+// nodeID is this node's ID, 0 outside a cluster.
+func (cr *ChatRoom) nodeID() int {
+	if cr.cluster == nil {
+		return 0
+	}
+	return cr.cluster.nodeID
+}
+
+// allocateMessageIDLocked returns a new message ID greater than every ID
+// seen so far. Callers must hold cr.messageMu.
+func (cr *ChatRoom) allocateMessageIDLocked() int {
+	stride := cr.idStride()
+	id := cr.nextMessageID
+	id += ((cr.nodeID()-id%stride)%stride + stride) % stride
+	cr.nextMessageID = id + 1
+	return id
+}
+
+// forward queues frame for every peer.
+func (c *cluster) forward(frame peerFrame) {
+	frame.Node = c.nodeID
+	for _, link := range c.links {
+		link.enqueue(frame)
+	}
+}
+
+// enqueue queues frame for the peer. If the queue is full the frame is
+// dropped and so is the connection, whose replacement starts with a catch-up.
+func (l *peerLink) enqueue(frame peerFrame) {
+	select {
+	case l.queue <- frame:
+	default:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.conn != nil {
+			fmt.Printf(" Peer %s is not keeping up, reconnecting to catch it up\n", l.addr)
+			l.conn.Close()
+			l.conn = nil
+		}
+	}
+}
+
+func (l *peerLink) setConn(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conn = conn
+}
+
+// runPeerLink keeps the outbound link to a peer open, redialling when it
+// drops.
+func (cr *ChatRoom) runPeerLink(link *peerLink) {
+	for {
+		conn, err := net.DialTimeout("tcp", link.addr, 5*time.Second)
+		if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		if cr.cluster.tlsConfig != nil {
+			conn = tls.Client(conn, cr.cluster.tlsConfig)
+		}
+
+		link.setConn(conn)
+		if err := cr.streamToPeer(link, conn); err != nil {
+			fmt.Printf(" Peer link to %s lost: %v\n", link.addr, err)
+		}
+		link.setConn(nil)
+		conn.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+// streamToPeer introduces this node, sends the peer the messages from this
+// node it has not seen and the current user list, then streams queued frames
+// until the connection fails.
+func (cr *ChatRoom) streamToPeer(link *peerLink, conn net.Conn) error {
+	c := cr.cluster
+	binding, err := sessionBinding(conn)
+	if err != nil {
+		return err
+	}
+
+	nonce := newNonce()
+	enc := json.NewEncoder(conn)
+	if err := enc.Encode(peerFrame{Type: peerHello, Node: c.nodeID, Nonce: nonce}); err != nil {
+		return err
+	}
+
+	var answer peerFrame
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(line, &answer); err != nil || answer.Type != peerSync {
+		return fmt.Errorf("bad handshake from %s", link.addr)
+	}
+	if !c.validPeer(answer.Node) || !hmac.Equal([]byte(answer.Auth), []byte(c.proof(peerSync, nonce, answer.Node, binding))) {
+		return fmt.Errorf("%s failed to authenticate as node %d", link.addr, answer.Node)
+	}
+	proof := peerFrame{Type: peerAuth, Node: c.nodeID, Auth: c.proof(peerAuth, answer.Nonce, c.nodeID, binding)}
+	if err := enc.Encode(proof); err != nil {
+		return err
+	}
+
+	cr.cluster.mu.Lock()
+	cr.cluster.byID[answer.Node] = link
+	cr.cluster.mu.Unlock()
+	fmt.Printf("Linked to cluster node %d at %s\n", answer.Node, link.addr)
+
+	// Catch the peer up on this node's own messages. Messages are stored
+	// before they are queued, so the catch-up covers the queued ones, which
+	// are dropped along with stale user lists. Messages queued from here on
+	// may be sent twice; the peer ignores IDs it has stored.
+	for drained := false; !drained; {
+		select {
+		case <-link.queue:
+		default:
+			drained = true
+		}
+	}
+	err = cr.eachMessageFromNode(cr.cluster.nodeID, answer.Since, func(msg Message) error {
+		return enc.Encode(peerFrame{Type: peerMessage, Node: cr.cluster.nodeID, Message: &msg})
+	})
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(cr.presenceFrame()); err != nil {
+		return err
+	}
+
+	for frame := range link.queue {
+		if err := enc.Encode(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// acceptPeers reads inbound peer links until listener is closed.
+func (cr *ChatRoom) acceptPeers(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go cr.readFromPeer(conn)
+	}
+}
+
+// peerHandshakeTimeout bounds how long an inbound peer has to authenticate.
+const peerHandshakeTimeout = 10 * time.Second
+
+// readFromPeer answers a peer's hello, checks its proof and hands every frame
+// it sends to the hub.
+func (cr *ChatRoom) readFromPeer(conn net.Conn) {
+	defer conn.Close()
+	c := cr.cluster
+	reader := bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	binding, err := sessionBinding(conn)
+	if err != nil {
+		return
+	}
+
+	var hello peerFrame
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(line, &hello); err != nil || hello.Type != peerHello {
+		fmt.Printf(" Rejected peer %s: bad hello\n", conn.RemoteAddr())
+		return
+	}
+	node := hello.Node
+	if !c.validPeer(node) {
+		fmt.Printf(" Rejected peer %s: invalid node ID %d\n", conn.RemoteAddr(), node)
+		return
+	}
+
+	cr.messageMu.Lock()
+	since, ok := cr.lastFromNode[node]
+	cr.messageMu.Unlock()
+	if !ok {
+		since = -1
+	}
+	nonce := newNonce()
+	answer := peerFrame{Type: peerSync, Node: c.nodeID, Since: since, Nonce: nonce, Auth: c.proof(peerSync, hello.Nonce, c.nodeID, binding)}
+	if err := json.NewEncoder(conn).Encode(answer); err != nil {
+		return
+	}
+
+	var proof peerFrame
+	line, err = reader.ReadBytes('\n')
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(line, &proof); err != nil || proof.Type != peerAuth ||
+		!hmac.Equal([]byte(proof.Auth), []byte(c.proof(peerAuth, nonce, node, binding))) {
+		fmt.Printf(" Rejected peer %s: failed to authenticate as node %d\n", conn.RemoteAddr(), node)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			cr.peerFrames <- peerFrame{Type: peerDown, Node: node}
+			return
+		}
+
+		var frame peerFrame
+		if err := json.Unmarshal(line, &frame); err != nil {
+			fmt.Printf(" Skipping bad frame from node %d\n", node)
+			continue
+		}
+		frame.Node = node
+		cr.peerFrames <- frame
+	}
+}
+
+// validPeer reports whether node can be the ID of another node.
+func (c *cluster) validPeer(node int) bool {
+	return node >= 0 && node < maxClusterNodes && node != c.nodeID
+}
+
+// proof is what the end of a link sending a frame of type step shows to
+// prove that node knows the secret, in answer to nonce.
+func (c *cluster) proof(step, nonce string, node int, binding []byte) string {
+	mac := hmac.New(sha256.New, []byte(c.secret))
+	fmt.Fprintf(mac, "%s\n%s\n%d\n", step, nonce, node)
+	mac.Write(binding)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newNonce returns a random challenge.
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// sessionBinding returns keying material unique to conn's TLS session, or
+// nil for a plain connection. Proofs that include it are only good on conn.
+func sessionBinding(conn net.Conn) ([]byte, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return state.ExportKeyingMaterial("chatroom peer link", nil, 32)
+}
+
+// catchUpPageSize is how many messages of a channel are read from the
+// history log at a time while catching a peer up.
+const catchUpPageSize = 256
+
+// eachMessageFromNode calls fn with every stored message node assigned an ID
+// to that is newer than since, channel by channel, stopping at the first
+// error.
+func (cr *ChatRoom) eachMessageFromNode(node, since int, fn func(Message) error) error {
+	for _, channel := range cr.history.Channels() {
+		after := since
+		for {
+			page := cr.readHistory(cr.history.After(channel, after, catchUpPageSize))
+			for _, msg := range page {
+				if msg.ID%maxClusterNodes != node {
+					continue
+				}
+				if err := fn(msg); err != nil {
+					return err
+				}
+			}
+			if len(page) < catchUpPageSize {
+				break
+			}
+			after = page[len(page)-1].ID
+		}
+	}
+	return nil
+}
+
+// presenceFrame lists the users connected to this node.
+func (cr *ChatRoom) presenceFrame() peerFrame {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	frame := peerFrame{Type: peerPresence, Node: cr.nodeID()}
+	for client := range cr.clients {
+		frame.Users = append(frame.Users, client.username)
+	}
+	return frame
+}
+
+// announcePresence tells the peers who is connected to this node.
+func (cr *ChatRoom) announcePresence() {
+	if cr.cluster != nil {
+		cr.cluster.forward(cr.presenceFrame())
+	}
+}
+
+// handlePeerFrame applies a frame received from another node. It runs on the
+// hub goroutine.
+func (cr *ChatRoom) handlePeerFrame(frame peerFrame) {
+	switch frame.Type {
+	case peerMessage:
+		if frame.Message == nil {
+			return
+		}
+		if frame.Message.ID%maxClusterNodes != frame.Node {
+			fmt.Printf(" Dropped message %d from node %d, which can't have assigned its ID\n", frame.Message.ID, frame.Node)
+			return
+		}
+		cr.handleRemoteMessage(*frame.Message)
+	case peerPresence, peerDown:
+		cr.mu.Lock()
+		for username, node := range cr.remoteUsers {
+			if node == frame.Node {
+				delete(cr.remoteUsers, username)
+			}
+		}
+		for _, username := range frame.Users {
+			cr.remoteUsers[username] = frame.Node
+		}
+		cr.mu.Unlock()
+	}
+}
+
+// handleRemoteMessage stores, persists and delivers a message that another
+// node assigned an ID to. Messages already stored are ignored.
+func (cr *ChatRoom) handleRemoteMessage(msg Message) {
+	cr.messageMu.Lock()
+	stored := cr.storeMessageLocked(msg)
+	cr.messageMu.Unlock()
+	if !stored {
+		return
+	}
+
+	cr.applyChannelEvent(msg)
+
+	if err := cr.persistMessage(msg); err != nil {
+		fmt.Printf("Failed to persist message: %v\n", err)
+	}
+
+	cr.deliver(msg)
+}
@@ -0,0 +1,278 @@
+package chatroom
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Caesarsage/chatroom/pkg/devcert"
+)
+
+const testClusterSecret = "cluster secret"
+
+// startCluster starts n nodes peered over loopback, with node IDs 1..n.
+func startCluster(t *testing.T, n int) []*ChatRoom {
+	t.Helper()
+
+	listeners := make([]net.Listener, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		listeners[i] = l
+	}
+
+	nodes := make([]*ChatRoom, n)
+	for i := range nodes {
+		cr, err := NewChatRoom(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cr.shutdown)
+
+		var peers []string
+		for j, l := range listeners {
+			if j != i {
+				peers = append(peers, l.Addr().String())
+			}
+		}
+		if err := cr.joinCluster(i+1, listeners[i], peers, testClusterSecret, nil); err != nil {
+			t.Fatal(err)
+		}
+		go cr.Run()
+		nodes[i] = cr
+	}
+	return nodes
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	nodes := startCluster(t, 3)
+
+	alice, aliceReader := connectPipe(t, nodes[0])
+	alice.Write([]byte("alice\n"))
+	expectLine(t, aliceReader, "Welcome, alice!", "alice")
+
+	bob, bobReader := connectPipe(t, nodes[1])
+	bob.Write([]byte("bob\n"))
+	expectLine(t, bobReader, "Welcome, bob!", "bob")
+
+	for _, node := range nodes {
+		waitFor(t, "cluster-wide presence", func() bool {
+			return node.isUsernameConnected("alice") && node.isUsernameConnected("bob")
+		})
+	}
+
+	// A name in use on one node can't be taken on another
+	other, otherReader := connectPipe(t, nodes[2])
+	other.Write([]byte("alice\n"))
+	expectLine(t, otherReader, "Username already connected", "second alice")
+
+	alice.Write([]byte("hello cluster\n"))
+	expectLine(t, bobReader, "[alice]: hello cluster", "bob")
+
+	bob.Write([]byte("/users\n"))
+	expectLine(t, bobReader, "alice (node 1)", "bob's user list")
+
+	bob.Write([]byte("/msg alice hi from node 2\n"))
+	expectLine(t, bobReader, "Message sent to alice", "bob")
+	expectLine(t, aliceReader, "[From bob]: hi from node 2", "alice")
+
+	// Every node ends up with the same history, in the same order
+	messageIDs := func(node *ChatRoom) []int {
+		node.messageMu.Lock()
+		defer node.messageMu.Unlock()
+		var ids []int
+		for _, msg := range node.windowMessagesLocked() {
+			ids = append(ids, msg.ID)
+		}
+		return ids
+	}
+	waitFor(t, "replication", func() bool {
+		want := fmt.Sprint(messageIDs(nodes[0]))
+		return fmt.Sprint(messageIDs(nodes[1])) == want && fmt.Sprint(messageIDs(nodes[2])) == want
+	})
+
+	ids := messageIDs(nodes[0])
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("IDs out of order: %v", ids)
+		}
+	}
+
+	nodes[2].messageMu.Lock()
+	defer nodes[2].messageMu.Unlock()
+	for _, msg := range nodes[2].windowMessagesLocked() {
+		if msg.Content == "hello cluster" && msg.ID%maxClusterNodes != 1 {
+			t.Fatalf("message sent on node 1 has ID %d", msg.ID)
+		}
+	}
+}
+
+func TestPeerLinkOverflow(t *testing.T) {
+	server, peer := net.Pipe()
+	defer peer.Close()
+	link := &peerLink{addr: "peer", queue: make(chan peerFrame, 1)}
+	link.setConn(server)
+
+	link.enqueue(peerFrame{Type: peerPresence})
+	link.enqueue(peerFrame{Type: peerPresence}) // doesn't fit
+
+	// The link is closed rather than losing the frame unnoticed, so the
+	// reconnect catches the peer up
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err == nil {
+		t.Fatal("the overflowing link stayed open")
+	}
+}
+
+func TestPeerAuthentication(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeAtCleanup(t, cr)
+	if err := cr.joinCluster(1, listener, nil, testClusterSecret, nil); err != nil {
+		t.Fatal(err)
+	}
+	go cr.Run()
+
+	// dial says hello as node and answers with secret, and returns the
+	// link if the node let it in
+	dial := func(node int, secret string) (net.Conn, bool) {
+		t.Helper()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		enc := json.NewEncoder(conn)
+		enc.Encode(peerFrame{Type: peerHello, Node: node, Nonce: "nonce"})
+
+		var answer peerFrame
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return conn, false
+		}
+		json.Unmarshal(line, &answer)
+		if answer.Auth != (&cluster{secret: testClusterSecret}).proof(peerSync, "nonce", 1, nil) {
+			t.Fatalf("node 1 answered with the wrong proof: %+v", answer)
+		}
+		ours := &cluster{secret: secret}
+		enc.Encode(peerFrame{Type: peerAuth, Node: node, Auth: ours.proof(peerAuth, answer.Nonce, node, nil)})
+
+		// A rejected link is closed; an accepted one stays open
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = reader.ReadByte()
+		conn.SetReadDeadline(time.Time{})
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return conn, true
+		}
+		return conn, false
+	}
+
+	for _, node := range []int{1, -1, maxClusterNodes} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		json.NewEncoder(conn).Encode(peerFrame{Type: peerHello, Node: node, Nonce: "nonce"})
+		if _, err := bufio.NewReader(conn).ReadBytes('\n'); err == nil {
+			t.Fatalf("node 1 answered a hello from node %d", node)
+		}
+		conn.Close()
+	}
+	if _, ok := dial(2, "wrong secret"); ok {
+		t.Fatal("a peer with the wrong secret was let in")
+	}
+	conn, ok := dial(2, testClusterSecret)
+	if !ok {
+		t.Fatal("a peer with the right secret was turned away")
+	}
+
+	// Node 2 can only send messages with IDs it could have assigned
+	enc := json.NewEncoder(conn)
+	enc.Encode(peerFrame{Type: peerMessage, Message: &Message{ID: 3, Channel: defaultChannel, From: "mallory", Content: "forged", Timestamp: time.Now()}})
+	enc.Encode(peerFrame{Type: peerMessage, Message: &Message{ID: 2, Channel: defaultChannel, From: "bob", Content: "genuine", Timestamp: time.Now()}})
+	waitFor(t, "the genuine message", func() bool {
+		return len(cr.latestMessages(defaultChannel, 10)) > 0
+	})
+	syncHub(cr)
+	if got := cr.latestMessages(defaultChannel, 10); len(got) != 1 || got[0].Content != "genuine" {
+		t.Fatalf("stored %+v, want only the genuine message", got)
+	}
+}
+
+func TestClusterOverTLS(t *testing.T) {
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "server.crt")
+	key := filepath.Join(dir, "server.key")
+	if err := devcert.GenerateServer([]string{"127.0.0.1"}, cert, key); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig, err := serverTLSConfig(ServerConfig{TLSCertFile: cert, TLSKeyFile: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := make([]net.Listener, 2)
+	nodes := make([]*ChatRoom, 2)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		listeners[i] = l
+	}
+	for i := range nodes {
+		cr, err := NewChatRoom(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		closeAtCleanup(t, cr)
+		peer := listeners[1-i].Addr().String()
+		if err := cr.joinCluster(i+1, listeners[i], []string{peer}, testClusterSecret, tlsConfig); err != nil {
+			t.Fatal(err)
+		}
+		go cr.Run()
+		nodes[i] = cr
+	}
+
+	alice, aliceReader := connectPipe(t, nodes[0])
+	alice.Write([]byte("alice\n"))
+	expectLine(t, aliceReader, "Welcome, alice!", "alice")
+	waitFor(t, "presence over TLS", func() bool { return nodes[1].isUsernameConnected("alice") })
+
+	bob, bobReader := connectPipe(t, nodes[1])
+	bob.Write([]byte("bob\n"))
+	expectLine(t, bobReader, "Welcome, bob!", "bob")
+	alice.Write([]byte("over TLS\n"))
+	expectLine(t, bobReader, "[alice]: over TLS", "bob")
+}
@@ -0,0 +1,137 @@
+package chatroom
+
+import "time"
+
+// ServerConfig holds the settings the chat server runs with. See settings.go
+// for how it is loaded and which fields can be changed while running.
+type ServerConfig struct {
+	// ConfigFile is the TOML file the settings were read from, if any.
+	ConfigFile string
+
+	ListenAddr string // TCP chat protocol
+	HTTPAddr   string // WebSocket gateway and HTTP API
+	DataDir    string
+
+	// WSOrigins are the web origins, such as https://chat.example.com, whose
+	// pages may open WebSocket connections besides the gateway's own.
+	WSOrigins []string
+
+	// HistoryWindow is how many of the newest messages of each channel are
+	// kept in memory; older ones are read from the history log on disk.
+	HistoryWindow int
+
+	// SnapshotInterval is how often a snapshot is taken, once SnapshotAfter
+	// messages have been stored since the last one.
+	SnapshotInterval time.Duration
+	SnapshotAfter    int
+
+	// IdleTimeout is how long a client can send nothing before it is
+	// disconnected; zero disables it. LoginTimeout is how long a new
+	// connection has to answer the username prompt.
+	IdleTimeout  time.Duration
+	LoginTimeout time.Duration
+
+	// SessionTTL is how long a reconnect token works after it was last used.
+	SessionTTL time.Duration
+
+	// ShutdownTimeout is how long a shutdown waits for clients to receive
+	// what is queued for them.
+	ShutdownTimeout time.Duration
+
+	// QueueSize is how many frames a client's queue holds in memory.
+	QueueSize int
+
+	// SlowConsumer is what happens to frames for a client whose queue is
+	// full: MaxDrops bounds the frames a Disconnect client may miss, and
+	// BlockTimeout how long Block waits for room.
+	SlowConsumer SlowConsumerPolicy
+	MaxDrops     int
+	BlockTimeout time.Duration
+
+	// OfflineLimit is how many DMs and delivery notices are queued for a
+	// user who isn't connected.
+	OfflineLimit int
+
+	// AwayAfter is how long a user can be quiet before being marked away;
+	// zero disables it.
+	AwayAfter time.Duration
+
+	// Owners are given the owner role, which can hand out roles with /op.
+	Owners []string
+
+	// RateLimits are the per-user message, command and DM limits and the
+	// per-IP connection limit.
+	RateLimits RateLimits
+
+	// TLS is enabled for both listeners when a certificate and key are set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile enables optional mutual TLS: clients presenting a
+	// certificate signed by this CA are logged in as its common name.
+	TLSClientCAFile string
+
+	// RequireAuth rejects guests: users must log in to (or register) an
+	// account, reconnect to an account's session or present a certificate.
+	RequireAuth bool
+
+	// PeerAddr enables clustering: other nodes connect to it to exchange
+	// messages and presence. NodeID must be unique in the cluster and below
+	// 64, and Peers lists the peer addresses of every other node. Every
+	// node must share ClusterSecret, which authenticates peer links. With
+	// TLS configured, peer links use it too.
+	PeerAddr      string
+	NodeID        int
+	Peers         []string
+	ClusterSecret string
+
+	// RaftAddr enables Raft replication of the message log. RaftPeers maps
+	// the node ID of every member, including this one, to its Raft address.
+	RaftAddr  string
+	RaftPeers map[int]string
+
+	// flags are the command-line settings, which override the file and
+	// the environment every time the configuration is loaded.
+	flags map[string]string
+}
+
+// DefaultServerConfig returns the settings used when nothing is configured.
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ListenAddr:       ":9000",
+		HTTPAddr:         ":8080",
+		DataDir:          "./chatdata",
+		HistoryWindow:    defaultHistoryWindow,
+		SnapshotInterval: defaultSnapshotInterval,
+		SnapshotAfter:    1,
+		IdleTimeout:      defaultIdleTimeout,
+		LoginTimeout:     defaultLoginTimeout,
+		SessionTTL:       defaultSessionTTL,
+		ShutdownTimeout:  defaultShutdownTimeout,
+		QueueSize:        defaultQueueSize,
+		SlowConsumer:     DropOldest,
+		MaxDrops:         defaultMaxDrops,
+		BlockTimeout:     defaultBlockTimeout,
+		OfflineLimit:     defaultOfflineLimit,
+		AwayAfter:        defaultAwayAfter,
+		RateLimits:       DefaultRateLimits(),
+	}
+}
+
+// ClientConfig holds the settings the terminal client connects with.
+type ClientConfig struct {
+	Addr string
+
+	TLS bool
+	// TLSCAFile is a PEM bundle to trust instead of the system roots, such as
+	// a development certificate from cmd/gencert.
+	TLSCAFile string
+	// TLSCertFile and TLSKeyFile are an optional client certificate for
+	// servers with mutual TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// DefaultClientConfig returns the settings used when nothing is configured.
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{Addr: ":9000"}
+}
@@ -0,0 +1,98 @@
+package chatroom
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Direct messages
+//
+// A DM is an ordinary Message in the channel private:<a>:<b>, where a and b
+// are the two participants in sorted order, so both directions of a
+// conversation share one channel. DMs go through the hub like channel
+// messages: they get IDs, are stored, persisted, indexed for /search and
+// replicated to the rest of the cluster, and only the two participants count
+// as members of the channel.
+
+const privatePrefix = "private:"
+
+// privateChannel returns the channel holding the conversation between a and b.
+func privateChannel(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return privatePrefix + a + ":" + b
+}
+
+// privateParticipants returns the two users of a private channel. Usernames
+// can't contain ':', so the split is unambiguous.
+func privateParticipants(channel string) (a, b string, ok bool) {
+	rest, ok := strings.CutPrefix(channel, privatePrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, ":")
+}
+
+// privatePeer returns the participant of a private channel that isn't
+// username.
+func privatePeer(channel, username string) string {
+	a, b, _ := privateParticipants(channel)
+	if a == username {
+		return b
+	}
+	return a
+}
+
+// privateChannels returns the private channels username has taken part in.
+func (cr *ChatRoom) privateChannels(username string) []string {
+	var channels []string
+	for _, channel := range cr.history.Channels() {
+		if a, b, ok := privateParticipants(channel); ok && (a == username || b == username) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// handleDirectMessage stores and delivers a DM on the hub goroutine, then
+// acknowledges it to the sender.
+func (cr *ChatRoom) handleDirectMessage(dm DirectMessage) {
+	client := dm.from
+	if dm.to == client.username {
+		client.send(refEvent(errorEvent("Can't message yourself!"), dm.ref))
+		return
+	}
+	if !cr.isUsernameConnected(dm.to) {
+		cr.queueDirectMessage(dm)
+		return
+	}
+
+	cr.handleBroadcast(Message{
+		From:    client.username,
+		Content: dm.text,
+		Channel: privateChannel(client.username, dm.to),
+	})
+	client.send(refEvent(ackEvent(fmt.Sprintf("Message sent to %s", dm.to)), dm.ref))
+}
+
+// handleDMHistoryCommand handles "/dm-history <user> [N]": the last N
+// messages of the client's conversation with user.
+func (cr *ChatRoom) handleDMHistoryCommand(client *Client, args []string) {
+	if len(args) < 2 {
+		client.sendError("Usage: /dm-history <user> [N]")
+		return
+	}
+	peer := args[1]
+
+	count := 20 // Default
+	if len(args) > 2 {
+		fmt.Sscanf(args[2], "%d", &count)
+	}
+	count = min(max(count, 1), 100)
+
+	batch := newEvent(frameHistoryBatch)
+	batch.Content = fmt.Sprintf("Conversation with %s: ", peer)
+	batch.Messages = cr.latestMessages(privateChannel(client.username, peer), count)
+	client.send(batch)
+}
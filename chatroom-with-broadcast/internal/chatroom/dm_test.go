@@ -0,0 +1,75 @@
+package chatroom
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirectMessages(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cr.Run()
+
+	newClient := func(username string) *Client {
+		client := &Client{username: username, outgoing: make(chan Event, 50), lastActive: time.Now()}
+		cr.join <- client
+		return client
+	}
+	alice := newClient("alice")
+	bob := newClient("bob")
+	carol := newClient("carol")
+
+	cr.sendDirectMessage(alice, "bob", "secret plans", "r1")
+	expectMessageContains(t, bob.outgoing, "[From alice]: secret plans", "bob")
+	expectMessageContains(t, alice.outgoing, "Message sent to bob", "alice")
+	cr.sendDirectMessage(bob, "alice", "sounds good", "")
+	expectMessageContains(t, alice.outgoing, "[From bob]: sounds good", "alice")
+	cr.sendDirectMessage(alice, "dave", "hello?", "")
+	expectMessageContains(t, alice.outgoing, "User 'dave' not found", "alice")
+
+	// Both directions are one conversation, stored like any other channel
+	channel := privateChannel("bob", "alice")
+	if channel != "private:alice:bob" {
+		t.Fatalf("privateChannel = %q", channel)
+	}
+	waitFor(t, "the DMs to be stored", func() bool {
+		return len(cr.latestMessages(channel, 10)) == 2
+	})
+
+	// Only the participants can read it
+	for _, client := range []*Client{alice, bob, carol} {
+		want := client != carol
+		if got := cr.isMember(channel, client.username); got != want {
+			t.Fatalf("isMember(%s) = %v, want %v", client.username, got, want)
+		}
+	}
+	cr.handleHistoryCommand(carol, []string{"/history", "#" + channel})
+	expectMessageContains(t, carol.outgoing, "You are not in", "carol")
+	cr.handleSearchCommand(carol, strings.Fields("/search secret"))
+	expectMessageContains(t, carol.outgoing, "0 messages match", "carol")
+	cr.handleSearchCommand(bob, strings.Fields("/search secret"))
+	expectMessageContains(t, bob.outgoing, "[alice -> bob]: secret plans", "bob")
+
+	// /dm-history reads the conversation back after a restart
+	cr.shutdown()
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+	restarted.handleDMHistoryCommand(carol, []string{"/dm-history", "alice"})
+	if ev := <-carol.outgoing; len(ev.Messages) != 0 {
+		t.Fatalf("carol read %d messages of someone else's conversation", len(ev.Messages))
+	}
+	restarted.handleDMHistoryCommand(bob, []string{"/dm-history", "alice"})
+	text := (<-bob.outgoing).Text()
+	for _, want := range []string{"Conversation with alice", "[alice -> bob]: secret plans", "[bob -> alice]: sounds good"} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("/dm-history = %q, want %q", text, want)
+		}
+	}
+}
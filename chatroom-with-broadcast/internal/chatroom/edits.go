@@ -0,0 +1,237 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Edits, deletions and replies
+//
+// Messages are never changed in the log. /edit and /delete append an edit or
+// delete record to the message's channel whose Ref is the ID of the message
+// it changes, and the newest such record for each message is kept in
+// cr.amendments (and in snapshots). Messages are folded with their amendment
+// wherever they are read: in their window, which is updated in place, and as
+// they are read back from the history log. A deleted message keeps its ID but
+// loses its content, and can't be edited any more. Replies are ordinary
+// messages with ReplyTo set.
+
+const (
+	kindEdit   = "edit"
+	kindDelete = "delete"
+)
+
+// isAmendment reports whether msg changes another message.
+func isAmendment(msg Message) bool {
+	return msg.Kind == kindEdit || msg.Kind == kindDelete
+}
+
+// foldLocked applies the amendment of msg, if any. Callers must hold
+// cr.messageMu.
+func (cr *ChatRoom) foldLocked(msg *Message) {
+	amendment, ok := cr.amendments[msg.ID]
+	if !ok {
+		return
+	}
+	if amendment.Kind == kindDelete {
+		msg.Content, msg.Deleted = "", true
+		return
+	}
+	msg.Content, msg.Edited = amendment.Content, true
+}
+
+// supersededLocked reports whether rec is already applied or outdated: a
+// deleted message stays deleted, and the newest edit wins. Callers must hold
+// cr.messageMu.
+func (cr *ChatRoom) supersededLocked(rec Message) bool {
+	prev, ok := cr.amendments[rec.Ref]
+	return ok && (prev.Kind == kindDelete || prev.ID >= rec.ID)
+}
+
+// amendLocked records an edit or delete record and folds it into the window
+// and the search index. Callers must hold cr.messageMu.
+func (cr *ChatRoom) amendLocked(rec Message) {
+	if cr.supersededLocked(rec) {
+		return
+	}
+
+	// The search index holds the current text of the message
+	if original, ok := cr.findMessageLocked(rec.Channel, rec.Ref); ok && !original.Deleted {
+		cr.searchIndex.Remove(original.ID, original.Content)
+		if rec.Kind == kindEdit {
+			original.Content = rec.Content
+			cr.indexMessage(original)
+		}
+	}
+
+	cr.amendments[rec.Ref] = rec
+	if ring := cr.windows[rec.Channel]; ring != nil {
+		ring.update(rec.Ref, cr.foldLocked)
+	}
+}
+
+// amendmentsLocked returns the amendments in ID order, for snapshots.
+// Callers must hold cr.messageMu.
+func (cr *ChatRoom) amendmentsLocked() []Message {
+	amendments := make([]Message, 0, len(cr.amendments))
+	for _, rec := range cr.amendments {
+		amendments = append(amendments, rec)
+	}
+	sort.Slice(amendments, func(i, j int) bool { return amendments[i].ID < amendments[j].ID })
+	return amendments
+}
+
+// findMessageLocked returns the message of channel with the given ID, folded
+// with its amendment. Callers must hold cr.messageMu.
+func (cr *ChatRoom) findMessageLocked(channel string, id int) (Message, bool) {
+	if ring := cr.windows[channel]; ring != nil {
+		if i := ring.search(id); i < ring.len() && ring.at(i).ID == id {
+			return ring.at(i), true
+		}
+	}
+
+	data, found, err := cr.history.Get(channel, id)
+	if err != nil {
+		fmt.Printf("Failed to read the history log: %v\n", err)
+	}
+	var msg Message
+	if !found || json.Unmarshal(data, &msg) != nil {
+		return Message{}, false
+	}
+	cr.foldLocked(&msg)
+	return msg, true
+}
+
+// messageByID finds message id in the channels username belongs to.
+func (cr *ChatRoom) messageByID(username string, id int) (Message, bool) {
+	var channels []string
+	for _, channel := range cr.history.Channels() {
+		if cr.isMember(channel, username) {
+			channels = append(channels, channel)
+		}
+	}
+
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+	for _, channel := range channels {
+		if msg, ok := cr.findMessageLocked(channel, id); ok {
+			return msg, true
+		}
+	}
+	return Message{}, false
+}
+
+// targetMessage parses the message ID in a command and finds the chat
+// message it names, telling the client if there is none.
+func (cr *ChatRoom) targetMessage(client *Client, arg string) (Message, bool) {
+	id, err := strconv.Atoi(strings.TrimPrefix(arg, "#"))
+	if err != nil {
+		client.sendError(fmt.Sprintf("Invalid message ID: %s", arg))
+		return Message{}, false
+	}
+
+	msg, ok := cr.messageByID(client.username, id)
+	if !ok || msg.Kind != "" || msg.From == "system" {
+		client.sendError(fmt.Sprintf("No message #%d in your channels", id))
+		return Message{}, false
+	}
+	if msg.Deleted {
+		client.sendError(fmt.Sprintf("Message #%d was deleted", id))
+		return Message{}, false
+	}
+	return msg, true
+}
+
+// handleEditCommand handles "/edit <id> <text>": authors can change their
+// own messages.
+func (cr *ChatRoom) handleEditCommand(client *Client, args []string) {
+	if len(args) < 3 {
+		client.sendError("Usage: /edit <id> <text>")
+		return
+	}
+	msg, ok := cr.targetMessage(client, args[1])
+	if !ok {
+		return
+	}
+	if msg.From != client.username {
+		client.sendError("You can only edit your own messages")
+		return
+	}
+	if !cr.checkLimit(client, limitMessage, msg.Channel, "") {
+		return
+	}
+
+	cr.publishAmendment(client, Message{
+		From:    client.username,
+		Content: strings.Join(args[2:], " "),
+		Channel: msg.Channel,
+		Kind:    kindEdit,
+		Ref:     msg.ID,
+	})
+}
+
+// handleDeleteCommand handles "/delete <id>": authors can delete their own
+// messages, and moderators anyone's in a channel.
+func (cr *ChatRoom) handleDeleteCommand(client *Client, args []string) {
+	if len(args) != 2 {
+		client.sendError("Usage: /delete <id>")
+		return
+	}
+	msg, ok := cr.targetMessage(client, args[1])
+	if !ok {
+		return
+	}
+	moderator := cr.clientRole(client).rank() >= RoleModerator.rank() && !strings.HasPrefix(msg.Channel, privatePrefix)
+	if msg.From != client.username && !moderator {
+		client.sendError("You can only delete your own messages")
+		return
+	}
+
+	cr.publishAmendment(client, Message{
+		From:    client.username,
+		Channel: msg.Channel,
+		Kind:    kindDelete,
+		Ref:     msg.ID,
+	})
+}
+
+func (cr *ChatRoom) publishAmendment(client *Client, rec Message) {
+	if err := cr.publish(rec); err != nil {
+		client.sendError("Message not changed: " + err.Error())
+		return
+	}
+	if rec.Kind == kindEdit {
+		client.sendAck(fmt.Sprintf("Message #%d edited", rec.Ref))
+	} else {
+		client.sendAck(fmt.Sprintf("Message #%d deleted", rec.Ref))
+	}
+}
+
+// handleReplyCommand handles "/reply <id> <text>", which answers a message in
+// its channel.
+func (cr *ChatRoom) handleReplyCommand(client *Client, args []string) {
+	if len(args) < 3 {
+		client.sendError("Usage: /reply <id> <text>")
+		return
+	}
+	msg, ok := cr.targetMessage(client, args[1])
+	if !ok {
+		return
+	}
+	if !cr.checkLimit(client, limitMessage, msg.Channel, "") {
+		return
+	}
+
+	err := cr.publish(Message{
+		From:    client.username,
+		Content: strings.Join(args[2:], " "),
+		Channel: msg.Channel,
+		ReplyTo: msg.ID,
+	})
+	if err != nil {
+		client.sendError("Message not sent: " + err.Error())
+	}
+}
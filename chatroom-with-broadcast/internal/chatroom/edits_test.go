@@ -0,0 +1,99 @@
+package chatroom
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEditsAndDeletes(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cr.Run()
+
+	newClient := func(username string) *Client {
+		client := &Client{username: username, outgoing: make(chan Event, 50), lastActive: time.Now()}
+		cr.join <- client
+		return client
+	}
+	alice := newClient("alice")
+	bob := newClient("bob")
+
+	cr.broadcast <- Message{From: "alice", Content: "helo wrold"}
+	expectMessageContains(t, bob.outgoing, "[alice]: helo wrold", "bob")
+	id := cr.lastMessageID()
+	cr.broadcast <- Message{From: "alice", Content: "oops, wrong window"}
+	expectMessageContains(t, bob.outgoing, "oops", "bob")
+	oops := cr.lastMessageID()
+
+	handleCommand(alice, cr, fmt.Sprintf("/edit %d hello world", id))
+	expectMessageContains(t, bob.outgoing, fmt.Sprintf("*** alice edited message #%d: hello world ***", id), "bob")
+	handleCommand(bob, cr, fmt.Sprintf("/edit %d hijacked", id))
+	expectMessageContains(t, bob.outgoing, "only edit your own", "bob")
+	handleCommand(bob, cr, fmt.Sprintf("/delete %d", oops))
+	expectMessageContains(t, bob.outgoing, "only delete your own", "bob")
+	handleCommand(bob, cr, fmt.Sprintf("/reply %d hi!", id))
+	expectMessageContains(t, alice.outgoing, fmt.Sprintf("[bob]: (re #%d) hi!", id), "alice")
+	handleCommand(alice, cr, fmt.Sprintf("/delete %d", oops))
+	expectMessageContains(t, bob.outgoing, fmt.Sprintf("*** alice deleted message #%d ***", oops), "bob")
+	handleCommand(alice, cr, fmt.Sprintf("/edit %d back again", oops))
+	expectMessageContains(t, alice.outgoing, "was deleted", "alice")
+
+	// Search sees the current text only
+	search := func(cr *ChatRoom, query string) string {
+		t.Helper()
+		client := &Client{username: "carol", outgoing: make(chan Event, 10)}
+		cr.handleSearchCommand(client, strings.Fields("/search "+query))
+		return (<-client.outgoing).Text()
+	}
+	if !strings.Contains(search(cr, "hello"), "1 messages match") || !strings.Contains(search(cr, "wrold"), "0 messages") ||
+		!strings.Contains(search(cr, "oops"), "0 messages") {
+		t.Fatal("search doesn't reflect the edit and the delete")
+	}
+
+	// The records are folded back in after replaying the WAL, reading past
+	// the window and loading a snapshot
+	expectFolded := func(label string, msgs []Message) {
+		t.Helper()
+		var text string
+		for _, msg := range msgs {
+			text += formatMessage(msg)
+		}
+		for _, want := range []string{"[alice]: hello world (edited)", "[alice]: (message deleted)", fmt.Sprintf("(re #%d) hi!", id)} {
+			if !strings.Contains(text, want) {
+				t.Fatalf("%s: %q doesn't contain %q", label, text, want)
+			}
+		}
+	}
+	expectFolded("live", cr.latestMessages(defaultChannel, 20))
+
+	replayed, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFolded("after replay", replayed.latestMessages(defaultChannel, 20))
+	replayed.setHistoryWindow(1)
+	expectFolded("from the history log", replayed.latestMessages(defaultChannel, 20))
+	replayed.shutdown()
+
+	// ...and while rebuilding the search index
+	if err := os.Remove(filepath.Join(dir, "search.idx")); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.wal.Close()
+	restored.setHistoryWindow(1)
+	expectFolded("after a snapshot", restored.latestMessages(defaultChannel, 20))
+	if !strings.Contains(search(restored, "hello"), "1 messages match") || !strings.Contains(search(restored, "wrold"), "0 messages") {
+		t.Fatal("the edit was lost from the rebuilt search index")
+	}
+}
@@ -0,0 +1,93 @@
+package chatroom
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Caesarsage/chatroom/pkg/websocket"
+)
+
+// websocketHandler upgrades requests to WebSocket connections and serves them
+// exactly like TCP connections, so browser users share the same ChatRoom,
+// history, DMs and reconnect tokens. Each WebSocket message is one line.
+//
+// Browsers let any page open a WebSocket and send along the user's client
+// certificate, so only pages from the gateway itself or an origin in
+// -ws-origins may connect.
+func websocketHandler(chatRoom *ChatRoom) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !chatRoom.allowOrigin(r) {
+			fmt.Printf("Refused WebSocket from %s: origin %s not allowed\n", r.RemoteAddr, r.Header.Get("Origin"))
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if !chatRoom.allowConnect(r.RemoteAddr) {
+			http.Error(w, "too many connections, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			fmt.Printf("WebSocket upgrade failed for %s: %v\n", r.RemoteAddr, err)
+			return
+		}
+
+		fmt.Println("New WebSocket connection from:", conn.RemoteAddr())
+		handleClient(conn, chatRoom)
+	})
+}
+
+// allowOrigin reports whether the page that made r, if any, may connect.
+// Clients other than browsers send no Origin.
+func (cr *ChatRoom) allowOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range cr.settings().WSOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// newHTTPMux returns the routes served on the HTTP listener.
+func newHTTPMux(chatRoom *ChatRoom) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", websocketHandler(chatRoom))
+	chatRoom.registerHTTPAPI(mux)
+	return mux
+}
+
+// serveHTTP serves HTTP on listener until ctx is done or it fails. A non-nil
+// tlsConfig serves HTTPS and secure WebSockets.
+func serveHTTP(ctx context.Context, listener net.Listener, chatRoom *ChatRoom, tlsConfig *tls.Config) {
+	server := &http.Server{
+		Handler:   newHTTPMux(chatRoom),
+		TLSConfig: tlsConfig,
+	}
+	// WebSocket connections are hijacked, so Shutdown leaves them to drain
+	context.AfterFunc(ctx, func() { server.Shutdown(context.Background()) })
+
+	fmt.Printf("HTTP server started on %s (WebSocket at /ws, API at /messages, /users, /stats)\n", listener.Addr())
+
+	var err error
+	if tlsConfig != nil {
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Println("HTTP server failed:", err)
+	}
+}
@@ -0,0 +1,122 @@
+package chatroom
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Caesarsage/chatroom/pkg/websocket"
+)
+
+func TestWebSocketGateway(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+
+	server := httptest.NewServer(newHTTPMux(cr))
+	defer server.Close()
+
+	// A browser user joins over WebSocket...
+	ws, err := websocket.Dial("ws" + strings.TrimPrefix(server.URL, "http") + "/ws")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	wsReader := bufio.NewReader(ws)
+	expectLine(t, wsReader, "Enter username", "Alice")
+	ws.Write([]byte("Alice"))
+	token := expectLine(t, wsReader, "reconnect:Alice:", "Alice")
+	token = strings.TrimSpace(token[strings.LastIndex(token, ":")+1:])
+	expectLine(t, wsReader, "Welcome, Alice!", "Alice")
+
+	// ...and a TCP user joins the same room
+	tcp, tcpReader := connectPipe(t, cr)
+	tcp.Write([]byte("Bob\n"))
+	expectLine(t, tcpReader, "Welcome, Bob!", "Bob")
+
+	ws.Write([]byte("hello from the browser"))
+	expectLine(t, tcpReader, "[Alice]: hello from the browser", "Bob")
+
+	tcp.Write([]byte("/msg Alice hi back\n"))
+	expectLine(t, wsReader, "[From Bob]: hi back", "Alice")
+
+	// The reconnect token handed out over WebSocket works over WebSocket again
+	ws.Close()
+	waitUntilDisconnected(t, cr, "Alice")
+
+	ws, err = websocket.Dial("ws" + strings.TrimPrefix(server.URL, "http") + "/ws")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	ws.SetDeadline(time.Now().Add(5 * time.Second))
+	wsReader = bufio.NewReader(ws)
+	expectLine(t, wsReader, "Enter username", "Alice")
+	ws.Write([]byte("reconnect:Alice:" + token))
+	expectLine(t, wsReader, "Welcome back, Alice!", "Alice")
+
+	ws.Close()
+	tcp.Close()
+	waitUntilDisconnected(t, cr, "Alice")
+	waitUntilDisconnected(t, cr, "Bob")
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+	cr.configMu.Lock()
+	cr.config.WSOrigins = []string{"https://chat.example.com"}
+	cr.configMu.Unlock()
+
+	server := httptest.NewServer(newHTTPMux(cr))
+	defer server.Close()
+
+	// upgrade opens a WebSocket as a page from origin would
+	upgrade := func(origin string) (net.Conn, *bufio.Reader, int) {
+		t.Helper()
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: " + server.Listener.Addr().String() + "\r\n" +
+			"Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nOrigin: " + origin + "\r\n\r\n"))
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("upgrading from %s: %v", origin, err)
+		}
+		return conn, reader, resp.StatusCode
+	}
+
+	for origin, want := range map[string]int{
+		"https://evil.example":     http.StatusForbidden,
+		"https://chat.example.com": http.StatusSwitchingProtocols,
+		server.URL:                 http.StatusSwitchingProtocols,
+	} {
+		if _, _, got := upgrade(origin); got != want {
+			t.Errorf("origin %s got status %d, want %d", origin, got, want)
+		}
+	}
+
+	// Clients must mask their frames; an unmasked one ends the connection
+	conn, reader, _ := upgrade(server.URL)
+	conn.Write([]byte{0x81, 5, 'A', 'l', 'i', 'c', 'e'})
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Fatalf("connection wasn't closed after an unmasked frame: %v", err)
+	}
+	if cr.isUsernameConnected("Alice") {
+		t.Fatal("an unmasked frame logged Alice in")
+	}
+}
@@ -2,6 +2,8 @@ package chatroom
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -9,17 +11,38 @@ import (
 // handleJoin adds a client to the active client set and broadcasts a join message.
 func (cr *ChatRoom) handleJoin(client *Client) {
 	cr.mu.Lock()
+	if cr.closing {
+		cr.mu.Unlock()
+		client.send(cr.shutdownEvent(client.username))
+		client.closeQueue()
+		return
+	}
 	cr.clients[client] = true
+	total := len(cr.clients)
 	cr.mu.Unlock()
 
 	client.markActive()
 
-	fmt.Printf("%s joined (total: %d)\n", client.username, len(cr.clients))
+	fmt.Printf("%s joined (total: %d)\n", client.username, total)
+	cr.announcePresence()
 
-	cr.sendHistory(client, 10) // Lat 10 messages
+	if client.resuming {
+		cr.replayMissed(client, replayLimit)
+	} else {
+		cr.sendHistory(client, client.currentChannel(), 10) // Lat 10 messages
+	}
+	// Only the user the queue is for gets it: a guest name taken without its
+	// token belongs to someone new, and the old guest can't come back
+	if client.authenticated || client.resuming {
+		cr.deliverOffline(client)
+	} else {
+		cr.dropOffline([]string{client.username})
+	}
 
-	announcement := fmt.Sprintf("*** %s joined the chat ***\n", client.username)
-	cr.handleBroadcast(announcement)
+	cr.handleBroadcast(Message{
+		From:    "system",
+		Content: fmt.Sprintf("*** %s joined the chat ***", client.username),
+	})
 }
 
 func (cr *ChatRoom) handleLeave(client *Client) {
@@ -29,145 +52,345 @@ func (cr *ChatRoom) handleLeave(client *Client) {
 		return // Already removed
 	}
 	delete(cr.clients, client)
+	total := len(cr.clients)
 	cr.mu.Unlock()
 
-	fmt.Printf(" %s left (total: %d)\n", client.username, len(cr.clients))
+	fmt.Printf(" %s left (total: %d)\n", client.username, total)
+	cr.announcePresence()
 
-	// Close channel safely
-	select {
-	case <-client.outgoing:
-		// Already closed
-	default:
-		close(client.outgoing)
-	}
+	// Stops the client's writer
+	client.closeQueue()
 
-	announcement := fmt.Sprintf("*** %s left the chat ***\n", client.username)
-	cr.handleBroadcast(announcement)
+	cr.handleBroadcast(Message{
+		From:    "system",
+		Content: fmt.Sprintf("*** %s left the chat ***", client.username),
+	})
 }
 
-// handleBroadcast records a chat message to persistence and forwards to all clients.
-func (cr *ChatRoom) handleBroadcast(message string) {
-	// Extract username from message if it's a chat message
-	parts := strings.SplitN(message, ": ", 2)
-	from := "system"
-	actualContent := message
+// handleBroadcast assigns an ID to msg, applies any channel event it carries,
+// persists it and forwards it to the members of its channel, on this node and
+// on its peers.
+func (cr *ChatRoom) handleBroadcast(msg Message) {
+	if msg.Channel == "" {
+		msg.Channel = defaultChannel
+	}
+	if msg.Kind == "" && msg.From != "system" && cr.isMuted(msg.From) {
+		fmt.Printf(" Dropped message from muted user %s\n", msg.From)
+		cr.metrics.dropped.Inc(dropMuted)
+		return
+	}
 
-	if len(parts) == 2 {
-		from = strings.Trim(parts[0], "[]")
-		actualContent = parts[1]
+	// With Raft the message comes back through applyCommitted once committed
+	if cr.raft != nil {
+		cr.propose(msg, nil)
+		return
 	}
 
-	// Create message
-	cr.messageMu.Lock()
-	msg := Message{
-		ID:        cr.nextMessageID,
-		From:      from,
-		Content:   actualContent,
-		Timestamp: time.Now(),
-		Channel:   "global",
-	}
-	cr.nextMessageID++
-	cr.messages = append(cr.messages, msg)
-	cr.messageMu.Unlock()
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+	msg = cr.storeMessage(msg)
 
 	if err := cr.persistMessage(msg); err != nil {
 		fmt.Printf("Failed to persist message: %v\n", err)
 		// Still sent it (better than losing it completely)
 	}
 
-	// Now broadcast
+	if cr.cluster != nil {
+		cr.cluster.forward(peerFrame{Type: peerMessage, Message: &msg})
+	}
+
+	cr.deliver(msg)
+}
+
+// applyCommitted stores and delivers a message committed by the Raft log.
+func (cr *ChatRoom) applyCommitted(msg Message) {
+	msg = cr.storeMessage(msg)
+	cr.deliver(msg)
+}
+
+// storeMessage assigns msg the next ID, stores it and applies any channel
+// event it carries.
+func (cr *ChatRoom) storeMessage(msg Message) Message {
+	// A joining user first catches up on what was said before they arrived
+	if msg.Kind == kindJoin {
+		if client := cr.findClientByUsername(msg.From); client != nil {
+			cr.sendHistory(client, msg.Channel, 10)
+		}
+	}
+
+	cr.messageMu.Lock()
+	msg.ID = cr.allocateMessageIDLocked()
+	cr.storeMessageLocked(msg)
+	cr.messageMu.Unlock()
+
+	cr.applyChannelEvent(msg)
+	return msg
+}
+
+// deliver sends a stored message to the local members of its channel.
+func (cr *ChatRoom) deliver(msg Message) {
+	dm := strings.HasPrefix(msg.Channel, privatePrefix)
+	if dm {
+		cr.recordQueuedDM(msg)
+	}
+
 	cr.mu.Lock()
 	clients := make([]*Client, 0, len(cr.clients))
 	for client := range cr.clients {
-		clients = append(clients, client)
+		// The parting user still gets to see their own part notice
+		if cr.isMember(msg.Channel, client.username) || (msg.Kind == kindPart && client.username == msg.From) {
+			if dm && client.username == msg.From {
+				continue // Acknowledged instead
+			}
+			clients = append(clients, client)
+		}
 	}
 	cr.totalMessages++
 	cr.mu.Unlock()
-
-	fmt.Printf(" Broadcasting to %d clients: %s", len(clients), message)
-
-	// Send to each client (non-blocking)
+	cr.metrics.messages.Inc(channelLabel(msg.Channel))
+
+	fmt.Printf(" Broadcasting to %d clients in #%s: %s", len(clients), msg.Channel, formatMessage(msg))
+
+	// Send to each client; full queues are up to the slow consumer policy
+	event := messageEvent(msg)
+	event.cursor = msg.ID
+	switch {
+	case msg.Kind == kindEdit:
+		event.Type = frameEdit
+	case msg.Kind == kindDelete:
+		event.Type = frameDelete
+	case dm:
+		event.Type = frameDM
+	}
 	for _, client := range clients {
-		select {
-		case client.outgoing <- message:
+		if client.send(event) {
 			client.mu.Lock()
 			client.messagesSent++
 			client.mu.Unlock()
-		default:
+		} else {
 			fmt.Printf(" Skipped %s (channel full - slow client)\n", client.username)
 		}
 	}
 }
 
-func (cr *ChatRoom) sendHistory(client *Client, count int) {
+// replayLimit caps how many missed messages are replayed on reconnect.
+const replayLimit = 50
+
+// sendHistory sends the last count messages of channel to client.
+func (cr *ChatRoom) sendHistory(client *Client, channel string, count int) {
+	batch := newEvent(frameHistoryBatch)
+	batch.Content = fmt.Sprintf("Recent messages in #%s: ", channel)
+	batch.Messages = cr.latestMessages(channel, count)
+
+	client.send(batch)
+}
+
+// sendHistoryBefore sends client a page of the count messages of channel
+// that precede the message with ID before, with a hint for fetching the page
+// before that.
+func (cr *ChatRoom) sendHistoryBefore(client *Client, channel string, before, count int) {
+	batch := newEvent(frameHistoryBatch)
+	batch.Messages = cr.messagesBefore(channel, before, count)
+	batch.Content = fmt.Sprintf("Messages in #%s before %d: ", channel, before)
+	if len(batch.Messages) == count {
+		batch.Content = fmt.Sprintf("Messages in #%s before %d (older: /history #%s before %d): ",
+			channel, before, channel, batch.Messages[0].ID)
+	}
+
+	client.send(batch)
+}
+
+// replayMissed sends a resuming client every message it has not seen yet in
+// the channels it belongs to and its DMs, oldest first. If there are more
+// than limit, only the newest limit are sent, preceded by a marker saying how
+// many were skipped.
+func (cr *ChatRoom) replayMissed(client *Client, limit int) {
+	client.mu.Lock()
+	cursor := client.lastMessageID
+	client.mu.Unlock()
+
+	// DMs the client sent were acknowledged rather than delivered, and the
+	// ones queued while it was offline come with the offline queue
+	queued := cr.queuedDMs(client.username)
+	channels := append(cr.memberChannels(client.username), cr.privateChannels(client.username)...)
+
+	// The newest limit missed messages are among the newest limit of each
+	// channel
+	var missed []Message
+	total := 0
+	for _, channel := range channels {
+		private := strings.HasPrefix(channel, privatePrefix)
+		for _, msg := range cr.latestMessages(channel, limit) {
+			if msg.ID <= cursor {
+				continue
+			}
+			if private && (msg.From == client.username || queued[msg.ID]) {
+				total--
+				continue
+			}
+			missed = append(missed, msg)
+		}
+		total += cr.countAfter(channel, cursor)
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i].ID < missed[j].ID })
+	latest := max(cursor, cr.lastMessageID())
+
+	replay := newEvent(frameHistoryBatch)
+	replay.Content = fmt.Sprintf("You missed %d messages: ", total)
+	if len(missed) > limit {
+		missed = missed[len(missed)-limit:]
+	}
+	replay.Skipped = total - len(missed)
+	replay.Messages = missed
+	replay.cursor = latest
+
+	client.send(replay)
+}
+
+// lastMessageID returns the ID of the newest stored message, or -1 if there
+// are none.
+func (cr *ChatRoom) lastMessageID() int {
 	cr.messageMu.Lock()
 	defer cr.messageMu.Unlock()
+	return cr.nextMessageID - 1
+}
 
-	start := len(cr.messages) - count
-	if start < 0 {
-		start = 0
+// formatMessage renders msg the way it is shown to text clients.
+func formatMessage(msg Message) string {
+	content := msg.Content
+	switch {
+	case msg.Deleted:
+		content = "(message deleted)"
+	case msg.Edited:
+		content += " (edited)"
 	}
-
-	historyMsg := "Recent messages: \n"
-	for i := start; i < len(cr.messages); i++ {
-		msg := cr.messages[i]
-		historyMsg += fmt.Sprintf(" [%s]: %s\n", msg.From, msg.Content)
+	if msg.ReplyTo > 0 {
+		content = fmt.Sprintf("(re #%d) %s", msg.ReplyTo, content)
 	}
 
-	select {
-	case client.outgoing <- historyMsg:
+	var line string
+	switch {
+	case msg.Kind == kindJoin:
+		line = fmt.Sprintf("*** %s joined #%s ***", msg.From, msg.Channel)
+	case msg.Kind == kindPart:
+		line = fmt.Sprintf("*** %s left #%s ***", msg.From, msg.Channel)
+	case msg.Kind == kindTopic:
+		line = fmt.Sprintf("*** %s set the topic of #%s to: %s ***", msg.From, msg.Channel, msg.Content)
+	case msg.Kind == kindEdit:
+		line = fmt.Sprintf("*** %s edited message #%d: %s ***", msg.From, msg.Ref, msg.Content)
+	case msg.Kind == kindDelete:
+		line = fmt.Sprintf("*** %s deleted message #%d ***", msg.From, msg.Ref)
+	case msg.From == "system":
+		line = content
+	case msg.Channel == defaultChannel:
+		line = fmt.Sprintf("[%s]: %s", msg.From, content)
+	case strings.HasPrefix(msg.Channel, privatePrefix):
+		line = fmt.Sprintf("[%s -> %s]: %s", msg.From, privatePeer(msg.Channel, msg.From), content)
 	default:
+		line = fmt.Sprintf("#%s [%s]: %s", msg.Channel, msg.From, content)
+	}
+
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
 	}
+	return line
 }
 
 func (cr *ChatRoom) sendUserList(client *Client) {
 	cr.mu.Lock()
 	defer cr.mu.Unlock()
 
-	list := "Users online:\n"
-	for c := range cr.clients {
-		status := ""
-		if c.isInactive(1 * time.Minute) {
-			status = " (idle)"
-		}
-		list += fmt.Sprintf("  - %s%s\n", c.username, status)
-	}
+	list := newEvent(frameUserList)
+	list.Users = cr.userInfosLocked()
 
-	list += fmt.Sprintf("\nTotal messages: %d\n", cr.totalMessages)
-	list += fmt.Sprintf("Uptime: %s\n", time.Since(cr.startTime).Round(time.Second))
+	list.Content = fmt.Sprintf("Total messages: %d\n", cr.totalMessages)
+	list.Content += fmt.Sprintf("Uptime: %s", time.Since(cr.startTime).Round(time.Second))
 
-	select {
-	case client.outgoing <- list:
-	default:
+	if !client.send(list) {
 		fmt.Printf(" Couldn't send user list to %s\n", client.username)
 	}
 }
 
-func (cr *ChatRoom) handleDirectMessage(dm DirectMessage) {
-	select {
-	case dm.toClient.outgoing <- dm.message:
-		dm.toClient.mu.Lock()
-		dm.toClient.messagesSent++
-		dm.toClient.mu.Unlock()
-	default:
-		fmt.Printf(" Couldn't deliver DM to %s\n", dm.toClient.username)
+// idleAfter is how long a user can be quiet before being shown as idle.
+const idleAfter = 1 * time.Minute
+
+// userInfosLocked describes the users connected to the cluster, sorted by
+// name. Callers must hold cr.mu.
+func (cr *ChatRoom) userInfosLocked() []UserInfo {
+	users := make([]UserInfo, 0, len(cr.clients)+len(cr.remoteUsers))
+	for c := range cr.clients {
+		queued, lag, dropped := c.backlog()
+		presence, status := c.presence()
+		users = append(users, UserInfo{
+			Username: c.username,
+			Idle:     c.isInactive(idleAfter),
+			Presence: presence,
+			Status:   status,
+			Node:     cr.nodeID(),
+			Queued:   queued,
+			LagMs:    lag.Milliseconds(),
+			Dropped:  dropped,
+		})
 	}
+	for username, node := range cr.remoteUsers {
+		users = append(users, UserInfo{Username: username, Presence: PresenceOnline, Node: node, Remote: true})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users
 }
 
-// findClientByUsername returns the first connected client with the given username or nil.
+// handleHistoryCommand handles "/history [#channel] [N]" and
+// "/history [#channel] before <id> [N]", defaulting to the client's current
+// channel.
 func (cr *ChatRoom) handleHistoryCommand(client *Client, args []string) {
+	channel := client.currentChannel()
+	args = args[1:]
+	if len(args) > 0 && strings.HasPrefix(args[0], "#") {
+		channel = normalizeChannelName(args[0])
+		args = args[1:]
+	}
+
+	if !cr.isMember(channel, client.username) {
+		client.sendError(fmt.Sprintf("You are not in #%s", channel))
+		return
+	}
+
+	before := -1
+	if len(args) > 0 && args[0] == "before" {
+		if len(args) < 2 {
+			client.sendError("Usage: /history [#channel] before <id> [N]")
+			return
+		}
+		id, err := strconv.Atoi(args[1])
+		if err != nil || id < 0 {
+			client.sendError(fmt.Sprintf("Invalid message ID: %s", args[1]))
+			return
+		}
+		before = id
+		args = args[2:]
+	}
+
 	count := 20 // Default
-	if len(args) > 1 {
-		fmt.Sscanf(args[1], "%d", &count)
+	if len(args) > 0 {
+		fmt.Sscanf(args[0], "%d", &count)
 	}
 
 	if count > 100 {
 		count = 100 // Limit
 	}
+	if count < 1 {
+		count = 1
+	}
 
-	cr.sendHistory(client, count)
+	if before >= 0 {
+		cr.sendHistoryBefore(client, channel, before, count)
+		return
+	}
+	cr.sendHistory(client, channel, count)
 }
 
+// findClientByUsername returns the first connected client with the given username or nil.
 func (cr *ChatRoom) findClientByUsername(username string) *Client {
 	cr.mu.Lock()
 	defer cr.mu.Unlock()
@@ -194,3 +417,18 @@ func (c *Client) isInactive(timeout time.Duration) bool {
 	return time.Since(c.lastActive) > timeout
 }
 
+// currentChannel returns the channel the client's plain lines are sent to.
+func (c *Client) currentChannel() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channel == "" {
+		return defaultChannel
+	}
+	return c.channel
+}
+
+func (c *Client) setChannel(channel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.channel = channel
+}
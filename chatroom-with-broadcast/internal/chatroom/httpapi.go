@@ -0,0 +1,163 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/raft"
+)
+
+// HTTP read API
+//
+// GET /messages?channel=&since_id=&limit=  messages after since_id, oldest first
+// GET /users                               connected users and their idle status
+// GET /stats                               uptime and message counters
+// GET /metrics                             Prometheus metrics, see metrics.go
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// messagesPage is the response of GET /messages. Pass NextSinceID as since_id
+// to fetch the following page.
+type messagesPage struct {
+	Channel     string    `json:"channel"`
+	Messages    []Message `json:"messages"`
+	NextSinceID int       `json:"next_since_id"`
+	HasMore     bool      `json:"has_more"`
+}
+
+type statsResponse struct {
+	Uptime         string `json:"uptime"`
+	UptimeSeconds  int64  `json:"uptime_seconds"`
+	TotalMessages  int    `json:"total_messages"`
+	StoredMessages int    `json:"stored_messages"` // in the history log
+	WindowMessages int    `json:"window_messages"` // of those, how many are held in memory
+	ConnectedUsers int    `json:"connected_users"`
+	Channels       int    `json:"channels"`
+
+	Raft *raft.Status `json:"raft,omitempty"` // set when the log is replicated with Raft
+}
+
+func (cr *ChatRoom) registerHTTPAPI(mux *http.ServeMux) {
+	mux.HandleFunc("/messages", getOnly(cr.handleMessagesAPI))
+	mux.HandleFunc("/users", getOnly(cr.handleUsersAPI))
+	mux.HandleFunc("/stats", getOnly(cr.handleStatsAPI))
+	mux.HandleFunc("/metrics", getOnly(cr.metrics.registry.ServeHTTP))
+}
+
+func (cr *ChatRoom) handleMessagesAPI(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	channel := defaultChannel
+	if c := query.Get("channel"); c != "" {
+		channel = normalizeChannelName(c)
+	}
+	if strings.HasPrefix(channel, "private:") {
+		writeJSONError(w, http.StatusForbidden, "private channels are not readable over HTTP")
+		return
+	}
+
+	sinceID, err := intParam(query.Get("since_id"), -1)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "since_id must be an integer")
+		return
+	}
+
+	limit, err := intParam(query.Get("limit"), defaultPageSize)
+	if err != nil || limit < 1 {
+		writeJSONError(w, http.StatusBadRequest, "limit must be a positive integer")
+		return
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	page := messagesPage{
+		Channel:     channel,
+		Messages:    cr.messagesAfter(channel, sinceID, limit+1),
+		NextSinceID: sinceID,
+	}
+	if len(page.Messages) > limit {
+		page.Messages = page.Messages[:limit]
+		page.HasMore = true
+	}
+	if n := len(page.Messages); n > 0 {
+		page.NextSinceID = page.Messages[n-1].ID
+	}
+
+	writeJSON(w, page)
+}
+
+func (cr *ChatRoom) handleUsersAPI(w http.ResponseWriter, r *http.Request) {
+	cr.mu.Lock()
+	users := cr.userInfosLocked()
+	cr.mu.Unlock()
+
+	writeJSON(w, users)
+}
+
+func (cr *ChatRoom) handleStatsAPI(w http.ResponseWriter, r *http.Request) {
+	uptime := time.Since(cr.startTime)
+
+	stats := statsResponse{
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+	}
+
+	cr.mu.Lock()
+	stats.TotalMessages = cr.totalMessages
+	stats.ConnectedUsers = len(cr.clients)
+	cr.mu.Unlock()
+
+	stats.StoredMessages = cr.history.Len()
+	stats.WindowMessages = len(cr.windowMessages())
+
+	cr.channelsMu.Lock()
+	stats.Channels = len(cr.channels)
+	cr.channelsMu.Unlock()
+
+	if cr.raft != nil {
+		status := cr.raft.Status()
+		stats.Raft = &status
+	}
+
+	writeJSON(w, stats)
+}
+
+// getOnly rejects every method but GET.
+func getOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func intParam(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Failed to write HTTP response: %v\n", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,86 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHTTPAPI(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+
+	alice := &Client{username: "Alice", outgoing: make(chan Event, 10), lastActive: time.Now()}
+	cr.join <- alice
+	for _, text := range []string{"one", "two", "three"} {
+		cr.broadcast <- Message{From: "Alice", Content: text}
+	}
+	cr.broadcast <- Message{From: "Alice", Content: "elsewhere", Channel: "go"}
+	waitFor(t, "the messages to be delivered", func() bool {
+		cr.mu.Lock()
+		defer cr.mu.Unlock()
+		return cr.totalMessages == 5
+	})
+
+	server := httptest.NewServer(newHTTPMux(cr))
+	defer server.Close()
+
+	get := func(path string, v any) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", path, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: decoding: %v", path, err)
+		}
+	}
+
+	// Page through #global two messages at a time: the join notice and "one",
+	// then "two" and "three"
+	var page messagesPage
+	get("/messages?limit=2", &page)
+	if len(page.Messages) != 2 || !page.HasMore || page.Messages[1].Content != "one" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	get("/messages?limit=2&since_id="+strconv.Itoa(page.NextSinceID), &page)
+	if len(page.Messages) != 2 || page.HasMore || page.Messages[1].Content != "three" {
+		t.Fatalf("unexpected second page: %+v", page)
+	}
+
+	get("/messages?channel=%23go", &page)
+	if len(page.Messages) != 1 || page.Messages[0].Content != "elsewhere" {
+		t.Fatalf("unexpected #go page: %+v", page)
+	}
+
+	var users []UserInfo
+	get("/users", &users)
+	if len(users) != 1 || users[0].Username != "Alice" || users[0].Idle {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+
+	var stats statsResponse
+	get("/stats", &stats)
+	if stats.TotalMessages != 5 || stats.ConnectedUsers != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	resp, err := http.Get(server.URL + "/messages?since_id=abc")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("bad since_id: got %s, want 400", resp.Status)
+	}
+}
@@ -2,6 +2,7 @@ package chatroom
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
@@ -9,6 +10,15 @@ import (
 	"time"
 )
 
+const (
+	// defaultLoginTimeout is how long a new connection has to answer the
+	// username prompt.
+	defaultLoginTimeout = 30 * time.Second
+	// defaultIdleTimeout is how long a client can send nothing before it is
+	// disconnected.
+	defaultIdleTimeout = 5 * time.Minute
+)
+
 // handleClient manages a single TCP connection: prompt for username, register
 // client, start writer goroutine and process incoming lines.
 func handleClient(conn net.Conn, chatRoom *ChatRoom) {
@@ -19,13 +29,20 @@ func handleClient(conn net.Conn, chatRoom *ChatRoom) {
 		conn.Close()
 	}()
 
+	// A verified client certificate decides the username
+	certName, err := certUsername(conn)
+	if err != nil {
+		fmt.Printf("TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
 	// Set initial read timeout for username
-	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(chatRoom.settings().LoginTimeout))
 
 	reader := bufio.NewReader(conn)
 
 	// Ask for username or reconnect token
-	conn.Write([]byte("Enter username (or 'reconnect:<username>:<token>' to reconnect): \n"))
+	conn.Write([]byte("Enter username (or 'login:<username>:<password>', 'register:<username>:<password>' or 'reconnect:<username>:<token>'): \n"))
 
 	input, err := reader.ReadString('\n')
 	if err != nil {
@@ -36,70 +53,194 @@ func handleClient(conn net.Conn, chatRoom *ChatRoom) {
 
 	var username string
 	var reconnectToken string
+	var password string
 	var isReconnecting bool
+	var isRegistering bool
+	var resuming bool
+	var jsonMode bool
+
+	// reply writes a handshake frame before the writer goroutine takes over
+	reply := func(ev Event) {
+		writeFrame(conn, ev, jsonMode)
+	}
+
+	if strings.HasPrefix(input, "{") {
+		// A JSON hello frame negotiates the JSON-lines protocol
+		jsonMode = true
 
-	if strings.HasPrefix(input, "reconnect:") {
+		var hello clientFrame
+		if err := json.Unmarshal([]byte(input), &hello); err != nil || hello.Type != frameHello {
+			reply(errorEvent("Expected a hello frame"))
+			return
+		}
+
+		username = hello.Username
+		password = hello.Password
+		isRegistering = hello.Register
+		if hello.Token != "" {
+			reconnectToken = hello.Token
+			isReconnecting = true
+		}
+	} else if strings.HasPrefix(input, "reconnect:") {
 		parts := strings.Split(input, ":")
 		if len(parts) == 3 {
 			username = parts[1]
 			reconnectToken = parts[2]
 			isReconnecting = true
 		} else {
-			conn.Write([]byte("Invalid reconnect format. Use: reconnect:<username>:<token> \n"))
+			reply(errorEvent("Invalid reconnect format. Use: reconnect:<username>:<token> "))
+			return
+		}
+	} else if strings.HasPrefix(input, "login:") || strings.HasPrefix(input, "register:") {
+		parts := strings.SplitN(input, ":", 3)
+		if len(parts) != 3 {
+			reply(errorEvent(fmt.Sprintf("Invalid format. Use: %s:<username>:<password> ", parts[0])))
 			return
 		}
+		username = parts[1]
+		password = parts[2]
+		isRegistering = parts[0] == "register"
 	} else {
 		username = input
 	}
 
+	// authenticated is set once the user has proven they own the name
+	authenticated := false
+
+	if certName != "" {
+		if username != "" && username != certName {
+			reply(errorEvent(fmt.Sprintf("Your client certificate is for %s", certName)))
+			return
+		}
+		username = certName
+		authenticated = true
+		reply(systemEvent(fmt.Sprintf("Authenticated as %s by client certificate", certName)))
+	}
+
 	if username == "" {
+		if chatRoom.requireAuth {
+			reply(errorEvent("This server requires an account. Use login:<username>:<password> or register:<username>:<password>"))
+			return
+		}
 		username = fmt.Sprintf("Guest%d", rand.Intn(1000))
 	}
 
+	if strings.Contains(username, ":") {
+		reply(errorEvent("Usernames can't contain ':'"))
+		return
+	}
+
+	if ban := chatRoom.checkBan(username, conn.RemoteAddr().String()); ban != nil {
+		fmt.Printf("Refused banned user %s from %s\n", username, conn.RemoteAddr())
+		reply(errorEvent(fmt.Sprintf("You are banned %s%s", describeUntil(ban.Until), reasonSuffix(ban.Reason))))
+		return
+	}
+
+	// Checked before any registration, so nobody can register the name of a
+	// connected guest
+	if !isReconnecting && chatRoom.isUsernameConnected(username) {
+		reply(errorEvent("Username already connected, Use reconnect if you lost connection"))
+		return
+	}
+
+	switch {
+	case authenticated || isReconnecting:
+		// Certificates speak for themselves; reconnect tokens are checked below
+
+	case isRegistering:
+		if err := chatRoom.registerAccount(username, password); err != nil {
+			reply(errorEvent(fmt.Sprintf("Registration failed: %v", err)))
+			return
+		}
+		authenticated = true
+
+	case password != "" || chatRoom.hasAccount(username):
+		// Registered names are protected: ask for the password if it wasn't
+		// given up front
+		if password == "" {
+			if jsonMode {
+				reply(errorEvent(fmt.Sprintf("%s is registered; send a password in the hello frame", username)))
+				return
+			}
+			conn.Write([]byte(fmt.Sprintf("%s is registered. Password: \n", username)))
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			password = strings.TrimSpace(line)
+		}
+
+		if err := chatRoom.checkPassword(username, password); err != nil {
+			fmt.Printf("Failed login for %s from %s\n", username, conn.RemoteAddr())
+			reply(errorEvent("Invalid username or password"))
+			return
+		}
+		authenticated = true
+
+	case chatRoom.requireAuth:
+		reply(errorEvent("This server requires an account. Use login:<username>:<password> or register:<username>:<password>"))
+		return
+	}
+
 	if isReconnecting {
+		if chatRoom.requireAuth && !chatRoom.hasAccount(username) {
+			reply(errorEvent("This server requires an account. Use login:<username>:<password> or register:<username>:<password>"))
+			return
+		}
+
 		if chatRoom.validateReconnectToken(username, reconnectToken) {
+			resuming = true
+			chatRoom.metrics.reconnects.Inc(reconnectSuccess)
 			fmt.Printf("%s reconnected successfully\n", username)
-			conn.Write([]byte(fmt.Sprintf("Welcome back, %s!\n", username)))
+			reply(ackEvent(fmt.Sprintf("Welcome back, %s!", username)))
 		} else {
-			conn.Write([]byte("Invalid reconnect token or session expired. \n"))
-		}
-	} else {
-		// New connection - check it username is already connected
-		if chatRoom.isUsernameConnected(username) {
-			conn.Write([]byte("Username already connected, Use reconnect if you lost connection\n"))
+			// Without a valid token this must not fall through to a login,
+			// or anyone could take a registered name
+			chatRoom.metrics.reconnects.Inc(reconnectFailure)
+			reply(errorEvent("Invalid reconnect token or session expired. "))
 			return
 		}
-
+	} else {
 		// check if session exists (was connected before)
 		chatRoom.sessionsMu.Lock()
 		existingSession := chatRoom.sessions[username]
 		chatRoom.sessionsMu.Unlock()
 
-		if existingSession != nil {
-			// They were here before, give them their token
+		if existingSession != nil && authenticated && !isRegistering {
+			// They were here before and proved the name is theirs, give them
+			// their token
 			token := existingSession.ReconnectToken
 			msg := fmt.Sprintf("Tip: Save this reconnect token: %s\n", token)
 			msg += fmt.Sprintf("   To reconnect later: reconnect:%s:%s\n", username, token)
-			conn.Write([]byte(msg))
+			reply(systemEvent(msg))
 		} else {
-			// Brand new user, create session
+			// Brand new user, or someone else taking a guest's name (perhaps
+			// registering it): a new session, so older tokens stop working
 			session := chatRoom.createSession(username)
 			token := session.ReconnectToken
 			msg := fmt.Sprintf("Your reconnect token: %s\n", token)
 			msg += fmt.Sprintf("   Save this to reconnect: reconnect:%s:%s\n", username, token)
-			conn.Write([]byte(msg))
+			reply(systemEvent(msg))
 		}
 	}
 
 	// Create client
 	client := &Client{
-		conn:       conn,
-		username:   username,
-		outgoing:   make(chan string, 10),
-		lastActive: time.Now(),
+		conn:           conn,
+		username:       username,
+		jsonMode:       jsonMode,
+		authenticated:  authenticated || (resuming && chatRoom.hasAccount(username)),
+		lastActive:     time.Now(),
 		reconnectToken: reconnectToken,
+		drained:        make(chan struct{}),
 		// TEST MODE: Simulate slow client randomly
-		isSlowClient: rand.Float64() < 0.1, // 10% chance
+		isSlowClient: rand.Float64() < slowClientFraction,
+	}
+	chatRoom.newClientQueue(client)
+
+	if resuming {
+		client.resuming = true
+		client.lastMessageID = chatRoom.sessionCursor(username)
 	}
 
 	if client.isSlowClient {
@@ -114,35 +255,60 @@ func handleClient(conn net.Conn, chatRoom *ChatRoom) {
 	welcomeMsg := fmt.Sprintf("Welcome, %s!\n", username)
 	welcomeMsg += "Commands:\n"
 	welcomeMsg += "  /users - List all users\n"
-	welcomeMsg += "  /history [N] - Show last N messages\n"
+	welcomeMsg += "  /history [#channel] [N] - Show last N messages\n"
+	welcomeMsg += "  /history [#channel] before <id> [N] - Show N messages before message <id>\n"
+	welcomeMsg += "  /search <terms> [from:user] [in:#channel] [before:/after:YYYY-MM-DD] - Search messages\n"
+	welcomeMsg += "  /reply <id> <msg>, /edit <id> <msg>, /delete <id> - Answer, change or delete a message\n"
+	welcomeMsg += "  /join #channel - Join or switch to a channel\n"
+	welcomeMsg += "  /part [#channel] - Leave a channel\n"
+	welcomeMsg += "  /channels - List channels\n"
+	welcomeMsg += "  /topic [#channel] [text] - Show or set a channel topic\n"
 	welcomeMsg += "  /msg <user> <msg> - Private message\n"
+	welcomeMsg += "  /dm-history <user> [N] - Show your last N private messages with <user>\n"
+	welcomeMsg += "  /away [msg], /busy [msg], /back - Set your presence\n"
 	welcomeMsg += "  /token - Show your reconnect token\n"
+	welcomeMsg += "  /register <password> - Protect your username with a password\n"
 	welcomeMsg += "  /stats - Show your stats\n"
+	welcomeMsg += "  /kick, /ban, /unban, /mute <user> - Moderate (moderators); /op <user> [role] - Set roles (owners)\n"
+	welcomeMsg += "  /config - Show the server settings (owners)\n"
 	welcomeMsg += "  /simulate crash - Test crash handling\n"
 	welcomeMsg += "  /quit - Leave\n"
-	conn.Write([]byte(welcomeMsg))
+	reply(systemEvent(welcomeMsg))
 
-	go readMessages(client, chatRoom)
+	go readMessages(client, chatRoom, reader)
 
 	writeMessages(client)
+	close(client.drained)
 
-	// Client disconnected - update session but don't delete
-	chatRoom.updateSessionActivity(username)
+	// The writer stopped (write error or leave); make sure the client is gone
 	chatRoom.leave <- client
 }
 
-func readMessages(client *Client, chatRoom *ChatRoom) {
+// readMessages processes the lines a client sends after the handshake, using
+// the reader the handshake was read from so nothing it buffered is lost.
+func readMessages(client *Client, chatRoom *ChatRoom, reader *bufio.Reader) {
 	defer func() {
 		if r := recover(); r != nil {
 			fmt.Printf("Panic in readMessages for %s: %v\n", client.username, r)
 		}
-	}()
 
-	reader := bufio.NewReader(client.conn)
+		// Client disconnected - update session but don't delete
+		client.mu.Lock()
+		lastMessageID := client.lastMessageID
+		client.mu.Unlock()
+		chatRoom.updateSessionActivity(client.username, lastMessageID)
+
+		// Stop the writer too; handleClient's own leave is then a no-op
+		chatRoom.leave <- client
+	}()
 
 	for {
 		// Set read timeout
-		client.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		var deadline time.Time
+		if idleTimeout := chatRoom.settings().IdleTimeout; idleTimeout > 0 {
+			deadline = time.Now().Add(idleTimeout)
+		}
+		client.conn.SetReadDeadline(deadline)
 
 		message, err := reader.ReadString('\n')
 		if err != nil {
@@ -154,26 +320,93 @@ func readMessages(client *Client, chatRoom *ChatRoom) {
 			return
 		}
 
-		client.markActive()
+		chatRoom.noteActivity(client)
 
 		message = strings.TrimSpace(message)
 		if message == "" {
 			continue
 		}
+		// Lines that arrive while the server shuts down go unanswered, so
+		// clients send them again once they have reconnected
+		if chatRoom.isClosing() {
+			continue
+		}
 
 		client.mu.Lock()
 		client.messagesRecv++
 		client.mu.Unlock()
 
+		if client.jsonMode {
+			handleFrame(client, chatRoom, message)
+			continue
+		}
+
 		// Process command
 		if strings.HasPrefix(message, "/") {
 			handleCommand(client, chatRoom, message)
 			continue
 		}
 
-		// Broadcast message
-		formatted := fmt.Sprintf("[%s]: %s\n", client.username, message)
-		chatRoom.broadcast <- formatted
+		// Broadcast message to the client's current channel
+		channel := client.currentChannel()
+		if !chatRoom.checkLimit(client, limitMessage, channel, "") {
+			continue
+		}
+		err = chatRoom.publish(Message{
+			From:    client.username,
+			Content: message,
+			Channel: channel,
+		})
+		if err != nil {
+			client.sendError("Message not sent: " + err.Error())
+		}
+	}
+}
+
+// handleFrame processes one line from a JSON client.
+func handleFrame(client *Client, chatRoom *ChatRoom, line string) {
+	var frame clientFrame
+	if err := json.Unmarshal([]byte(line), &frame); err != nil {
+		client.sendError("Invalid frame: " + err.Error())
+		return
+	}
+
+	switch frame.Type {
+	case frameMessage:
+		channel := client.currentChannel()
+		if frame.Channel != "" {
+			channel = normalizeChannelName(frame.Channel)
+		}
+		if !chatRoom.isMember(channel, client.username) {
+			client.send(refEvent(errorEvent(fmt.Sprintf("You are not in #%s", channel)), frame.Ref))
+			return
+		}
+		if !chatRoom.checkLimit(client, limitMessage, channel, frame.Ref) {
+			return
+		}
+
+		err := chatRoom.publish(Message{
+			From:    client.username,
+			Content: frame.Content,
+			Channel: channel,
+		})
+		if err != nil {
+			client.send(refEvent(errorEvent("Message not sent: "+err.Error()), frame.Ref))
+			return
+		}
+		client.send(refEvent(ackEvent("sent"), frame.Ref))
+
+	case frameDM:
+		chatRoom.sendDirectMessage(client, frame.To, frame.Content, frame.Ref)
+
+	case frameTyping:
+		chatRoom.handleTyping(client, frame)
+
+	case frameCommand:
+		handleCommand(client, chatRoom, frame.Content)
+
+	default:
+		client.send(refEvent(errorEvent(fmt.Sprintf("Unknown frame type %q", frame.Type)), frame.Ref))
 	}
 }
 
@@ -185,6 +418,9 @@ func handleCommand(client *Client, chatRoom *ChatRoom, command string) {
 	if len(parts) == 0 {
 		return
 	}
+	if !chatRoom.checkLimit(client, limitCommand, "", "") {
+		return
+	}
 
 	// TODO: Breakdown and Move to hamdlers.go
 	switch parts[0] {
@@ -201,15 +437,14 @@ func handleCommand(client *Client, chatRoom *ChatRoom, command string) {
 			stats += "  You are a SLOW CLIENT (test mode)\n"
 		}
 		client.mu.Unlock()
+		queued, lag, dropped := client.backlog()
+		stats += fmt.Sprintf("  Lag: %d frames queued, %s behind, %d dropped\n", queued, lag.Round(time.Millisecond), dropped)
 
-		select {
-		case client.outgoing <- stats:
-		default:
-		}
+		client.sendSystem(stats)
 
 	case "/simulate":
 		if len(parts) > 1 && parts[1] == "crash" {
-			client.outgoing <- "Simulating crash...\n"
+			client.sendSystem("Simulating crash...")
 			time.Sleep(100 * time.Millisecond)
 			client.conn.Close() // Abrupt disconnect!
 			return
@@ -217,51 +452,65 @@ func handleCommand(client *Client, chatRoom *ChatRoom, command string) {
 
 	case "/msg":
 		if len(parts) < 3 {
-			select {
-			case client.outgoing <- "Usage: /msg <username> <message>\n":
-			default:
-			}
+			client.sendError("Usage: /msg <username> <message>")
 			return
 		}
 
-		targetUsername := parts[1]
-		messageText := strings.Join(parts[2:], " ")
+		chatRoom.sendDirectMessage(client, parts[1], strings.Join(parts[2:], " "), "")
 
-		targetClient := chatRoom.findClientByUsername(targetUsername)
-		if targetClient == nil {
-			select {
-			case client.outgoing <- fmt.Sprintf("User '%s' not found\n", targetUsername):
-			default:
-			}
-			return
-		}
+	case "/history":
+		chatRoom.handleHistoryCommand(client, parts)
 
-		if targetClient == client {
-			select {
-			case client.outgoing <- "Can't message yourself!\n":
-			default:
-			}
-			return
-		}
+	case "/edit":
+		chatRoom.handleEditCommand(client, parts)
 
-		privateMsg := fmt.Sprintf("[From %s]: %s\n", client.username, messageText)
-		select {
-		case targetClient.outgoing <- privateMsg:
-		default:
-			select {
-			case client.outgoing <- fmt.Sprintf("%s's inbox is full\n", targetUsername):
-			default:
-			}
-			return
-		}
+	case "/delete":
+		chatRoom.handleDeleteCommand(client, parts)
 
-		select {
-		case client.outgoing <- fmt.Sprintf("Message sent to %s\n", targetUsername):
-		default:
-		}
+	case "/reply":
+		chatRoom.handleReplyCommand(client, parts)
 
-	case "/history":
-		chatRoom.handleHistoryCommand(client, parts)
+	case "/dm-history":
+		chatRoom.handleDMHistoryCommand(client, parts)
+
+	case "/away", "/busy", "/back":
+		chatRoom.handlePresenceCommand(client, parts)
+
+	case "/search":
+		chatRoom.handleSearchCommand(client, parts)
+
+	case "/config":
+		chatRoom.handleConfigCommand(client)
+
+	case "/register":
+		chatRoom.handleRegisterCommand(client, parts)
+
+	case "/kick":
+		chatRoom.handleKickCommand(client, parts)
+
+	case "/ban":
+		chatRoom.handleBanCommand(client, parts)
+
+	case "/unban":
+		chatRoom.handleUnbanCommand(client, parts)
+
+	case "/mute":
+		chatRoom.handleMuteCommand(client, parts)
+
+	case "/op":
+		chatRoom.handleOpCommand(client, parts)
+
+	case "/join":
+		chatRoom.handleJoinCommand(client, parts)
+
+	case "/part":
+		chatRoom.handlePartCommand(client, parts)
+
+	case "/channels":
+		chatRoom.sendChannelList(client)
+
+	case "/topic":
+		chatRoom.handleTopicCommand(client, parts)
 
 	case "/token":
 		chatRoom.sessionsMu.Lock()
@@ -272,34 +521,24 @@ func handleCommand(client *Client, chatRoom *ChatRoom, command string) {
 			msg := "Your reconnect token:\n"
 			msg += fmt.Sprintf("   reconnect:%s:%s\n", client.username, session.ReconnectToken)
 			msg += "   Use this to reconnect if you disconnect.\n"
-			select {
-			case client.outgoing <- msg:
-			default:
-			}
+			client.sendSystem(msg)
 		} else {
-			select {
-			case client.outgoing <- " No session found\n":
-			default:
-			}
+			client.sendError(" No session found")
 		}
 
 	case "/quit":
-		announcement := fmt.Sprintf("%s left the chat\n", client.username)
-		chatRoom.broadcast <- announcement
-
-		select {
-		case client.outgoing <- "Goodbye!\n":
-		default:
+		chatRoom.broadcast <- Message{
+			From:    "system",
+			Content: fmt.Sprintf("%s left the chat", client.username),
 		}
 
+		client.sendAck("Goodbye!")
+
 		time.Sleep(100 * time.Millisecond)
 		client.conn.Close()
 
 	default:
-		select {
-		case client.outgoing <- fmt.Sprintf("Unknown: %s\n", parts[0]):
-		default:
-		}
+		client.sendError(fmt.Sprintf("Unknown: %s", parts[0]))
 	}
 }
 
@@ -312,14 +551,36 @@ func writeMessages(client *Client) {
 	}()
 
 	writer := bufio.NewWriter(client.conn)
+	seq := 0
+	lastQueued := 0
 
-	for message := range client.outgoing {
+	for event := range client.outgoing {
 		// Simulate slow client
 		if client.isSlowClient {
-			time.Sleep(time.Duration(rand.Intn(500)) * time.Millisecond)
+			time.Sleep(time.Duration(rand.Int63n(int64(slowClientDelay))))
+		}
+
+		// Tell the client about frames dropped before this one
+		if gap := event.queueSeq - lastQueued - 1; gap > 0 {
+			seq++
+			notice := gapEvent(gap)
+			notice.Seq = seq
+			if err := writeFrame(writer, notice, client.jsonMode); err != nil {
+				fmt.Printf("⚠️  Write error for %s: %v\n", client.username, err)
+				return
+			}
+			// The notice gets its own write, so WebSocket clients receive
+			// it as a message of its own
+			if err := writer.Flush(); err != nil {
+				fmt.Printf("⚠️  Flush error for %s: %v\n", client.username, err)
+				return
+			}
 		}
+		lastQueued = event.queueSeq
 
-		_, err := writer.WriteString(message)
+		seq++
+		event.Seq = seq
+		err := writeFrame(writer, event, client.jsonMode)
 		if err != nil {
 			fmt.Printf("⚠️  Write error for %s: %v\n", client.username, err)
 			return
@@ -330,6 +591,19 @@ func writeMessages(client *Client) {
 			fmt.Printf("⚠️  Flush error for %s: %v\n", client.username, err)
 			return
 		}
+		client.noteWritten(event)
+
+		if client.slowConsumer.policy == Spill {
+			client.refill()
+		}
 	}
 }
 
+// sendDirectMessage hands a private message from client to target over to
+// the hub. ref is echoed back to JSON clients.
+func (cr *ChatRoom) sendDirectMessage(client *Client, target, text, ref string) {
+	if !cr.checkLimit(client, limitDM, "", ref) {
+		return
+	}
+	cr.directMessage <- DirectMessage{from: client, to: target, text: text, ref: ref}
+}
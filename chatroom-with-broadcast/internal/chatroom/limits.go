@@ -0,0 +1,217 @@
+package chatroom
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/ratelimit"
+)
+
+// Flood protection
+//
+// Every user has token buckets (see internal/ratelimit) for channel
+// messages, commands and DMs, kept by username so reconnecting doesn't
+// refill them. A channel can have its own message limit, which replaces the
+// server-wide one there. Going over a limit drops the line and earns a
+// warning frame; the warning after warningsBeforeMute mutes the user for
+// firstMute, and every further mute lasts twice as long as the previous one.
+// A user who stays within the limits for strikeDecay starts over, and their
+// state is dropped once their buckets have refilled.
+//
+// New connections are limited per IP address as they are accepted.
+
+// RateLimits bounds how fast users may talk. Zero limits are unlimited.
+type RateLimits struct {
+	Messages ratelimit.Limit            // channel messages per user
+	Channels map[string]ratelimit.Limit // replaces Messages in these channels
+	Commands ratelimit.Limit            // commands per user
+	DMs      ratelimit.Limit            // direct messages per user
+	Connects ratelimit.Limit            // connections per IP address
+}
+
+// DefaultRateLimits returns the limits used when nothing is configured.
+func DefaultRateLimits() RateLimits {
+	return RateLimits{
+		Messages: ratelimit.Limit{Events: 10, Per: 10 * time.Second},
+		Commands: ratelimit.Limit{Events: 20, Per: 10 * time.Second},
+		DMs:      ratelimit.Limit{Events: 10, Per: 10 * time.Second},
+		Connects: ratelimit.Limit{Events: 10, Per: time.Minute},
+	}
+}
+
+const (
+	warningsBeforeMute = 3
+	firstMute          = 30 * time.Second
+	maxMute            = time.Hour
+	strikeDecay        = 10 * time.Minute
+
+	// limitsSweepAt is how many users have flood protection state before
+	// the state that no longer matters is dropped.
+	limitsSweepAt = 1024
+)
+
+// limitedAction is what a user is trying to do.
+type limitedAction int
+
+const (
+	limitMessage limitedAction = iota
+	limitCommand
+	limitDM
+)
+
+// userLimits is the flood protection state of one user.
+type userLimits struct {
+	messages *ratelimit.Bucket
+	channels map[string]*ratelimit.Bucket // channels with their own limit
+	commands *ratelimit.Bucket
+	dms      *ratelimit.Bucket
+
+	warnings      int // since the last mute
+	mutes         int // since the last quiet spell
+	mutedUntil    time.Time
+	lastViolation time.Time
+}
+
+// idle reports whether forgetting the state changes nothing at time now:
+// every bucket is full and no mute or strike is in force.
+func (s *userLimits) idle(now time.Time) bool {
+	if now.Before(s.mutedUntil) || now.Sub(s.lastViolation) <= strikeDecay {
+		return false
+	}
+	if s.messages == nil {
+		return true // reset by setRateLimits
+	}
+	for _, bucket := range s.channels {
+		if !bucket.Full(now) {
+			return false
+		}
+	}
+	return s.messages.Full(now) && s.commands.Full(now) && s.dms.Full(now)
+}
+
+// setRateLimits replaces the limits, refilling everyone's buckets; mutes
+// stay in force.
+func (cr *ChatRoom) setRateLimits(limits RateLimits) {
+	cr.limitsMu.Lock()
+	defer cr.limitsMu.Unlock()
+
+	cr.rateLimits = limits
+	cr.connects = ratelimit.NewKeyed(limits.Connects)
+	for _, state := range cr.userLimits {
+		state.messages = nil
+	}
+}
+
+// userLimitsLocked returns the state of username, setting up its buckets if
+// needed. Callers must hold limitsMu.
+func (cr *ChatRoom) userLimitsLocked(username string, now time.Time) *userLimits {
+	state := cr.userLimits[username]
+	if state == nil {
+		if len(cr.userLimits) >= limitsSweepAt {
+			for name, s := range cr.userLimits {
+				if s.idle(now) {
+					delete(cr.userLimits, name)
+				}
+			}
+		}
+		state = &userLimits{}
+		cr.userLimits[username] = state
+	}
+	if state.messages == nil {
+		state.messages = ratelimit.NewBucket(cr.rateLimits.Messages)
+		state.channels = make(map[string]*ratelimit.Bucket)
+		state.commands = ratelimit.NewBucket(cr.rateLimits.Commands)
+		state.dms = ratelimit.NewBucket(cr.rateLimits.DMs)
+	}
+	return state
+}
+
+// checkLimit reports whether client may perform action (in channel, for
+// messages) now. If not, it tells the client why, tagging the frame with
+// ref for JSON clients.
+func (cr *ChatRoom) checkLimit(client *Client, action limitedAction, channel, ref string) bool {
+	return cr.checkLimitAt(client, action, channel, ref, time.Now())
+}
+
+func (cr *ChatRoom) checkLimitAt(client *Client, action limitedAction, channel, ref string, now time.Time) bool {
+	if action != limitCommand && cr.isMuted(client.username) {
+		client.send(refEvent(errorEvent("You have been muted by a moderator"), ref))
+		return false
+	}
+
+	// Sending can block on a slow client, so it happens after unlocking
+	cr.limitsMu.Lock()
+	allowed, reply := cr.checkLimitLocked(client.username, action, channel, now)
+	cr.limitsMu.Unlock()
+
+	if !allowed {
+		client.send(refEvent(reply, ref))
+	}
+	return allowed
+}
+
+// checkLimitLocked takes a token for action by username, or returns the frame
+// telling them why they can't. Callers must hold limitsMu.
+func (cr *ChatRoom) checkLimitLocked(username string, action limitedAction, channel string, now time.Time) (bool, Event) {
+	state := cr.userLimitsLocked(username, now)
+	if action != limitCommand && now.Before(state.mutedUntil) {
+		return false, errorEvent(fmt.Sprintf("You are muted for flooding for another %s", state.mutedUntil.Sub(now).Round(time.Second)))
+	}
+
+	var bucket *ratelimit.Bucket
+	switch action {
+	case limitMessage:
+		bucket = state.messages
+		if limit, ok := cr.rateLimits.Channels[channel]; ok {
+			bucket = state.channels[channel]
+			if bucket == nil {
+				bucket = ratelimit.NewBucket(limit)
+				state.channels[channel] = bucket
+			}
+		}
+	case limitCommand:
+		bucket = state.commands
+	case limitDM:
+		bucket = state.dms
+	}
+	if bucket.AllowAt(now) {
+		return true, Event{}
+	}
+
+	// Over the limit: warn, then mute for longer each time
+	if now.Sub(state.lastViolation) > strikeDecay {
+		state.warnings, state.mutes = 0, 0
+	}
+	state.lastViolation = now
+	state.warnings++
+	if state.warnings <= warningsBeforeMute {
+		return false, warningEvent(fmt.Sprintf("You are sending too fast, slow down (warning %d of %d)", state.warnings, warningsBeforeMute))
+	}
+
+	mute := min(firstMute<<min(state.mutes, 8), maxMute)
+	state.mutes++
+	state.warnings = 0
+	state.mutedUntil = now.Add(mute)
+	fmt.Printf(" Muted %s for %s for flooding\n", username, mute)
+	return false, warningEvent(fmt.Sprintf("You have been muted for %s for flooding", mute))
+}
+
+// allowConnect reports whether a new connection from addr is within the
+// per-IP connection limit.
+func (cr *ChatRoom) allowConnect(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	cr.limitsMu.Lock()
+	connects := cr.connects
+	cr.limitsMu.Unlock()
+
+	if connects.Allow(host) {
+		return true
+	}
+	fmt.Printf(" Refused connection from %s: too many connections\n", addr)
+	return false
+}
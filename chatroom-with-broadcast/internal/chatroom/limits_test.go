@@ -0,0 +1,93 @@
+package chatroom
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/ratelimit"
+)
+
+func TestFloodProtection(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.wal.Close()
+	cr.setRateLimits(RateLimits{
+		Messages: ratelimit.Limit{Events: 2, Per: 10 * time.Second},
+		Channels: map[string]ratelimit.Limit{"slow": {Events: 1, Per: time.Minute}},
+		Commands: ratelimit.Limit{Events: 100, Per: time.Second},
+		Connects: ratelimit.Limit{Events: 2, Per: time.Minute},
+	})
+
+	start := time.Now()
+	alice := &Client{username: "alice", outgoing: make(chan Event, 10)}
+	check := func(action limitedAction, channel string, after time.Duration, want bool) {
+		t.Helper()
+		if got := cr.checkLimitAt(alice, action, channel, "r1", start.Add(after)); got != want {
+			t.Fatalf("%v in %q after %s: allowed %v, want %v", action, channel, after, got, want)
+		}
+	}
+
+	// Two messages, then three warnings, then a mute
+	check(limitMessage, defaultChannel, 0, true)
+	check(limitMessage, defaultChannel, 0, true)
+	for i := 1; i <= warningsBeforeMute; i++ {
+		check(limitMessage, defaultChannel, 0, false)
+		if ev := <-alice.outgoing; ev.Type != frameWarning || ev.Ref != "r1" {
+			t.Fatalf("got %+v, want a warning answering r1", ev)
+		}
+	}
+	check(limitMessage, defaultChannel, 0, false)
+	expectMessageContains(t, alice.outgoing, "muted for 30s", "alice")
+
+	// Muted users can't talk, even with tokens to spare, but can run commands
+	check(limitMessage, defaultChannel, 20*time.Second, false)
+	expectMessageContains(t, alice.outgoing, "another 10s", "alice")
+	check(limitDM, "", 20*time.Second, false)
+	check(limitCommand, "", 20*time.Second, true)
+
+	// Flooding again soon after earns a longer mute
+	check(limitMessage, defaultChannel, 31*time.Second, true)
+	check(limitMessage, defaultChannel, 31*time.Second, true)
+	for i := 0; i <= warningsBeforeMute; i++ {
+		check(limitMessage, defaultChannel, 31*time.Second, false)
+	}
+	expectMessageContains(t, alice.outgoing, "muted for 1m0s", "alice")
+
+	// Channels with their own limit have their own bucket
+	later := 2 * time.Minute
+	check(limitMessage, "slow", later, true)
+	check(limitMessage, "slow", later, false)
+	check(limitMessage, defaultChannel, later, true)
+
+	// A quiet spell forgives earlier mutes
+	later += strikeDecay + time.Minute
+	for i := 0; i < 2+warningsBeforeMute+1; i++ {
+		cr.checkLimitAt(alice, limitMessage, defaultChannel, "", start.Add(later))
+	}
+	expectMessageContains(t, alice.outgoing, "muted for 30s", "alice")
+
+	// Once there are many users, those whose buckets have refilled are
+	// forgotten; alice, muted, is kept
+	for i := 0; i < limitsSweepAt; i++ {
+		user := &Client{username: fmt.Sprint("user", i), outgoing: make(chan Event, 1)}
+		cr.checkLimitAt(user, limitMessage, defaultChannel, "", start.Add(later))
+	}
+	bob := &Client{username: "bob", outgoing: make(chan Event, 1)}
+	cr.checkLimitAt(bob, limitMessage, defaultChannel, "", start.Add(later+time.Minute))
+	if len(cr.userLimits) != 2 || cr.userLimits["alice"] == nil {
+		t.Fatalf("kept flood protection state for %d users, want alice and bob", len(cr.userLimits))
+	}
+
+	// Connections are limited per IP address
+	for i, want := range []bool{true, true, false} {
+		if got := cr.allowConnect("10.0.0.1:4000"); got != want {
+			t.Fatalf("connection %d: allowed %v, want %v", i, got, want)
+		}
+	}
+	if !cr.allowConnect("10.0.0.2:4000") {
+		t.Fatal("another address was refused")
+	}
+}
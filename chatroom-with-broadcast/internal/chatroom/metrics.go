@@ -0,0 +1,74 @@
+package chatroom
+
+import (
+	"strings"
+
+	"github.com/Caesarsage/chatroom/internal/metrics"
+)
+
+// Metrics
+//
+// GET /metrics on the HTTP listener serves the room's telemetry in the
+// Prometheus text format. Messages are counted by channel, so
+// rate(chatroom_messages_total[1m]) gives messages per second; DMs are all
+// counted under channel="private" to keep who talks to whom out of it.
+
+// Reasons a message or frame was dropped, the reason label of
+// chatroom_dropped_messages_total.
+const (
+	dropQueueFull    = "queue_full"         // drop-oldest and disconnect policies
+	dropBlockTimeout = "block_timeout"      // block policy
+	dropSpillFailed  = "spill_failed"       // spill policy, on a file error
+	dropMuted        = "muted"              // sent by a muted user
+	dropOfflineFull  = "offline_queue_full" // DM for a user whose offline queue is full
+)
+
+// Reconnect results, the result label of chatroom_reconnects_total.
+const (
+	reconnectSuccess = "success"
+	reconnectFailure = "failure"
+)
+
+// chatMetrics are the metrics of a room.
+type chatMetrics struct {
+	registry *metrics.Registry
+
+	messages         *metrics.Counter   // by channel
+	dropped          *metrics.Counter   // by reason
+	persistLatency   *metrics.Histogram // WAL append and fsync, in seconds
+	snapshots        *metrics.Counter
+	snapshotDuration *metrics.Gauge
+	snapshotSize     *metrics.Gauge
+	reconnects       *metrics.Counter // by result
+}
+
+// persistBuckets are the upper bounds of the persist latency buckets, from
+// 100µs to a second.
+var persistBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+func newChatMetrics(cr *ChatRoom) *chatMetrics {
+	r := metrics.NewRegistry()
+	r.GaugeFunc("chatroom_connected_clients", "Clients connected to this node.", func() float64 {
+		cr.mu.Lock()
+		defer cr.mu.Unlock()
+		return float64(len(cr.clients))
+	})
+	return &chatMetrics{
+		registry:         r,
+		messages:         r.Counter("chatroom_messages_total", "Messages delivered, by channel.", "channel"),
+		dropped:          r.Counter("chatroom_dropped_messages_total", "Messages and frames dropped instead of delivered, by reason.", "reason"),
+		persistLatency:   r.Histogram("chatroom_persist_duration_seconds", "Time to append a message to the WAL and fsync it.", persistBuckets),
+		snapshots:        r.Counter("chatroom_snapshots_total", "Snapshots taken."),
+		snapshotDuration: r.Gauge("chatroom_snapshot_duration_seconds", "Time the last snapshot took."),
+		snapshotSize:     r.Gauge("chatroom_snapshot_size_bytes", "Size of the last snapshot."),
+		reconnects:       r.Counter("chatroom_reconnects_total", "Reconnect attempts with a token, by result.", "result"),
+	}
+}
+
+// channelLabel is the channel label a message in channel is counted under.
+func channelLabel(channel string) string {
+	if strings.HasPrefix(channel, privatePrefix) {
+		return "private"
+	}
+	return channel
+}
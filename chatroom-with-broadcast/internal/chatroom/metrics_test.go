@@ -0,0 +1,75 @@
+package chatroom
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+
+	// alice's queue holds one frame, so every frame but the newest is dropped
+	alice := &Client{username: "Alice", outgoing: make(chan Event, 1), lastActive: time.Now()}
+	alice.slowConsumer = cr.slowConsumer
+	cr.join <- alice
+	for _, text := range []string{"one", "two", "three"} {
+		cr.broadcast <- Message{From: "Alice", Content: text}
+	}
+	waitFor(t, "the messages to be delivered", func() bool {
+		cr.mu.Lock()
+		defer cr.mu.Unlock()
+		return cr.totalMessages == 4
+	})
+
+	bob, bobReader := connectPipe(t, cr)
+	bob.Write([]byte("reconnect:Bob:nope\n"))
+	expectLine(t, bobReader, "Invalid reconnect token", "Bob")
+
+	_, _, dropped := alice.backlog()
+	if dropped < 3 {
+		t.Fatalf("alice missed %d frames, want at least 3", dropped)
+	}
+
+	if err := cr.createSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(newHTTPMux(cr))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, want := range []string{
+		"chatroom_connected_clients 1\n",
+		fmt.Sprintf("chatroom_messages_total{channel=%q} 4\n", defaultChannel),
+		fmt.Sprintf("chatroom_dropped_messages_total{reason=%q} %d\n", dropQueueFull, dropped),
+		`chatroom_reconnects_total{result="failure"} 1` + "\n",
+		"chatroom_persist_duration_seconds_count 4\n",
+		"chatroom_snapshots_total 1\n",
+		"# TYPE chatroom_snapshot_size_bytes gauge\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("/metrics has no %q:\n%s", want, body)
+		}
+	}
+	if cr.metrics.snapshotSize.Value() == 0 {
+		t.Error("the snapshot size wasn't recorded")
+	}
+
+	if channelLabel(privatePrefix+"Alice:Bob") != "private" {
+		t.Error("a DM channel is counted under its own name")
+	}
+}
@@ -0,0 +1,465 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Moderation
+//
+// Users have a role: owner, moderator or (by default) user. Owners are set
+// with -owners and hand out roles with /op; moderators and owners can /kick,
+// /ban and /mute anyone of a lower role. Roles only count for users who
+// proved they own their name (an account login, a client certificate or a
+// session of a registered user), since anyone can pick an unregistered name.
+//
+// A ban covers the username and the address the user was connected from,
+// and is checked during the handshake. A muted user's chat messages are
+// dropped by handleBroadcast. Roles, bans and mutes are kept in
+// moderation.json, and every action is announced in #global by a system
+// message, so it's also in the log.
+
+const moderationFile = "moderation.json"
+
+// Role is what a user is allowed to do.
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleOwner     Role = "owner"
+)
+
+func (r Role) rank() int {
+	switch r {
+	case RoleOwner:
+		return 2
+	case RoleModerator:
+		return 1
+	}
+	return 0
+}
+
+// Ban keeps a user, and the address they used, out until Until (forever if
+// zero).
+type Ban struct {
+	Username  string    `json:"username"`
+	IP        string    `json:"ip,omitempty"`
+	By        string    `json:"by"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Until     time.Time `json:"until,omitempty"`
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && !now.Before(b.Until)
+}
+
+// moderationState is the content of moderation.json.
+type moderationState struct {
+	Roles map[string]Role      `json:"roles"`
+	Bans  []*Ban               `json:"bans"`
+	Mutes map[string]time.Time `json:"mutes"` // until; zero means until unmuted
+	// ConfigOwners are the owners last set with -owners, so that users
+	// dropped from it lose the role even if that happened while the server
+	// was down.
+	ConfigOwners []string `json:"config_owners,omitempty"`
+}
+
+func newModerationState() moderationState {
+	return moderationState{
+		Roles: make(map[string]Role),
+		Mutes: make(map[string]time.Time),
+	}
+}
+
+func (cr *ChatRoom) loadModeration() error {
+	data, err := os.ReadFile(filepath.Join(cr.dataDir, moderationFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	state := newModerationState()
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	cr.moderationMu.Lock()
+	defer cr.moderationMu.Unlock()
+	cr.moderation = state
+	fmt.Printf("Loaded %d roles and %d bans\n", len(state.Roles), len(state.Bans))
+	return nil
+}
+
+// saveModerationLocked atomically rewrites moderation.json, dropping expired
+// bans and mutes. Callers must hold moderationMu.
+func (cr *ChatRoom) saveModerationLocked() error {
+	now := time.Now()
+	bans := cr.moderation.Bans[:0]
+	for _, ban := range cr.moderation.Bans {
+		if !ban.expired(now) {
+			bans = append(bans, ban)
+		}
+	}
+	cr.moderation.Bans = bans
+	for username, until := range cr.moderation.Mutes {
+		if !until.IsZero() && !now.Before(until) {
+			delete(cr.moderation.Mutes, username)
+		}
+	}
+
+	data, err := json.MarshalIndent(cr.moderation, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(cr.dataDir, moderationFile), data)
+}
+
+// setOwners makes each of usernames an owner, and takes the role away from
+// the owners configured before that are no longer listed.
+func (cr *ChatRoom) setOwners(usernames []string) {
+	cr.moderationMu.Lock()
+	defer cr.moderationMu.Unlock()
+
+	var removed []string
+	for _, username := range cr.moderation.ConfigOwners {
+		if !slices.Contains(usernames, username) {
+			removed = append(removed, username)
+		}
+	}
+	if len(usernames) == 0 && len(removed) == 0 {
+		return
+	}
+
+	cr.moderation.ConfigOwners = slices.Clone(usernames)
+	for _, username := range usernames {
+		cr.moderation.Roles[username] = RoleOwner
+	}
+	for _, username := range removed {
+		if cr.moderation.Roles[username] == RoleOwner {
+			delete(cr.moderation.Roles, username)
+			fmt.Printf(" %s is no longer an owner\n", username)
+		}
+	}
+	if err := cr.saveModerationLocked(); err != nil {
+		fmt.Printf("Failed to save moderation state: %v\n", err)
+	}
+}
+
+// roleOf returns the role of username.
+func (cr *ChatRoom) roleOf(username string) Role {
+	cr.moderationMu.Lock()
+	defer cr.moderationMu.Unlock()
+
+	if role, ok := cr.moderation.Roles[username]; ok {
+		return role
+	}
+	return RoleUser
+}
+
+// clientRole returns the role client acts with: none beyond user's unless
+// it proved its name.
+func (cr *ChatRoom) clientRole(client *Client) Role {
+	client.mu.Lock()
+	authenticated := client.authenticated
+	client.mu.Unlock()
+
+	if !authenticated {
+		return RoleUser
+	}
+	return cr.roleOf(client.username)
+}
+
+// checkBan returns the ban keeping username or the host of addr out, or nil.
+func (cr *ChatRoom) checkBan(username, addr string) *Ban {
+	ip := hostOf(addr)
+	now := time.Now()
+
+	cr.moderationMu.Lock()
+	defer cr.moderationMu.Unlock()
+
+	for _, ban := range cr.moderation.Bans {
+		if ban.expired(now) {
+			continue
+		}
+		if ban.Username == username || (ban.IP != "" && ban.IP == ip) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// isMuted reports whether a moderator muted username.
+func (cr *ChatRoom) isMuted(username string) bool {
+	cr.moderationMu.Lock()
+	defer cr.moderationMu.Unlock()
+
+	until, ok := cr.moderation.Mutes[username]
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+// hostOf returns the host part of a network address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// parseModerationDuration parses a ban or mute length: a Go duration or a
+// number of days such as "7d".
+func parseModerationDuration(s string) (time.Duration, bool) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err == nil && n > 0
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil && d > 0
+}
+
+// describeUntil renders how long a ban or mute lasts.
+func describeUntil(until time.Time) string {
+	if until.IsZero() {
+		return "permanently"
+	}
+	return "until " + until.Format("2006-01-02 15:04")
+}
+
+// announceModeration records a moderation action in the log and tells
+// everyone in #global.
+func (cr *ChatRoom) announceModeration(text string) {
+	fmt.Printf(" Moderation: %s\n", text)
+	err := cr.publish(Message{
+		From:    "system",
+		Content: fmt.Sprintf("*** %s ***", text),
+		Channel: defaultChannel,
+	})
+	if err != nil {
+		fmt.Printf("Failed to log moderation action: %v\n", err)
+	}
+}
+
+// authorize reports whether client may moderate target, telling it why not.
+// Moderators and owners act on users of a lower role.
+func (cr *ChatRoom) authorize(client *Client, target string) bool {
+	role := cr.clientRole(client)
+	if role.rank() < RoleModerator.rank() {
+		client.sendError("Only moderators can do that")
+		return false
+	}
+	if target == client.username {
+		client.sendError("You can't do that to yourself")
+		return false
+	}
+	if cr.roleOf(target).rank() >= role.rank() {
+		client.sendError(fmt.Sprintf("%s is a %s; you can only moderate users below your role", target, cr.roleOf(target)))
+		return false
+	}
+	return true
+}
+
+// handleKickCommand handles "/kick <user> [reason]".
+func (cr *ChatRoom) handleKickCommand(client *Client, args []string) {
+	if len(args) < 2 {
+		client.sendError("Usage: /kick <user> [reason]")
+		return
+	}
+	target := args[1]
+	if !cr.authorize(client, target) {
+		return
+	}
+
+	victim := cr.findClientByUsername(target)
+	if victim == nil {
+		client.sendError(fmt.Sprintf("%s is not connected to this server", target))
+		return
+	}
+
+	reason := strings.Join(args[2:], " ")
+	victim.sendError(fmt.Sprintf("You were kicked by %s%s", client.username, reasonSuffix(reason)))
+	cr.disconnectClient(victim)
+	cr.announceModeration(fmt.Sprintf("%s was kicked by %s%s", target, client.username, reasonSuffix(reason)))
+}
+
+// handleBanCommand handles "/ban <user> [duration] [reason]".
+func (cr *ChatRoom) handleBanCommand(client *Client, args []string) {
+	if len(args) < 2 {
+		client.sendError("Usage: /ban <user> [duration such as 1h or 7d] [reason]")
+		return
+	}
+	target := args[1]
+	if !cr.authorize(client, target) {
+		return
+	}
+
+	ban := &Ban{Username: target, By: client.username, CreatedAt: time.Now()}
+	rest := args[2:]
+	if len(rest) > 0 {
+		if d, ok := parseModerationDuration(rest[0]); ok {
+			ban.Until = ban.CreatedAt.Add(d)
+			rest = rest[1:]
+		}
+	}
+	ban.Reason = strings.Join(rest, " ")
+
+	victim := cr.findClientByUsername(target)
+	if victim != nil && victim.conn != nil {
+		ban.IP = hostOf(victim.conn.RemoteAddr().String())
+	}
+
+	cr.moderationMu.Lock()
+	cr.moderation.Bans = append(cr.moderation.Bans, ban)
+	err := cr.saveModerationLocked()
+	cr.moderationMu.Unlock()
+	if err != nil {
+		fmt.Printf("Failed to save moderation state: %v\n", err)
+	}
+
+	if victim != nil {
+		victim.sendError(fmt.Sprintf("You were banned by %s %s%s", client.username, describeUntil(ban.Until), reasonSuffix(ban.Reason)))
+		cr.disconnectClient(victim)
+	}
+	cr.announceModeration(fmt.Sprintf("%s was banned by %s %s%s", target, client.username, describeUntil(ban.Until), reasonSuffix(ban.Reason)))
+}
+
+// handleUnbanCommand handles "/unban <user>", lifting every ban on the user.
+func (cr *ChatRoom) handleUnbanCommand(client *Client, args []string) {
+	if len(args) != 2 {
+		client.sendError("Usage: /unban <user>")
+		return
+	}
+	if cr.clientRole(client).rank() < RoleModerator.rank() {
+		client.sendError("Only moderators can do that")
+		return
+	}
+	target := args[1]
+
+	cr.moderationMu.Lock()
+	bans := cr.moderation.Bans[:0]
+	for _, ban := range cr.moderation.Bans {
+		if ban.Username != target {
+			bans = append(bans, ban)
+		}
+	}
+	lifted := len(cr.moderation.Bans) - len(bans)
+	cr.moderation.Bans = bans
+	err := cr.saveModerationLocked()
+	cr.moderationMu.Unlock()
+	if err != nil {
+		fmt.Printf("Failed to save moderation state: %v\n", err)
+	}
+
+	if lifted == 0 {
+		client.sendError(fmt.Sprintf("%s is not banned", target))
+		return
+	}
+	cr.announceModeration(fmt.Sprintf("%s was unbanned by %s", target, client.username))
+}
+
+// handleMuteCommand handles "/mute <user> [duration|off]".
+func (cr *ChatRoom) handleMuteCommand(client *Client, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		client.sendError("Usage: /mute <user> [duration such as 10m, or off]")
+		return
+	}
+	target := args[1]
+	if !cr.authorize(client, target) {
+		return
+	}
+
+	var until time.Time
+	unmute := len(args) == 3 && args[2] == "off"
+	if len(args) == 3 && !unmute {
+		d, ok := parseModerationDuration(args[2])
+		if !ok {
+			client.sendError(fmt.Sprintf("Invalid duration %q", args[2]))
+			return
+		}
+		until = time.Now().Add(d)
+	}
+
+	cr.moderationMu.Lock()
+	if unmute {
+		delete(cr.moderation.Mutes, target)
+	} else {
+		cr.moderation.Mutes[target] = until
+	}
+	err := cr.saveModerationLocked()
+	cr.moderationMu.Unlock()
+	if err != nil {
+		fmt.Printf("Failed to save moderation state: %v\n", err)
+	}
+
+	if unmute {
+		cr.announceModeration(fmt.Sprintf("%s was unmuted by %s", target, client.username))
+		return
+	}
+	cr.announceModeration(fmt.Sprintf("%s was muted by %s %s", target, client.username, describeUntil(until)))
+}
+
+// handleOpCommand handles "/op <user> [owner|moderator|user]", which only
+// owners may use. The role defaults to moderator; "user" takes roles away.
+func (cr *ChatRoom) handleOpCommand(client *Client, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		client.sendError("Usage: /op <user> [owner|moderator|user]")
+		return
+	}
+	if cr.clientRole(client) != RoleOwner {
+		client.sendError("Only owners can do that")
+		return
+	}
+
+	target, role := args[1], RoleModerator
+	if len(args) == 3 {
+		role = Role(strings.ToLower(args[2]))
+		if role.rank() == 0 && role != RoleUser {
+			client.sendError(fmt.Sprintf("Unknown role %q", args[2]))
+			return
+		}
+	}
+	if target == client.username && role != RoleOwner {
+		client.sendError("You can't demote yourself")
+		return
+	}
+
+	cr.moderationMu.Lock()
+	if role == RoleUser {
+		delete(cr.moderation.Roles, target)
+	} else {
+		cr.moderation.Roles[target] = role
+	}
+	err := cr.saveModerationLocked()
+	cr.moderationMu.Unlock()
+	if err != nil {
+		fmt.Printf("Failed to save moderation state: %v\n", err)
+	}
+
+	cr.announceModeration(fmt.Sprintf("%s made %s a %s", client.username, target, role))
+}
+
+// disconnectClient closes a client's connection; its reader then sees the
+// error and the client leaves.
+func (cr *ChatRoom) disconnectClient(client *Client) {
+	if client.conn != nil {
+		// Let the writer flush the farewell first
+		time.AfterFunc(100*time.Millisecond, func() { client.conn.Close() })
+	}
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
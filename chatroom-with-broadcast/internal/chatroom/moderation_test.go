@@ -0,0 +1,99 @@
+package chatroom
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModeration(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cr.Run()
+	cr.setOwners([]string{"alice"})
+
+	newClient := func(username string, authenticated bool) *Client {
+		client := &Client{username: username, authenticated: authenticated, outgoing: make(chan Event, 50), lastActive: time.Now()}
+		cr.join <- client
+		return client
+	}
+	alice := newClient("alice", true)
+	bob := newClient("bob", true)
+	mallory := newClient("mallory", false)
+	fakeAlice := &Client{username: "alice", outgoing: make(chan Event, 10)}
+
+	logged := func(text string) {
+		t.Helper()
+		waitFor(t, "the action to be logged", func() bool {
+			return strings.Contains(contents(cr.windowMessages()), text)
+		})
+	}
+
+	// Only owners hand out roles, and only to users who proved their name
+	handleCommand(fakeAlice, cr, "/op bob")
+	expectMessageContains(t, fakeAlice.outgoing, "Only owners", "fake alice")
+	handleCommand(alice, cr, "/op bob")
+	logged("alice made bob a moderator")
+
+	// Moderators can't touch owners or themselves
+	handleCommand(bob, cr, "/kick alice")
+	expectMessageContains(t, bob.outgoing, "below your role", "bob")
+	handleCommand(mallory, cr, "/kick bob")
+	expectMessageContains(t, mallory.outgoing, "Only moderators", "mallory")
+
+	// Muted users' messages never make it into the log
+	handleCommand(bob, cr, "/mute mallory 10m")
+	logged("mallory was muted by bob until")
+	cr.broadcast <- Message{From: "mallory", Content: "spam"}
+	cr.broadcast <- Message{From: "bob", Content: "quiet now"}
+	logged("quiet now")
+	if strings.Contains(contents(cr.windowMessages()), "spam") {
+		t.Fatal("a muted user's message was broadcast")
+	}
+	handleCommand(bob, cr, "/mute mallory off")
+	logged("mallory was unmuted by bob")
+
+	handleCommand(bob, cr, "/kick mallory flooding")
+	expectMessageContains(t, mallory.outgoing, "You were kicked by bob: flooding", "mallory")
+	logged("mallory was kicked by bob: flooding")
+
+	handleCommand(bob, cr, "/ban mallory 1h spam")
+	logged("mallory was banned by bob until")
+	if ban := cr.checkBan("mallory", "10.0.0.1:1234"); ban == nil || ban.Reason != "spam" {
+		t.Fatalf("ban = %+v", ban)
+	}
+
+	// Bans are checked in the handshake and survive restarts
+	conn, reader := connectPipe(t, cr)
+	conn.Write([]byte("mallory\n"))
+	expectLine(t, reader, "You are banned until", "mallory")
+
+	data, err := os.ReadFile(filepath.Join(dir, moderationFile))
+	if err != nil || !strings.Contains(string(data), `"bob": "moderator"`) {
+		t.Fatalf("moderation.json: %s, %v", data, err)
+	}
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+	if restarted.checkBan("mallory", "") == nil || restarted.roleOf("bob") != RoleModerator {
+		t.Fatal("bans and roles were lost on restart")
+	}
+	// An owner dropped from -owners while the server was down loses the role
+	restarted.setOwners(nil)
+	if restarted.roleOf("alice") != RoleUser {
+		t.Fatalf("alice is %s after being dropped from the owners", restarted.roleOf("alice"))
+	}
+
+	handleCommand(bob, cr, "/unban mallory")
+	logged("mallory was unbanned by bob")
+	if cr.checkBan("mallory", "") != nil {
+		t.Fatal("mallory is still banned")
+	}
+}
@@ -0,0 +1,207 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Offline delivery
+//
+// A DM to a user who isn't connected anywhere, but has a session or an
+// account, is stored in the conversation like any other DM and also queued
+// for the recipient as a queued-dm frame carrying the stored message, with
+// its ID and original timestamp.
+// The queue is flushed when the recipient next logs in or reconnects with
+// their token, and dropped if someone else takes a guest's name. Each sender
+// is told their message was delivered (queued in turn if they are offline by
+// then). Queues are saved to offline.json on every change, are kept by the
+// node the DM was sent on, and hold at most offlineLimit frames per user.
+
+const offlineFile = "offline.json"
+
+// defaultOfflineLimit is how many frames are queued for an offline user.
+const defaultOfflineLimit = 100
+
+// setOfflineLimit changes how many frames are queued for each offline user;
+// frames already queued are kept.
+func (cr *ChatRoom) setOfflineLimit(limit int) {
+	if limit < 1 {
+		limit = defaultOfflineLimit
+	}
+
+	cr.offlineMu.Lock()
+	defer cr.offlineMu.Unlock()
+	cr.offlineLimit = limit
+}
+
+// hasSession reports whether username has a session, connected or not.
+func (cr *ChatRoom) hasSession(username string) bool {
+	cr.sessionsMu.Lock()
+	defer cr.sessionsMu.Unlock()
+
+	_, exists := cr.sessions[username]
+	return exists
+}
+
+// queueDirectMessage handles a DM to a user who isn't connected.
+func (cr *ChatRoom) queueDirectMessage(dm DirectMessage) {
+	client := dm.from
+	if !cr.hasSession(dm.to) && !cr.hasAccount(dm.to) {
+		client.send(refEvent(errorEvent(fmt.Sprintf("User '%s' not found", dm.to)), dm.ref))
+		return
+	}
+
+	// The frame gets the stored message, with its ID, once the hub has
+	// stored it; until then the timestamp identifies it
+	msg := Message{
+		From:      client.username,
+		Content:   dm.text,
+		Timestamp: time.Now(),
+		Channel:   privateChannel(client.username, dm.to),
+	}
+	queued := newEvent(frameQueuedDM)
+	queued.Message = &msg
+	if !cr.enqueueOffline(dm.to, queued) {
+		client.send(refEvent(errorEvent(fmt.Sprintf("%s has too many messages waiting", dm.to)), dm.ref))
+		return
+	}
+
+	cr.handleBroadcast(msg)
+	client.send(refEvent(ackEvent(fmt.Sprintf("%s is offline; your message will be delivered when they next connect", dm.to)), dm.ref))
+}
+
+// enqueueOffline queues ev for username, unless the queue is full.
+func (cr *ChatRoom) enqueueOffline(username string, ev Event) bool {
+	cr.offlineMu.Lock()
+	defer cr.offlineMu.Unlock()
+
+	if len(cr.offline[username]) >= cr.offlineLimit {
+		fmt.Printf(" Offline queue for %s is full\n", username)
+		cr.metrics.dropped.Inc(dropOfflineFull)
+		return false
+	}
+	cr.offline[username] = append(cr.offline[username], ev)
+	cr.saveOfflineLocked()
+	return true
+}
+
+// recordQueuedDM replaces the message of the queued-dm frame waiting for the
+// recipient of msg, a stored DM, with msg itself. Frames are matched by
+// sender and timestamp, which handleBroadcast and replicate keep.
+func (cr *ChatRoom) recordQueuedDM(msg Message) {
+	recipient := privatePeer(msg.Channel, msg.From)
+
+	cr.offlineMu.Lock()
+	defer cr.offlineMu.Unlock()
+
+	for i, ev := range cr.offline[recipient] {
+		if ev.Type == frameQueuedDM && ev.Message.Channel == msg.Channel &&
+			ev.Message.From == msg.From && ev.Message.Timestamp.Equal(msg.Timestamp) {
+			cr.offline[recipient][i].Message = &msg
+			cr.saveOfflineLocked()
+			return
+		}
+	}
+}
+
+// queuedDMs returns the IDs of the DMs queued for username.
+func (cr *ChatRoom) queuedDMs(username string) map[int]bool {
+	cr.offlineMu.Lock()
+	defer cr.offlineMu.Unlock()
+
+	ids := make(map[int]bool)
+	for _, ev := range cr.offline[username] {
+		if ev.Type == frameQueuedDM {
+			ids[ev.Message.ID] = true
+		}
+	}
+	return ids
+}
+
+// deliverOffline sends a joining client everything queued for it and tells
+// the senders of queued DMs that they were delivered. It runs on the hub
+// goroutine.
+func (cr *ChatRoom) deliverOffline(client *Client) {
+	cr.offlineMu.Lock()
+	queued := cr.offline[client.username]
+	delete(cr.offline, client.username)
+	if len(queued) > 0 {
+		cr.saveOfflineLocked()
+	}
+	cr.offlineMu.Unlock()
+
+	if len(queued) == 0 {
+		return
+	}
+	client.sendSystem(fmt.Sprintf("%d messages arrived while you were away:", len(queued)))
+
+	for _, ev := range queued {
+		client.send(ev)
+		if ev.Type != frameQueuedDM {
+			continue
+		}
+
+		sender := ev.Message.From
+		notice := systemEvent(fmt.Sprintf("Your message to %s from %s was delivered",
+			client.username, ev.Message.Timestamp.Format("2006-01-02 15:04")))
+		if senderClient := cr.findClientByUsername(sender); senderClient != nil {
+			senderClient.send(notice)
+		} else {
+			cr.enqueueOffline(sender, notice)
+		}
+	}
+	fmt.Printf(" Delivered %d queued frames to %s\n", len(queued), client.username)
+}
+
+// dropOffline discards the queues of users who can no longer come back for
+// them: guests whose session expired or whose name was taken.
+func (cr *ChatRoom) dropOffline(usernames []string) {
+	cr.offlineMu.Lock()
+	defer cr.offlineMu.Unlock()
+
+	dropped := false
+	for _, username := range usernames {
+		if _, queued := cr.offline[username]; queued && !cr.hasAccount(username) {
+			delete(cr.offline, username)
+			dropped = true
+		}
+	}
+	if dropped {
+		cr.saveOfflineLocked()
+	}
+}
+
+func (cr *ChatRoom) loadOffline() error {
+	data, err := os.ReadFile(filepath.Join(cr.dataDir, offlineFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	offline := make(map[string][]Event)
+	if err := json.Unmarshal(data, &offline); err != nil {
+		return err
+	}
+
+	cr.offlineMu.Lock()
+	defer cr.offlineMu.Unlock()
+	cr.offline = offline
+	return nil
+}
+
+// saveOfflineLocked atomically rewrites the offline queues. Callers must
+// hold offlineMu.
+func (cr *ChatRoom) saveOfflineLocked() {
+	data, err := json.MarshalIndent(cr.offline, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(cr.dataDir, offlineFile), data)
+	}
+	if err != nil {
+		fmt.Printf("Failed to save offline queues: %v\n", err)
+	}
+}
@@ -0,0 +1,91 @@
+package chatroom
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOfflineDelivery(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cr.Run()
+	cr.setOfflineLimit(1)
+	cr.createSession("bob")
+
+	alice := &Client{username: "alice", outgoing: make(chan Event, 50), lastActive: time.Now()}
+	cr.join <- alice
+
+	cr.sendDirectMessage(alice, "bob", "call me", "")
+	expectMessageContains(t, alice.outgoing, "bob is offline", "alice")
+	cr.sendDirectMessage(alice, "bob", "please", "")
+	expectMessageContains(t, alice.outgoing, "bob has too many messages waiting", "alice")
+	cr.sendDirectMessage(alice, "nobody", "hi", "")
+	expectMessageContains(t, alice.outgoing, "User 'nobody' not found", "alice")
+
+	// The queue survives a restart and is flushed when bob next joins
+	cr.offlineMu.Lock()
+	sent := cr.offline["bob"][0].Message.Timestamp
+	cr.offlineMu.Unlock()
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+	go restarted.Run()
+	alice = &Client{username: "alice", outgoing: make(chan Event, 50), lastActive: time.Now()}
+	restarted.join <- alice
+	bob := &Client{username: "bob", outgoing: make(chan Event, 50), lastActive: time.Now(), authenticated: true}
+	restarted.join <- bob
+
+	expectMessageContains(t, bob.outgoing, "1 messages arrived while you were away", "bob")
+	ev := <-bob.outgoing
+	if ev.Type != frameQueuedDM || ev.Message.Content != "call me" || !ev.Message.Timestamp.Equal(sent) {
+		t.Fatalf("got %+v, want the queued DM with its original timestamp", ev)
+	}
+	// ...and it is the stored message, so bob can /reply to it
+	stored := restarted.latestMessages(privateChannel("alice", "bob"), 1)
+	if len(stored) != 1 || ev.Message.ID != stored[0].ID || !ev.Message.Timestamp.Equal(stored[0].Timestamp) {
+		t.Fatalf("queued DM %+v isn't the stored one %+v", ev.Message, stored)
+	}
+	expectMessageContains(t, alice.outgoing, "Your message to bob from", "alice")
+
+	restarted.offlineMu.Lock()
+	defer restarted.offlineMu.Unlock()
+	if len(restarted.offline) != 0 {
+		t.Fatalf("offline queues left after delivery: %v", restarted.offline)
+	}
+}
+
+func TestOfflineQueueStaysWithItsGuest(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cr.Run()
+	closeAtCleanup(t, cr)
+	cr.createSession("carol")
+
+	alice := &Client{username: "alice", outgoing: make(chan Event, 50), lastActive: time.Now()}
+	cr.join <- alice
+	cr.sendDirectMessage(alice, "carol", "the password is swordfish", "")
+	expectMessageContains(t, alice.outgoing, "carol is offline", "alice")
+
+	// Someone else taking the name without carol's token doesn't get it
+	mallory := &Client{username: "carol", outgoing: make(chan Event, 50), lastActive: time.Now()}
+	cr.join <- mallory
+	syncHub(cr)
+	for len(mallory.outgoing) > 0 {
+		if ev := <-mallory.outgoing; strings.Contains(ev.Content, "arrived while you were away") || ev.Type == frameQueuedDM {
+			t.Fatalf("a new guest got carol's queue: %+v", ev)
+		}
+	}
+	cr.offlineMu.Lock()
+	defer cr.offlineMu.Unlock()
+	if len(cr.offline["carol"]) != 0 {
+		t.Fatalf("carol's queue was kept for whoever logs in next: %v", cr.offline["carol"])
+	}
+}
@@ -2,41 +2,86 @@ package chatroom
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/wal"
 )
 
 // WAL - Write-ahead-log
+//
+// Messages are appended to a segmented, checksummed log in <data>/wal (see
+// internal/wal). Older versions wrote one JSON object per line to
+// messages.wal; that file is still replayed, before the segments, until the
+// next snapshot makes it redundant.
+
+// snapshot is the on-disk layout of snapshot.json. Messages holds the
+// in-memory window of every channel; older snapshots held every message.
+type snapshot struct {
+	Messages []Message  `json:"messages"`
+	Channels []*Channel `json:"channels"`
+	// LastMessageID is the newest message ID assigned when the snapshot was
+	// taken, or -1.
+	LastMessageID int `json:"last_message_id"`
+	// LastFromNode is the newest message ID stored from each cluster node.
+	LastFromNode map[int]int `json:"last_from_node,omitempty"`
+	// Amendments are the newest edit or delete record of every changed
+	// message, which may be older than the windows.
+	Amendments []Message `json:"amendments,omitempty"`
+}
+
+// crashPoint is called between the steps of a checkpoint. Tests replace it
+// to kill the process at each step.
+var crashPoint = func(step string) {}
 
 func (cr *ChatRoom) initializePersistence() error {
 	if err := os.MkdirAll(cr.dataDir, 0755); err != nil {
 		return fmt.Errorf("create data dir: %w", err)
 	}
 
-	walPath := filepath.Join(cr.dataDir, "messages.wal")
-
-	if err := cr.recoverFromWAL(walPath); err != nil {
+	if err := cr.recoverFromWAL(filepath.Join(cr.dataDir, "messages.wal")); err != nil {
 		fmt.Printf("Recovery failed: %v\n", err)
 	}
 
-	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	walDir := filepath.Join(cr.dataDir, "wal")
+	checkpointed := 0
+	log, report, err := wal.Open(walDir, wal.DefaultSegmentSize, func(payload []byte) {
+		var msg Message
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			fmt.Printf("Skipping undecodable WAL record: %v\n", err)
+			return
+		}
+		if !cr.recoverMessage(msg) {
+			checkpointed++
+		}
+	})
 	if err != nil {
 		return fmt.Errorf("open wal: %w", err)
 	}
+	cr.wal = log
+
+	// The history log may hold a message the WAL lost, so never reuse its IDs
+	if last := cr.history.LastID(); last >= cr.nextMessageID {
+		cr.nextMessageID = last + 1
+	}
 
-	cr.walFile = file
-	fmt.Printf("WAL initialized: %s\n", walPath)
+	fmt.Printf("WAL recovered from %s: %s (%d already in the snapshot)\n", walDir, report, checkpointed)
+	if report.Truncated > 0 {
+		fmt.Printf(" Cut off %d bytes of a torn write\n", report.TruncatedBytes)
+	}
 	return nil
 }
 
+// recoverFromWAL replays a legacy JSON-lines WAL, if there is one.
 func (cr *ChatRoom) recoverFromWAL(walPath string) error {
 	file, err := os.Open(walPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Println("No WAL file found (fresh start)")
 			return nil
 		}
 		return err
@@ -44,7 +89,7 @@ func (cr *ChatRoom) recoverFromWAL(walPath string) error {
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
-	recovered := 0
+	recovered, corrupt := 0, 0
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -54,53 +99,83 @@ func (cr *ChatRoom) recoverFromWAL(walPath string) error {
 		var msg Message
 		if err := json.Unmarshal([]byte(line), &msg); err != nil {
 			fmt.Printf("Skipping corrupt line: %s\n", line)
+			corrupt++
 			continue
 		}
-		cr.messages = append(cr.messages, msg)
-		if msg.ID >= cr.nextMessageID {
-			cr.nextMessageID = msg.ID + 1
+		if cr.recoverMessage(msg) {
+			recovered++
 		}
-		recovered++
 	}
 
-	fmt.Printf("Recovered %d messages \n", recovered)
-	return nil
+	fmt.Printf("Recovered %d messages from legacy WAL %s (%d corrupt lines)\n", recovered, walPath, corrupt)
+	return scanner.Err()
 }
 
-func (cr *ChatRoom) persistMessage(msg Message) error {
-	cr.messageMu.Lock()
-	defer cr.messageMu.Unlock()
-
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
+// recoverMessage adds a message read back from a WAL and reports whether it
+// was new. Entries covered by the snapshot are already in their window or
+// older than it, and in the history log, so storing them again is a no-op.
+func (cr *ChatRoom) recoverMessage(msg Message) bool {
+	if !cr.storeMessageLocked(msg) {
+		return false // Checkpointed, or logged twice
 	}
 
-	_, err = cr.walFile.Write(append(data, '\n'))
+	cr.applyChannelEvent(msg)
+	return true
+}
+
+func (cr *ChatRoom) persistMessage(msg Message) error {
+	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	return cr.walFile.Sync()
+	started := time.Now()
+	err = cr.wal.Append(data)
+	cr.metrics.persistLatency.Observe(time.Since(started).Seconds())
+	return err
 }
 
+// createSnapshot checkpoints the chat state to snapshot.json and drops the
+// WAL segments it covers.
+//
+// The state is captured and the WAL rotated together under messageMu.
+// Messages are stored (in their window and the history log) before they are
+// logged, so every record in the older segments is in the snapshot or the
+// history log, and appends racing with the checkpoint land in the new
+// segment. The history log is synced and the search index saved before the
+// snapshot replaces the old one. A crash at any step leaves either the old
+// snapshot with every segment, or the new one with segments whose entries
+// replay skips.
 func (cr *ChatRoom) createSnapshot() error {
-	snapshortPath := filepath.Join(cr.dataDir, "snapshot.json")
-	tempPath := snapshortPath + ".tmp"
-
-	file, err := os.Create(tempPath)
+	started := time.Now()
+	cr.messageMu.Lock()
+	data, messageCount, err := cr.encodeSnapshotLocked()
+	segment := 0
+	if err == nil {
+		segment, err = cr.wal.Rotate()
+	}
+	lastMessageID := cr.nextMessageID - 1
+	cr.messageMu.Unlock()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	crashPoint("rotated")
 
-	cr.messageMu.Lock()
-	data, err := json.MarshalIndent(cr.messages, "", "  ")
-	cr.messageMu.Unlock()
+	if err := cr.history.Sync(); err != nil {
+		return fmt.Errorf("sync history: %w", err)
+	}
+	if err := cr.saveSearchIndex(); err != nil {
+		return fmt.Errorf("save search index: %w", err)
+	}
 
+	snapshotPath := filepath.Join(cr.dataDir, "snapshot.json")
+	tempPath := snapshotPath + ".tmp"
+
+	file, err := os.Create(tempPath)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	if _, err := file.Write(data); err != nil {
 		return err
@@ -111,30 +186,61 @@ func (cr *ChatRoom) createSnapshot() error {
 	}
 
 	file.Close()
-	if err := os.Rename(tempPath, snapshortPath); err != nil {
+	crashPoint("snapshot-written")
+
+	if err := os.Rename(tempPath, snapshotPath); err != nil {
+		return err
+	}
+	if err := wal.SyncDir(cr.dataDir); err != nil {
+		return err
+	}
+	crashPoint("snapshot-renamed")
+
+	// Everything before the new segment is in the snapshot now
+	if err := cr.wal.RemoveBefore(segment); err != nil {
+		return err
+	}
+	legacyPath := filepath.Join(cr.dataDir, "messages.wal")
+	if err := os.Remove(legacyPath); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	crashPoint("wal-compacted")
+
+	cr.messageMu.Lock()
+	cr.checkpointID = lastMessageID
+	cr.messageMu.Unlock()
 
-	fmt.Printf("Snapshot created (%d messages)\n", len(cr.messages))
-	return cr.truncateWAL()
+	cr.metrics.snapshots.Inc()
+	cr.metrics.snapshotDuration.Set(time.Since(started).Seconds())
+	cr.metrics.snapshotSize.Set(float64(len(data)))
+	fmt.Printf("Snapshot created (%d messages)\n", messageCount)
+	return nil
 }
 
-func (cr *ChatRoom) truncateWAL() error {
-	cr.walMu.Lock()
-	defer cr.walMu.Unlock()
+// encodeSnapshot returns the message windows and channels in the
+// snapshot.json format, and how many messages it holds.
+func (cr *ChatRoom) encodeSnapshot() ([]byte, int, error) {
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+	return cr.encodeSnapshotLocked()
+}
 
-	if cr.walFile != nil {
-		cr.walFile.Close()
-	}
+// encodeSnapshotLocked is encodeSnapshot for callers holding cr.messageMu.
+func (cr *ChatRoom) encodeSnapshotLocked() ([]byte, int, error) {
+	cr.channelsMu.Lock()
+	defer cr.channelsMu.Unlock()
 
-	walPath := filepath.Join(cr.dataDir, "messages.wal")
-	file, err := os.OpenFile(walPath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+	snap := snapshot{
+		Messages:      cr.windowMessagesLocked(),
+		LastMessageID: cr.nextMessageID - 1,
+		LastFromNode:  cr.lastFromNode,
+		Amendments:    cr.amendmentsLocked(),
 	}
-	cr.walFile = file
-	fmt.Println(" WAL truncated")
-	return nil
+	for _, ch := range cr.channels {
+		snap.Channels = append(snap.Channels, ch)
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	return data, len(snap.Messages), err
 }
 
 func (cr *ChatRoom) loadSnapshot() error {
@@ -153,19 +259,96 @@ func (cr *ChatRoom) loadSnapshot() error {
 		return err
 	}
 
-	cr.messageMu.Lock()
-	err = json.Unmarshal(data, &cr.messages)
-	cr.messageMu.Unlock()
+	if err := cr.restoreSnapshot(data); err != nil {
+		return err
+	}
+
+	fmt.Printf("Loaded %d messages from snapshot\n", len(cr.windowMessages()))
+	return nil
+}
+
+// restoreSnapshot replaces the message windows and channels with those in
+// data, which is in the snapshot.json format. Messages missing from the
+// history log, such as those of a snapshot from before it existed, are added
+// to it.
+func (cr *ChatRoom) restoreSnapshot(data []byte) error {
+	snap := snapshot{LastMessageID: -1}
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		// Snapshots used to be a bare array of messages
+		err = json.Unmarshal(data, &snap.Messages)
+	} else {
+		err = json.Unmarshal(data, &snap)
+	}
 	if err != nil {
 		return err
 	}
 
-	for _, msg := range cr.messages {
-		if msg.ID >= cr.nextMessageID {
-			cr.nextMessageID = msg.ID + 1
+	cr.messageMu.Lock()
+	cr.windows = make(map[string]*messageRing)
+	cr.lastFromNode = make(map[int]int)
+	cr.nextMessageID = snap.LastMessageID + 1
+	for _, rec := range snap.Amendments {
+		if !cr.supersededLocked(rec) {
+			cr.amendments[rec.Ref] = rec
+		}
+	}
+	for _, msg := range snap.Messages {
+		cr.storeMessageLocked(msg)
+	}
+	for node, id := range snap.LastFromNode {
+		if last, ok := cr.lastFromNode[node]; !ok || id > last {
+			cr.lastFromNode[node] = id
+		}
+	}
+	// Older messages than the snapshot holds are only in the history log
+	for channel, ring := range cr.windows {
+		stored, err := cr.history.Count(channel, -1)
+		if err != nil {
+			fmt.Printf("Failed to read the history log: %v\n", err)
+		}
+		ring.partial = ring.partial || err != nil || stored > ring.len()
+	}
+	cr.checkpointID = cr.nextMessageID - 1
+	cr.messageMu.Unlock()
+
+	cr.channelsMu.Lock()
+	cr.channels = map[string]*Channel{defaultChannel: newChannel(defaultChannel)}
+	for _, ch := range snap.Channels {
+		if ch.Members == nil {
+			ch.Members = make(map[string]bool)
 		}
+		cr.channels[ch.Name] = ch
 	}
+	cr.channelsMu.Unlock()
 
-	fmt.Printf("Loaded %d messages from snapshot\n", len(cr.messages))
+	if len(snap.Channels) == 0 {
+		for _, msg := range snap.Messages {
+			cr.applyChannelEvent(msg)
+		}
+	}
 	return nil
 }
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it and
+// renames it into place so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + ".tmp"
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	file.Close()
+	return os.Rename(tempPath, path)
+}
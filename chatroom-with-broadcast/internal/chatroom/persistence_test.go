@@ -0,0 +1,42 @@
+package chatroom
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLegacyWALStillReadable(t *testing.T) {
+	dir := t.TempDir()
+
+	legacy := `{"id":0,"from":"alice","content":"from the old format","channel":"global"}
+{"id":1,"from":"bob","content":"me too","channel":"global"}
+{"id":2,"from":"bob","con
+`
+	if err := os.WriteFile(filepath.Join(dir, "messages.wal"), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.handleBroadcast(Message{From: "carol", Content: "in the new format"})
+	cr.wal.Close()
+
+	// The legacy file and the new segments are both replayed, in order
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+
+	var got []string
+	for _, msg := range restarted.windowMessages() {
+		got = append(got, fmt.Sprintf("%d:%s", msg.ID, msg.Content))
+	}
+	if want := "[0:from the old format 1:me too 2:in the new format]"; fmt.Sprint(got) != want {
+		t.Fatalf("recovered %v, want %s", got, want)
+	}
+}
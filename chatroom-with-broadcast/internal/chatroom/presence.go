@@ -0,0 +1,213 @@
+package chatroom
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Presence
+//
+// Every connected user is online, away or busy, with an optional status
+// message. /away and /busy set it, /back clears it, and a user who has sent
+// nothing for awayAfter is marked away automatically until they next send
+// something. Changes are sent as presence frames to everyone sharing a
+// channel with the user. JSON clients can also send typing frames, which
+// are passed on to the other JSON clients in the channel or DM, at most
+// once every typingInterval per user.
+
+// Presence is a user's availability.
+type Presence string
+
+const (
+	PresenceOnline Presence = "online"
+	PresenceAway   Presence = "away"
+	PresenceBusy   Presence = "busy"
+)
+
+// defaultAwayAfter is how long a user can be quiet before being marked away.
+const defaultAwayAfter = 3 * time.Minute
+
+// typingInterval is the least time between two typing frames passed on for
+// the same user.
+const typingInterval = 3 * time.Second
+
+// presence returns the client's availability and status message.
+func (c *Client) presence() (Presence, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.availability == "" {
+		return PresenceOnline, ""
+	}
+	return c.availability, c.status
+}
+
+// setPresence changes the client's availability and reports whether it
+// changed. auto marks an away set by the idle check rather than by the user.
+func (c *Client) setPresence(presence Presence, status string, auto bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.availability == "" {
+		c.availability = PresenceOnline
+	}
+	if c.availability == presence && c.status == status {
+		return false
+	}
+	c.availability, c.status, c.autoAway = presence, status, auto
+	return true
+}
+
+// setAwayAfter changes how long users can be quiet before being marked away;
+// zero disables it.
+func (cr *ChatRoom) setAwayAfter(d time.Duration) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.awayAfter = d
+}
+
+// handlePresenceCommand handles "/away [message]", "/busy [message]" and
+// "/back".
+func (cr *ChatRoom) handlePresenceCommand(client *Client, args []string) {
+	presence := PresenceOnline
+	switch args[0] {
+	case "/away":
+		presence = PresenceAway
+	case "/busy":
+		presence = PresenceBusy
+	}
+	status := strings.Join(args[1:], " ")
+
+	if !client.setPresence(presence, status, false) {
+		client.sendSystem(fmt.Sprintf("You are already %s", presence))
+		return
+	}
+	cr.announcePresenceChange(client)
+}
+
+// noteActivity records that client just sent something, bringing it back
+// from an automatic away.
+func (cr *ChatRoom) noteActivity(client *Client) {
+	client.mu.Lock()
+	client.lastActive = time.Now()
+	back := client.autoAway
+	client.mu.Unlock()
+
+	if back && client.setPresence(PresenceOnline, "", false) {
+		cr.announcePresenceChange(client)
+	}
+}
+
+// markAway marks the online users who have been quiet for awayAfter as away.
+func (cr *ChatRoom) markAway() {
+	cr.mu.Lock()
+	awayAfter := cr.awayAfter
+	var quiet []*Client
+	for client := range cr.clients {
+		if awayAfter > 0 && client.isInactive(awayAfter) {
+			quiet = append(quiet, client)
+		}
+	}
+	cr.mu.Unlock()
+
+	for _, client := range quiet {
+		if presence, _ := client.presence(); presence != PresenceOnline {
+			continue
+		}
+		if client.setPresence(PresenceAway, "", true) {
+			cr.announcePresenceChange(client)
+		}
+	}
+}
+
+func (cr *ChatRoom) autoAway() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cr.markAway()
+	}
+}
+
+// audience returns the other local clients that share a channel with
+// username. With onlyJSON set it leaves out text clients.
+func (cr *ChatRoom) audience(username string, channels []string, onlyJSON bool) []*Client {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	var clients []*Client
+	for client := range cr.clients {
+		if client.username == username || (onlyJSON && !client.jsonMode) {
+			continue
+		}
+		for _, channel := range channels {
+			if cr.isMember(channel, client.username) {
+				clients = append(clients, client)
+				break
+			}
+		}
+	}
+	return clients
+}
+
+// announcePresenceChange sends client's presence to everyone sharing a
+// channel with it, and confirms it to the client.
+func (cr *ChatRoom) announcePresenceChange(client *Client) {
+	presence, status := client.presence()
+
+	ev := newEvent(framePresence)
+	ev.Users = []UserInfo{{Username: client.username, Node: cr.nodeID(), Presence: presence, Status: status}}
+	switch {
+	case presence == PresenceOnline:
+		ev.Content = fmt.Sprintf("%s is back", client.username)
+	case status != "":
+		ev.Content = fmt.Sprintf("%s is %s: %s", client.username, presence, status)
+	default:
+		ev.Content = fmt.Sprintf("%s is %s", client.username, presence)
+	}
+
+	fmt.Printf(" %s\n", ev.Content)
+	for _, other := range cr.audience(client.username, cr.memberChannels(client.username), false) {
+		other.send(ev)
+	}
+	client.send(ev)
+}
+
+// handleTyping passes a typing frame from a JSON client on to the other JSON
+// clients in the channel, or to the DM recipient when To is set.
+func (cr *ChatRoom) handleTyping(client *Client, frame clientFrame) {
+	client.mu.Lock()
+	throttled := time.Since(client.lastTyping) < typingInterval
+	if !throttled {
+		client.lastTyping = time.Now()
+	}
+	client.mu.Unlock()
+	if throttled {
+		return
+	}
+
+	ev := newEvent(frameTyping)
+	ev.User = client.username
+	var recipients []*Client
+	if frame.To != "" {
+		ev.Channel = privateChannel(client.username, frame.To)
+		if target := cr.findClientByUsername(frame.To); target != nil && target.jsonMode {
+			recipients = append(recipients, target)
+		}
+	} else {
+		ev.Channel = client.currentChannel()
+		if frame.Channel != "" {
+			ev.Channel = normalizeChannelName(frame.Channel)
+		}
+		if !cr.isMember(ev.Channel, client.username) {
+			client.send(refEvent(errorEvent(fmt.Sprintf("You are not in #%s", ev.Channel)), frame.Ref))
+			return
+		}
+		recipients = cr.audience(client.username, []string{ev.Channel}, true)
+	}
+
+	for _, recipient := range recipients {
+		recipient.send(ev)
+	}
+}
@@ -0,0 +1,66 @@
+package chatroom
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	cr, err := NewChatRoom(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.wal.Close()
+
+	newClient := func(username string, jsonMode bool) *Client {
+		client := &Client{username: username, jsonMode: jsonMode, outgoing: make(chan Event, 50), lastActive: time.Now()}
+		cr.handleJoin(client)
+		return client
+	}
+	alice := newClient("alice", true)
+	bob := newClient("bob", true)
+	carol := newClient("carol", false)
+
+	// Changes reach everyone sharing a channel, and show up in /users
+	handleCommand(alice, cr, "/away lunch")
+	expectMessageContains(t, bob.outgoing, "*** alice is away: lunch ***", "bob")
+	expectMessageContains(t, carol.outgoing, "*** alice is away: lunch ***", "carol")
+	cr.sendUserList(carol)
+	expectMessageContains(t, carol.outgoing, "alice (away: lunch)", "carol's user list")
+	handleCommand(alice, cr, "/back")
+	expectMessageContains(t, bob.outgoing, "alice is back", "bob")
+
+	// Quiet users are marked away until they next say something
+	cr.setAwayAfter(time.Minute)
+	carol.mu.Lock()
+	carol.lastActive = time.Now().Add(-2 * time.Minute)
+	carol.mu.Unlock()
+	cr.markAway()
+	expectMessageContains(t, bob.outgoing, "carol is away", "bob")
+	handleCommand(bob, cr, "/busy")
+	expectMessageContains(t, alice.outgoing, "bob is busy", "alice")
+	cr.noteActivity(carol)
+	cr.noteActivity(bob)
+	expectMessageContains(t, alice.outgoing, "carol is back", "alice")
+	if presence, _ := bob.presence(); presence != PresenceBusy {
+		t.Fatalf("bob is %s, want busy: only automatic aways end with activity", presence)
+	}
+
+	// Typing frames only go to other JSON clients, throttled
+	expectMessageContains(t, bob.outgoing, "carol is back", "bob")
+	cr.handleTyping(alice, clientFrame{Type: frameTyping})
+	ev := <-bob.outgoing
+	if ev.Type != frameTyping || ev.User != "alice" || ev.Channel != defaultChannel {
+		t.Fatalf("got %+v, want alice typing in #global", ev)
+	}
+	cr.handleTyping(alice, clientFrame{Type: frameTyping})
+	cr.handleTyping(carol, clientFrame{Type: frameTyping, To: "bob"})
+	if ev := <-bob.outgoing; ev.Type != frameTyping || ev.User != "carol" || ev.Channel != "private:bob:carol" {
+		t.Fatalf("got %+v, want carol typing in a DM", ev)
+	}
+	for len(carol.outgoing) > 0 {
+		if ev := <-carol.outgoing; ev.Type == frameTyping {
+			t.Fatal("a text client got a typing frame")
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Wire protocol
+//
+// Legacy clients exchange plain text lines. A client that opens the
+// connection with a JSON "hello" frame instead of a username switches to the
+// JSON-lines protocol: every line it sends is a clientFrame and every line
+// it receives is an Event. The server's first line (the username prompt) is
+// always plain text.
+
+// Frame types sent to clients.
+const (
+	frameMessage       = "message"
+	frameDM            = "dm"
+	frameQueuedDM      = "queued-dm"
+	frameEdit          = "edit"
+	frameDelete        = "delete"
+	frameSystem        = "system"
+	frameHistoryBatch  = "history-batch"
+	frameSearchResults = "search-results"
+	frameUserList      = "user-list"
+	frameError         = "error"
+	frameAck           = "ack"
+	frameGap           = "gap"
+	frameWarning       = "warning"
+	framePresence      = "presence"
+	frameShutdown      = "shutdown"
+	frameTyping        = "typing" // also sent by JSON clients
+)
+
+// Frame types sent by JSON clients.
+const (
+	frameHello   = "hello"
+	frameCommand = "command"
+)
+
+// Event is a typed frame queued on Client.outgoing. JSON clients receive it
+// marshalled as one line; text clients receive Text().
+type Event struct {
+	Type      string     `json:"type"`
+	Seq       int        `json:"seq"` // per-connection frame number, set when written
+	Timestamp time.Time  `json:"timestamp"`
+	Message   *Message   `json:"message,omitempty"`  // message, dm, queued-dm, edit and delete
+	Messages  []Message  `json:"messages,omitempty"` // history-batch, and search-results newest first
+	Skipped   int        `json:"skipped,omitempty"`  // history-batch: older messages left out; search-results: matches not shown; gap: frames dropped
+	Users     []UserInfo `json:"users,omitempty"`    // user-list, and presence for the one user
+	User      string     `json:"user,omitempty"`     // typing: who is typing; shutdown: who the token is for
+	Channel   string     `json:"channel,omitempty"`  // typing: where
+	Content   string     `json:"content,omitempty"`  // text of system, error and ack frames, or a header
+	Ref       string     `json:"ref,omitempty"`      // ack and error: ref of the client frame they answer
+	Token     string     `json:"token,omitempty"`    // shutdown: the reconnect token to come back with
+
+	queueSeq int // position in the client's queue, set by Client.send
+	cursor   int // ID of the newest message the client has once this is written
+}
+
+// UserInfo describes a connected user in a user-list frame.
+type UserInfo struct {
+	Username string   `json:"username"`
+	Idle     bool     `json:"idle"`
+	Presence Presence `json:"presence"`
+	Status   string   `json:"status,omitempty"` // away or busy message
+	Node     int      `json:"node"`             // cluster node the user is connected to
+	Remote   bool     `json:"remote,omitempty"` // connected to another node
+
+	// Backlog of local users: frames queued for them, how long the last
+	// one written had waited and how many were dropped
+	Queued  int   `json:"queued,omitempty"`
+	LagMs   int64 `json:"lag_ms,omitempty"`
+	Dropped int   `json:"dropped,omitempty"`
+}
+
+// clientFrame is a line sent by a JSON client.
+type clientFrame struct {
+	Type     string `json:"type"`
+	Ref      string `json:"ref,omitempty"`
+	Username string `json:"username,omitempty"` // hello
+	Token    string `json:"token,omitempty"`    // hello: reconnect token
+	Password string `json:"password,omitempty"` // hello: account password
+	Register bool   `json:"register,omitempty"` // hello: create the account
+	Channel  string `json:"channel,omitempty"`  // message and typing
+	To       string `json:"to,omitempty"`       // dm, and typing in a DM
+	Content  string `json:"content,omitempty"`  // message, dm and command
+}
+
+func newEvent(eventType string) Event {
+	return Event{Type: eventType, Timestamp: time.Now()}
+}
+
+func messageEvent(msg Message) Event {
+	ev := newEvent(frameMessage)
+	ev.Message = &msg
+	return ev
+}
+
+func textEvent(eventType, text string) Event {
+	ev := newEvent(eventType)
+	ev.Content = strings.TrimSuffix(text, "\n")
+	return ev
+}
+
+// gapEvent tells a client that n frames for it were dropped because it fell
+// behind.
+func gapEvent(n int) Event {
+	ev := newEvent(frameGap)
+	ev.Skipped = n
+	return ev
+}
+
+func systemEvent(text string) Event  { return textEvent(frameSystem, text) }
+func warningEvent(text string) Event { return textEvent(frameWarning, text) }
+func errorEvent(text string) Event   { return textEvent(frameError, text) }
+func ackEvent(text string) Event     { return textEvent(frameAck, text) }
+
+// refEvent tags ev as the answer to the client frame with the given ref.
+func refEvent(ev Event, ref string) Event {
+	ev.Ref = ref
+	return ev
+}
+
+// Text renders the event in the plain-text protocol.
+func (e Event) Text() string {
+	var text string
+
+	switch e.Type {
+	case frameMessage, frameEdit, frameDelete:
+		return formatMessage(*e.Message)
+	case frameDM:
+		return fmt.Sprintf("[From %s]: %s\n", e.Message.From, e.Message.Content)
+	case frameQueuedDM:
+		return fmt.Sprintf("[From %s, sent %s]: %s\n", e.Message.From, e.Message.Timestamp.Format("2006-01-02 15:04"), e.Message.Content)
+	case frameHistoryBatch:
+		text = e.Content + "\n"
+		if e.Skipped > 0 {
+			text += fmt.Sprintf(" ... %d more messages were skipped ...\n", e.Skipped)
+		}
+		for _, msg := range e.Messages {
+			text += " " + formatMessage(msg)
+		}
+		return text
+	case frameWarning, framePresence:
+		return fmt.Sprintf("*** %s ***\n", e.Content)
+	case frameShutdown:
+		if e.Token == "" {
+			return fmt.Sprintf("*** %s ***\n", e.Content)
+		}
+		return fmt.Sprintf("*** %s. Reconnect with reconnect:%s:%s ***\n", e.Content, e.User, e.Token)
+	case frameGap:
+		return fmt.Sprintf("*** You fell behind: %d messages were dropped (use /history to catch up) ***\n", e.Skipped)
+	case frameSearchResults:
+		text = e.Content + "\n"
+		for _, msg := range e.Messages {
+			text += fmt.Sprintf(" #%d %s %s", msg.ID, msg.Timestamp.Format("2006-01-02 15:04"), formatMessage(msg))
+		}
+		if e.Skipped > 0 {
+			text += fmt.Sprintf(" ... and %d older matches ...\n", e.Skipped)
+		}
+		return text
+	case frameUserList:
+		text = "Users online:\n"
+		for _, user := range e.Users {
+			status := ""
+			switch {
+			case user.Presence != PresenceOnline && user.Status != "":
+				status = fmt.Sprintf(" (%s: %s)", user.Presence, user.Status)
+			case user.Presence != PresenceOnline:
+				status = fmt.Sprintf(" (%s)", user.Presence)
+			case user.Idle:
+				status = " (idle)"
+			}
+			if user.Remote {
+				status += fmt.Sprintf(" (node %d)", user.Node)
+			}
+			if user.Queued > 0 || user.Dropped > 0 {
+				status += fmt.Sprintf(" (lagging: %d queued, %dms behind, %d dropped)", user.Queued, user.LagMs, user.Dropped)
+			}
+			text += fmt.Sprintf("  - %s%s\n", user.Username, status)
+		}
+		text += "\n" + e.Content
+	default:
+		text = e.Content
+	}
+
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return text
+}
+
+// writeFrame writes ev to w in the client's protocol.
+func writeFrame(w io.Writer, ev Event, jsonMode bool) error {
+	if !jsonMode {
+		_, err := io.WriteString(w, ev.Text())
+		return err
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func (c *Client) sendSystem(text string) { c.send(systemEvent(text)) }
+func (c *Client) sendError(text string)  { c.send(errorEvent(text)) }
+func (c *Client) sendAck(text string)    { c.send(ackEvent(text)) }
@@ -0,0 +1,207 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/raft"
+)
+
+// Raft replication
+//
+// With Raft enabled the message log lives in a Raft log replicated across
+// the nodes instead of the local WAL. Messages are proposed to the leader
+// (followers forward them) and only stored, delivered and acknowledged once
+// a majority has committed them. Every node applies committed messages in
+// log order, so IDs are assigned the same way everywhere. Raft snapshots
+// hold the same windows-and-channels document as snapshot.json; a node that
+// catches up from one only has the history from that point on.
+
+// raftSnapshotThreshold is how many messages the Raft log keeps before it
+// is compacted into a snapshot.
+const raftSnapshotThreshold = 1000
+
+// proposal is a message waiting to be proposed to the Raft log. done, if
+// set, receives the result; otherwise failures are only logged.
+type proposal struct {
+	msg  Message
+	done chan error
+}
+
+// proposalQueue holds proposals in the order they were made. The hub adds
+// to it without blocking, since committing a message needs the hub to apply
+// it.
+type proposalQueue struct {
+	mu      sync.Mutex
+	pending []proposal
+	ready   chan struct{} // signalled when pending becomes non-empty
+}
+
+// committedMessage is a message the Raft log has committed, waiting to be
+// applied by the hub. done is closed once it has been.
+type committedMessage struct {
+	msg  Message
+	done chan struct{}
+}
+
+// replicatedLog adapts the ChatRoom to raft.StateMachine.
+type replicatedLog struct{ cr *ChatRoom }
+
+func (l replicatedLog) Apply(data []byte) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		fmt.Printf("Skipping bad log entry: %v\n", err)
+		return
+	}
+
+	done := make(chan struct{})
+	l.cr.committed <- committedMessage{msg: msg, done: done}
+	<-done
+}
+
+func (l replicatedLog) Snapshot() ([]byte, error) {
+	data, _, err := l.cr.encodeSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	// The snapshot only holds the windows, so the rest must be on disk before
+	// the log entries are compacted away
+	if err := l.cr.history.Sync(); err != nil {
+		return nil, err
+	}
+	return data, l.cr.saveSearchIndex()
+}
+
+func (l replicatedLog) Restore(data []byte) error {
+	return l.cr.restoreSnapshot(data)
+}
+
+// joinRaft replicates the message log with the Raft nodes in peers (node ID
+// to Raft address, including this node), answering peers on listener. It
+// must be called before Run.
+func (cr *ChatRoom) joinRaft(nodeID int, listener net.Listener, peers map[int]string) error {
+	ids := make([]int, 0, len(peers))
+	for id := range peers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	node, err := cr.startRaft(nodeID, ids, raft.NewTCPTransport(peers))
+	if err != nil {
+		return err
+	}
+	go raft.Serve(listener, node)
+
+	fmt.Printf("Raft node %d listening on %s\n", nodeID, listener.Addr())
+	return nil
+}
+
+// startRaft starts this node's Raft member. The replicated log replaces
+// whatever was loaded from the local snapshot and WAL.
+func (cr *ChatRoom) startRaft(nodeID int, peers []int, transport raft.Transport) (*raft.Node, error) {
+	storage, err := raft.OpenStorage(filepath.Join(cr.dataDir, "raft"))
+	if err != nil {
+		return nil, fmt.Errorf("open raft storage: %w", err)
+	}
+
+	cr.messageMu.Lock()
+	cr.windows = make(map[string]*messageRing)
+	cr.lastFromNode = make(map[int]int)
+	cr.nextMessageID = 0
+	cr.messageMu.Unlock()
+	cr.channelsMu.Lock()
+	cr.channels = map[string]*Channel{defaultChannel: newChannel(defaultChannel)}
+	cr.channelsMu.Unlock()
+
+	node, err := raft.NewNode(raft.Config{
+		ID:                nodeID,
+		Peers:             peers,
+		Transport:         transport,
+		Storage:           storage,
+		StateMachine:      replicatedLog{cr},
+		SnapshotThreshold: raftSnapshotThreshold,
+	})
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+
+	cr.raft = node
+	cr.raftStorage = storage
+	cr.proposals = &proposalQueue{ready: make(chan struct{}, 1)}
+	go cr.runProposals()
+	return node, nil
+}
+
+// replicate proposes msg to the Raft log and returns once a majority has
+// committed it. The message is delivered as each node applies it.
+func (cr *ChatRoom) replicate(msg Message) error {
+	if msg.Channel == "" {
+		msg.Channel = defaultChannel
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return cr.raft.Propose(data)
+}
+
+// propose queues msg to be replicated after every message proposed before
+// it. Proposals that reach the leader concurrently could be committed in
+// any order, so they are made one at a time.
+func (cr *ChatRoom) propose(msg Message, done chan error) {
+	q := cr.proposals
+	q.mu.Lock()
+	q.pending = append(q.pending, proposal{msg: msg, done: done})
+	q.mu.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// runProposals replicates queued messages in order.
+func (cr *ChatRoom) runProposals() {
+	q := cr.proposals
+	for range q.ready {
+		for {
+			q.mu.Lock()
+			if len(q.pending) == 0 {
+				q.mu.Unlock()
+				break
+			}
+			p := q.pending[0]
+			q.pending = q.pending[1:]
+			q.mu.Unlock()
+
+			err := cr.replicate(p.msg)
+			if p.done != nil {
+				p.done <- err
+			} else if err != nil {
+				fmt.Printf("Failed to replicate message: %v\n", err)
+			}
+		}
+	}
+}
+
+// publish sends a message from a client to its channel. With Raft it waits
+// for the message to be committed and reports whether it was.
+func (cr *ChatRoom) publish(msg Message) error {
+	if cr.raft != nil {
+		done := make(chan error, 1)
+		cr.propose(msg, done)
+		return <-done
+	}
+	cr.broadcast <- msg
+	return nil
+}
@@ -0,0 +1,102 @@
+package chatroom
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Caesarsage/chatroom/internal/raft"
+)
+
+func TestRaftReplication(t *testing.T) {
+	network := raft.NewMemoryNetwork()
+	peers := []int{1, 2, 3}
+
+	nodes := make([]*ChatRoom, len(peers))
+	for i, id := range peers {
+		cr, err := NewChatRoom(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, err := cr.startRaft(id, peers, network.Transport(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cr.shutdown)
+
+		network.Register(id, node)
+		go cr.Run()
+		nodes[i] = cr
+	}
+
+	// Write through a follower, so the message is forwarded to the leader
+	var follower *ChatRoom
+	waitFor(t, "a leader", func() bool {
+		for _, cr := range nodes {
+			if status := cr.raft.Status(); status.Role == "follower" && status.Leader != -1 {
+				follower = cr
+				return true
+			}
+		}
+		return false
+	})
+
+	conn, reader := connectPipe(t, follower)
+	conn.Write([]byte(`{"type":"hello","username":"alice"}` + "\n"))
+	expectLine(t, reader, "Welcome, alice!", "alice")
+
+	conn.Write([]byte(`{"type":"message","ref":"m1","content":"replicated hello"}` + "\n"))
+	// The follower may apply the message before its proposal returns, so the
+	// ack and the message can arrive in either order
+	for acked, delivered := false, false; !acked || !delivered; {
+		line := expectLine(t, reader, "", "alice")
+		acked = acked || strings.Contains(line, `"ref":"m1"`)
+		delivered = delivered || strings.Contains(line, "replicated hello")
+	}
+
+	// Every node applies the same messages with the same IDs
+	storedMessages := func(cr *ChatRoom) string {
+		cr.messageMu.Lock()
+		defer cr.messageMu.Unlock()
+		var stored []string
+		for _, msg := range cr.windowMessagesLocked() {
+			stored = append(stored, fmt.Sprintf("%d:%s", msg.ID, msg.Content))
+		}
+		return fmt.Sprint(stored)
+	}
+	waitFor(t, "every node to apply the message", func() bool {
+		want := storedMessages(nodes[0])
+		for _, cr := range nodes[1:] {
+			if storedMessages(cr) != want {
+				return false
+			}
+		}
+		return want != "[]"
+	})
+
+	// Messages from the hub are committed in the order they were sent, even
+	// though they are forwarded to the leader
+	for i := range 20 {
+		follower.broadcast <- Message{From: "system", Content: fmt.Sprintf("burst %02d", i)}
+	}
+	waitFor(t, "the burst to be applied", func() bool {
+		return strings.Count(storedMessages(nodes[0]), "burst") == 20
+	})
+	var order []string
+	for _, msg := range nodes[0].windowMessages() {
+		if strings.HasPrefix(msg.Content, "burst") {
+			order = append(order, msg.Content)
+		}
+	}
+	for i, content := range order {
+		if want := fmt.Sprintf("burst %02d", i); content != want {
+			t.Fatalf("message %d is %q, want %q: %v", i, content, want, order)
+		}
+	}
+
+	// A node cut off from the majority can't get a message committed
+	network.Disconnect(1)
+	if err := nodes[0].replicate(Message{From: "bob", Content: "lost"}); err == nil {
+		t.Fatal("message was committed without a majority")
+	}
+}
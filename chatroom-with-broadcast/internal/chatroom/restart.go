@@ -0,0 +1,162 @@
+package chatroom
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+)
+
+// Zero-downtime restarts
+//
+// On the restart signal (SIGUSR2, see restart_unix.go) the server keeps
+// copies of its chat and HTTP listening sockets and shuts down as usual:
+// clients get a shutdown frame with their reconnect token, queues are
+// drained and the final snapshot is taken. It then starts its own
+// executable again with the same arguments, passing the sockets as extra
+// files and naming them in CHATROOM_LISTENERS. The new process loads the
+// snapshot, WAL and sessions and accepts on the inherited sockets, so
+// connections made during the restart wait in the socket's backlog instead
+// of being refused, and clients reconnecting with their token are replayed
+// what they missed.
+
+// listenersEnv names the listening sockets a restarted server inherits, in
+// the order of their file descriptors from 3 on.
+const listenersEnv = envPrefix + "LISTENERS"
+
+// restarter opens the server's listeners, taking them over from the previous
+// process if there was one, and hands them to the next on a restart.
+type restarter struct {
+	inherited map[string]*os.File
+
+	mu        sync.Mutex
+	names     []string
+	listeners []net.Listener
+	handover  []*os.File // copies of the listeners, once a restart is requested
+}
+
+func newRestarter() *restarter {
+	rs := &restarter{inherited: make(map[string]*os.File)}
+
+	names := os.Getenv(listenersEnv)
+	os.Unsetenv(listenersEnv) // Not for the processes the server starts
+	if names != "" {
+		for i, name := range strings.Split(names, ",") {
+			rs.inherited[name] = os.NewFile(uintptr(3+i), name)
+		}
+	}
+	return rs
+}
+
+// listen opens the TCP listener called name on addr, or takes it over from
+// the previous process.
+func (rs *restarter) listen(name, addr string) (net.Listener, error) {
+	var listener net.Listener
+	var err error
+	if file := rs.inherited[name]; file != nil {
+		delete(rs.inherited, name)
+		listener, err = net.FileListener(file)
+		file.Close()
+		if err == nil {
+			fmt.Printf("Took over the %s listener on %s from the previous process\n", name, listener.Addr())
+		}
+	} else {
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.names = append(rs.names, name)
+	rs.listeners = append(rs.listeners, listener)
+	return listener, nil
+}
+
+// watch waits for the restart signal, then copies the listeners for the next
+// process and calls shutdown. It gives up when ctx is done.
+func (rs *restarter) watch(ctx context.Context, shutdown context.CancelFunc) {
+	if len(restartSignals) == 0 {
+		return
+	}
+	restart := make(chan os.Signal, 1)
+	signal.Notify(restart, restartSignals...)
+	defer signal.Stop(restart)
+
+	for {
+		select {
+		case <-restart:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := rs.prepare(); err != nil {
+			fmt.Printf("Restart failed, carrying on: %v\n", err)
+			continue
+		}
+		fmt.Println("Restarting...")
+		shutdown()
+		return
+	}
+}
+
+// prepare copies the listeners, which then stay open in the kernel while the
+// server shuts down.
+func (rs *restarter) prepare() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var files []*os.File
+	for _, listener := range rs.listeners {
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("can't hand over a %T", listener)
+		}
+		file, err := tcp.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return err
+		}
+		files = append(files, file)
+	}
+	rs.handover = files
+	return nil
+}
+
+// handOff starts the next process with the listeners, if a restart was
+// requested. It is called once the server has shut down.
+func (rs *restarter) handOff() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.handover == nil {
+		return
+	}
+	defer func() {
+		for _, file := range rs.handover {
+			file.Close()
+		}
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Printf("Failed to start the new server: %v\n", err)
+		return
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenersEnv+"="+strings.Join(rs.names, ","))
+	cmd.ExtraFiles = rs.handover
+	if err := cmd.Start(); err != nil {
+		fmt.Printf("Failed to start the new server: %v\n", err)
+		return
+	}
+	fmt.Printf("Handed the listeners to process %d\n", cmd.Process.Pid)
+	cmd.Process.Release()
+}
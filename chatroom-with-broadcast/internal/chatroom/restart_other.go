@@ -0,0 +1,8 @@
+//go:build !unix
+
+package chatroom
+
+import "os"
+
+// restartSignals is empty: listeners can only be handed over on Unix.
+var restartSignals []os.Signal
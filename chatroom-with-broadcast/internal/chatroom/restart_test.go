@@ -0,0 +1,303 @@
+//go:build linux
+
+package chatroom
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRestartServer is the server TestRestart runs and restarts; it only
+// runs in the subprocess.
+func TestRestartServer(t *testing.T) {
+	if os.Getenv("CHATROOM_RESTART_TEST") == "" {
+		t.Skip("only run by TestRestart")
+	}
+	slowClientDelay = 1
+	cfg, err := LoadServerConfig(nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	StartServerWithConfig(cfg)
+	os.Exit(0)
+}
+
+// restartClient is a JSON client that follows the server through restarts.
+type restartClient struct {
+	addr, name string
+	conn       net.Conn
+	reader     *bufio.Reader
+}
+
+// connect logs in, resuming the session if token is set.
+func (c *restartClient) connect(token string) error {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+	if _, err := c.reader.ReadString('\n'); err != nil {
+		return fmt.Errorf("reading prompt: %w", err)
+	}
+	hello, _ := json.Marshal(clientFrame{Type: frameHello, Username: c.name, Token: token})
+	conn.Write(append(hello, '\n'))
+	for {
+		ev, err := c.next()
+		if err != nil {
+			return err
+		}
+		switch {
+		case ev.Type == frameError:
+			return errors.New(ev.Content)
+		case ev.Type == frameSystem && strings.HasPrefix(ev.Content, "Welcome,"):
+			return nil
+		}
+	}
+}
+
+func (c *restartClient) next() (Event, error) {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := c.reader.ReadBytes('\n')
+	if err != nil {
+		return Event{}, err
+	}
+	var ev Event
+	err = json.Unmarshal(line, &ev)
+	return ev, err
+}
+
+// freeAddr returns a local address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// TestRestart restarts a server while alice sends messages as fast as they
+// are acknowledged and bob receives them. Connections must never be refused,
+// and bob must get every message alice sent.
+func TestRestart(t *testing.T) {
+	addr, httpAddr := freeAddr(t), freeAddr(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestartServer$")
+	cmd.Env = append(os.Environ(),
+		"CHATROOM_RESTART_TEST=1",
+		"CHATROOM_ADDR="+addr,
+		"CHATROOM_HTTP="+httpAddr,
+		"CHATROOM_DATA="+t.TempDir(),
+		"CHATROOM_MESSAGE_LIMIT=off",
+		"CHATROOM_CONNECT_LIMIT=off",
+		"CHATROOM_SHUTDOWN_TIMEOUT=5s",
+	)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both servers write to the pipe, which ends when the second one exits
+	var output strings.Builder
+	lines := make(chan string, 1000)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			output.WriteString(scanner.Text() + "\n")
+			select {
+			case lines <- scanner.Text():
+			default:
+			}
+		}
+	}()
+	waitForOutput := func(prefix string) string {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case line := <-lines:
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			case <-timeout:
+				t.Fatalf("the server never printed %q", prefix)
+			}
+		}
+	}
+
+	pid := cmd.Process.Pid
+	t.Cleanup(func() {
+		syscall.Kill(pid, syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(10 * time.Second):
+			syscall.Kill(pid, syscall.SIGKILL)
+			<-exited
+			t.Error("the server didn't shut down")
+		}
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("server output:\n%s", output.String())
+		}
+	})
+	waitForOutput("Server started on")
+
+	var mu sync.Mutex
+	received := make(map[string]bool)
+	record := func(msg Message) {
+		if msg.From == "alice" {
+			mu.Lock()
+			received[msg.Content] = true
+			mu.Unlock()
+		}
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received)
+	}
+
+	bob := &restartClient{addr: addr, name: "bob"}
+	if err := bob.connect(""); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	bobDone := make(chan struct{})
+	go func() {
+		defer close(bobDone)
+		for {
+			ev, err := bob.next()
+			if err != nil {
+				select {
+				case <-stop:
+				default:
+					t.Errorf("bob: %v", err)
+				}
+				return
+			}
+			switch ev.Type {
+			case frameMessage:
+				record(*ev.Message)
+			case frameHistoryBatch:
+				for _, msg := range ev.Messages {
+					record(msg)
+				}
+			case frameShutdown:
+				bob.conn.Close()
+				if err := bob.connect(ev.Token); err != nil {
+					t.Errorf("bob couldn't reconnect: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	alice := &restartClient{addr: addr, name: "alice"}
+	if err := alice.connect(""); err != nil {
+		t.Fatal(err)
+	}
+	sent := make(chan int, 1)
+	go func() {
+		defer alice.conn.Close()
+		n := 0
+		defer func() { sent <- n }()
+		for ; ; n++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			// Send each message until it is acknowledged, reconnecting if
+			// the server goes away first
+			ref := strconv.Itoa(n)
+			line, _ := json.Marshal(clientFrame{Type: frameMessage, Ref: ref, Content: "load " + ref})
+			for acked := false; !acked; {
+				alice.conn.Write(append(line, '\n'))
+				for waiting := true; waiting; {
+					ev, err := alice.next()
+					if err != nil {
+						t.Errorf("alice: %v", err)
+						return
+					}
+					switch {
+					case ev.Type == frameAck && ev.Ref == ref:
+						acked, waiting = true, false
+					case ev.Type == frameError && ev.Ref == ref:
+						t.Errorf("alice's message %s failed: %s", ref, ev.Content)
+						return
+					case ev.Type == frameShutdown:
+						alice.conn.Close()
+						if err := alice.connect(ev.Token); err != nil {
+							t.Errorf("alice couldn't reconnect: %v", err)
+							return
+						}
+						waiting = false
+					}
+				}
+			}
+		}
+	}()
+
+	// New connections keep being accepted, if late, on both listeners
+	dialerDone := make(chan struct{})
+	go func() {
+		defer close(dialerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			for _, addr := range []string{addr, httpAddr} {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Errorf("a connection was refused: %v", err)
+					return
+				}
+				conn.Close()
+			}
+		}
+	}()
+
+	waitFor(t, "load before the restart", func() bool { return count() >= 100 })
+	syscall.Kill(pid, syscall.SIGUSR2)
+	line := waitForOutput("Handed the listeners to process ")
+	next, err := strconv.Atoi(strings.TrimPrefix(line, "Handed the listeners to process "))
+	if err != nil || next == pid {
+		t.Fatalf("unexpected handoff: %q", line)
+	}
+	pid = next
+	waitForOutput("Took over the chat listener")
+	before := count()
+	waitFor(t, "load after the restart", func() bool { return count() >= before+100 })
+
+	close(stop)
+	n := <-sent
+	<-dialerDone
+	waitFor(t, "bob to receive everything", func() bool { return count() >= n })
+	bob.conn.Close()
+	<-bobDone
+
+	for i := range n {
+		if !received["load "+strconv.Itoa(i)] {
+			t.Errorf("bob never received message %d of %d", i, n)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build unix
+
+package chatroom
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals make the server hand its listeners to a new process.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
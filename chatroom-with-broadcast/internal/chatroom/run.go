@@ -1,24 +1,66 @@
 package chatroom
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"time"
+
+	"github.com/Caesarsage/chatroom/internal/ratelimit"
 )
 
 func NewChatRoom(dataDir string) (*ChatRoom, error) {
+	cfg := DefaultServerConfig()
+	cfg.DataDir = dataDir
+	return newChatRoom(cfg)
+}
+
+// newChatRoom opens the room in cfg.DataDir. The settings that are read
+// while loading, such as the session TTL, are taken from cfg; the rest
+// take effect with applyConfig.
+func newChatRoom(cfg ServerConfig) (*ChatRoom, error) {
 	cr := &ChatRoom{
 		clients:       make(map[*Client]bool),
 		join:          make(chan *Client),
 		leave:         make(chan *Client),
-		broadcast:     make(chan string),
+		broadcast:     make(chan Message),
 		listUsers:     make(chan *Client),
 		directMessage: make(chan DirectMessage),
+		channels:      map[string]*Channel{defaultChannel: newChannel(defaultChannel)},
 		sessions:      make(map[string]*SessionInfo),
-		messages:      make([]Message, 0),
+		accounts:      make(map[string]*Account),
+		remoteUsers:   make(map[string]int),
+		peerFrames:    make(chan peerFrame),
+		committed:     make(chan committedMessage),
+		windows:       make(map[string]*messageRing),
+		amendments:    make(map[int]Message),
+		historyWindow: defaultHistoryWindow,
+		lastFromNode:  make(map[int]int),
+		userLimits:    make(map[string]*userLimits),
+		moderation:    newModerationState(),
+		offline:       make(map[string][]Event),
+		offlineLimit:  defaultOfflineLimit,
+		connects:      ratelimit.NewKeyed(ratelimit.Limit{}),
+		awayAfter:     defaultAwayAfter,
+		config:        cfg,
+		checkpointID:  -1,
 		startTime:     time.Now(),
-		dataDir:       dataDir,
+		dataDir:       cfg.DataDir,
+	}
+
+	cr.metrics = newChatMetrics(cr)
+
+	if err := cr.openHistory(); err != nil {
+		return nil, err
 	}
+	cr.loadSearchIndex()
+
+	// Spill files only mean something to the clients that wrote them
+	os.RemoveAll(cr.spillDir())
+	cr.setSlowConsumerPolicy(DropOldest, defaultMaxDrops, defaultBlockTimeout)
 
 	if err := cr.loadSnapshot(); err != nil {
 		fmt.Printf("Failed to load snapsjot: %v\n", err)
@@ -28,20 +70,49 @@ func NewChatRoom(dataDir string) (*ChatRoom, error) {
 		return nil, err
 	}
 
+	if err := cr.loadSessions(); err != nil {
+		fmt.Printf("Failed to load sessions: %v\n", err)
+	}
+
+	if err := cr.loadAccounts(); err != nil {
+		fmt.Printf("Failed to load accounts: %v\n", err)
+	}
+
+	if err := cr.loadModeration(); err != nil {
+		fmt.Printf("Failed to load moderation state: %v\n", err)
+	}
+
+	if err := cr.loadOffline(); err != nil {
+		fmt.Printf("Failed to load offline queues: %v\n", err)
+	}
+
 	go cr.periodicSnapshots()
 	return cr, nil
 }
 
+// defaultSnapshotInterval is how often periodic snapshots are taken.
+const defaultSnapshotInterval = 5 * time.Minute
+
 func (cr *ChatRoom) periodicSnapshots() {
-	ticker := time.NewTicker(5 * time.Minute)
+	interval := cr.settings().SnapshotInterval
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
+		cfg := cr.settings()
+		if cfg.SnapshotInterval != interval {
+			interval = cfg.SnapshotInterval
+			ticker.Reset(interval)
+		}
+		if cr.raft != nil {
+			continue // The Raft log takes its own snapshots
+		}
+
 		cr.messageMu.Lock()
-		messageCount := len(cr.messages)
+		newMessages := cr.nextMessageID-1-cr.checkpointID >= cfg.SnapshotAfter
 		cr.messageMu.Unlock()
 
-		if messageCount > 100 {
+		if newMessages {
 			if err := cr.createSnapshot(); err != nil {
 				fmt.Printf("Snapshot failed: %v\n", err)
 			}
@@ -52,6 +123,8 @@ func (cr *ChatRoom) periodicSnapshots() {
 func (cr *ChatRoom) Run() {
 	fmt.Println("ChatRoom heart beating...")
 	go cr.cleanupInactiveClients()
+	go cr.expireSessions()
+	go cr.autoAway()
 
 	for {
 		select {
@@ -59,39 +132,112 @@ func (cr *ChatRoom) Run() {
 			cr.handleJoin(client)
 		case client := <-cr.leave:
 			cr.handleLeave(client)
-		case message := <-cr.broadcast:
-			cr.handleBroadcast(message)
+		case msg := <-cr.broadcast:
+			cr.handleBroadcast(msg)
 		case client := <-cr.listUsers:
 			cr.sendUserList(client)
 		case dm := <-cr.directMessage:
 			cr.handleDirectMessage(dm)
+		case frame := <-cr.peerFrames:
+			cr.handlePeerFrame(frame)
+		case commit := <-cr.committed:
+			cr.applyCommitted(commit.msg)
+			close(commit.done)
 		}
 	}
 }
 
-func runServer() {
-	chatRoom, err := NewChatRoom("./chatdata")
+func runServer(ctx context.Context, cfg ServerConfig) {
+	// A restart starts the next process once everything below is shut down
+	restarts := newRestarter()
+	defer restarts.handOff()
+	ctx, shutdown := context.WithCancel(ctx)
+	defer shutdown()
+	go restarts.watch(ctx, shutdown)
+
+	chatRoom, err := newChatRoom(cfg)
 	if err != nil {
 		fmt.Printf("Failed to initialize: %v\n", err)
 	}
 	defer chatRoom.shutdown()
+	chatRoom.requireAuth = cfg.RequireAuth
+	chatRoom.applyConfig(cfg)
+	go chatRoom.reloadOnHangup()
+
+	tlsConfig, err := serverTLSConfig(cfg)
+	if err != nil {
+		fmt.Println("Error configuring TLS:", err)
+		return
+	}
+
+	if cfg.PeerAddr != "" {
+		peerListener, err := net.Listen("tcp", cfg.PeerAddr)
+		if err != nil {
+			fmt.Println("Error starting peer listener:", err)
+			return
+		}
+		defer peerListener.Close()
+		if err := chatRoom.joinCluster(cfg.NodeID, peerListener, cfg.Peers, cfg.ClusterSecret, tlsConfig); err != nil {
+			fmt.Println("Error joining cluster:", err)
+			return
+		}
+	}
+
+	if cfg.RaftAddr != "" {
+		raftListener, err := net.Listen("tcp", cfg.RaftAddr)
+		if err != nil {
+			fmt.Println("Error starting Raft listener:", err)
+			return
+		}
+		defer raftListener.Close()
+		if err := chatRoom.joinRaft(cfg.NodeID, raftListener, cfg.RaftPeers); err != nil {
+			fmt.Println("Error joining Raft cluster:", err)
+			return
+		}
+	}
+
 	go chatRoom.Run()
+	if httpListener, err := restarts.listen("http", cfg.HTTPAddr); err != nil {
+		fmt.Println("Error starting HTTP server:", err)
+	} else {
+		go serveHTTP(ctx, httpListener, chatRoom, tlsConfig)
+	}
 
-	listener, err := net.Listen("tcp", ":9000")
+	listener, err := restarts.listen("chat", cfg.ListenAddr)
 	if err != nil {
 		fmt.Println("Error starting server:", err)
 		return
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	defer listener.Close()
 
-	fmt.Println("Server started on :9000")
+	if tlsConfig != nil {
+		fmt.Println("Server started on", cfg.ListenAddr, "(TLS)")
+	} else {
+		fmt.Println("Server started on", cfg.ListenAddr)
+	}
+
+	serveUntil(ctx, listener, chatRoom)
+}
 
+// serve accepts chat connections on listener until it is closed.
+func serve(listener net.Listener, chatRoom *ChatRoom) {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			fmt.Println(" Error accepting connection:", err)
 			continue
 		}
+		if !chatRoom.allowConnect(conn.RemoteAddr().String()) {
+			fmt.Fprintln(conn, "Too many connections from your address, try again later")
+			conn.Close()
+			continue
+		}
 		fmt.Println("New connection from:", conn.RemoteAddr())
 		go handleClient(conn, chatRoom)
 	}
@@ -99,11 +245,20 @@ func runServer() {
 
 func (cr *ChatRoom) shutdown() {
 	fmt.Println("\n Shutting down...")
-	if err := cr.createSnapshot(); err != nil {
+	if cr.raft != nil {
+		cr.raft.Stop()
+		cr.raftStorage.Close()
+		if err := cr.saveSearchIndex(); err != nil {
+			fmt.Printf(" Failed to save the search index: %v\n", err)
+		}
+	} else if err := cr.createSnapshot(); err != nil {
 		fmt.Printf(" Final snapshot failed: %v\n", err)
 	}
-	if cr.walFile != nil {
-		cr.walFile.Close()
+	if cr.wal != nil {
+		cr.wal.Close()
+	}
+	if err := cr.history.Close(); err != nil {
+		fmt.Printf(" Failed to close the history log: %v\n", err)
 	}
 	fmt.Println("Shutdown complete")
 }
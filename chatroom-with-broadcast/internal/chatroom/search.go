@@ -0,0 +1,118 @@
+package chatroom
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Caesarsage/chatroom/internal/search"
+)
+
+// Search
+//
+// Chat messages are indexed for /search as they are stored (see
+// internal/search). The index is saved to search.idx at every checkpoint,
+// before the WAL segments it covers are removed, so after a restart only the
+// messages replayed from the WAL are indexed again. Without a usable
+// search.idx the index is rebuilt from the history log.
+
+// searchLimit is how many matches /search shows.
+const searchLimit = 20
+
+func (cr *ChatRoom) searchIndexPath() string {
+	return filepath.Join(cr.dataDir, "search.idx")
+}
+
+// loadSearchIndex loads the saved search index, or rebuilds it from the
+// history log.
+func (cr *ChatRoom) loadSearchIndex() {
+	index, err := search.Load(cr.searchIndexPath())
+	if err == nil {
+		cr.searchIndex = index
+		fmt.Printf("Loaded search index (%d messages)\n", index.Len())
+		return
+	}
+	if !os.IsNotExist(err) {
+		fmt.Printf("Rebuilding search index: %v\n", err)
+	}
+
+	cr.searchIndex = search.New()
+	for _, channel := range cr.history.Channels() {
+		after := -1
+		for {
+			page := cr.readHistory(cr.history.After(channel, after, catchUpPageSize))
+			for _, msg := range page {
+				if isAmendment(msg) {
+					cr.messageMu.Lock()
+					cr.amendLocked(msg)
+					cr.messageMu.Unlock()
+					continue
+				}
+				cr.indexMessage(msg)
+			}
+			if len(page) < catchUpPageSize {
+				break
+			}
+			after = page[len(page)-1].ID
+		}
+	}
+	fmt.Printf("Indexed %d messages for search\n", cr.searchIndex.Len())
+}
+
+// saveSearchIndex writes the search index to disk.
+func (cr *ChatRoom) saveSearchIndex() error {
+	return cr.searchIndex.Save(cr.searchIndexPath())
+}
+
+// indexMessage adds a chat message to the search index. Notices, channel
+// events and deleted messages are not searchable, topics are; edits replace
+// the text of the message they change (see amendLocked).
+func (cr *ChatRoom) indexMessage(msg Message) {
+	if msg.From == "system" || msg.Kind == kindJoin || msg.Kind == kindPart || isAmendment(msg) || msg.Deleted {
+		return
+	}
+	cr.searchIndex.Add(msg.ID, search.Doc{
+		Channel: msg.Channel,
+		From:    msg.From,
+		Time:    msg.Timestamp,
+	}, msg.Content)
+}
+
+// handleSearchCommand handles "/search <terms> [from:user] [in:#channel]
+// [before:date] [after:date]" over the channels the client belongs to.
+func (cr *ChatRoom) handleSearchCommand(client *Client, args []string) {
+	usage := "Usage: /search <terms> [from:user] [in:#channel] [before:YYYY-MM-DD] [after:YYYY-MM-DD]"
+	if len(args) < 2 {
+		client.sendError(usage)
+		return
+	}
+
+	query, err := search.ParseQuery(strings.Join(args[1:], " "))
+	if err != nil {
+		client.sendError(fmt.Sprintf("%s (%v)", usage, err))
+		return
+	}
+
+	hits, total := cr.searchIndex.Search(query, func(channel string) bool {
+		return cr.isMember(channel, client.username)
+	}, searchLimit)
+
+	results := newEvent(frameSearchResults)
+	results.Content = fmt.Sprintf("%d messages match %q: ", total, strings.Join(args[1:], " "))
+	for _, hit := range hits {
+		if msg, ok := cr.lookupMessage(hit.Channel, hit.ID); ok {
+			results.Messages = append(results.Messages, msg)
+		}
+	}
+	results.Skipped = total - len(hits)
+
+	client.send(results)
+}
+
+// lookupMessage returns the stored message of channel with the given ID.
+func (cr *ChatRoom) lookupMessage(channel string, id int) (Message, bool) {
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+	return cr.findMessageLocked(channel, id)
+}
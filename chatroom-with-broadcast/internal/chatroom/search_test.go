@@ -0,0 +1,67 @@
+package chatroom
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.setHistoryWindow(2)
+	cr.handleBroadcast(Message{From: "alice", Content: "deploy started"})
+	cr.handleBroadcast(Message{From: "bob", Kind: kindJoin, Channel: "ops"})
+	cr.handleBroadcast(Message{From: "bob", Content: "deploy keys rotated", Channel: "ops"})
+	cr.handleBroadcast(Message{From: "alice", Content: "Deploy done"})
+	cr.handleBroadcast(Message{From: "alice", Content: "lunch?"})
+
+	search := func(cr *ChatRoom, username, query string) string {
+		t.Helper()
+		client := &Client{username: username, outgoing: make(chan Event, 10)}
+		cr.handleSearchCommand(client, strings.Fields("/search "+query))
+		return (<-client.outgoing).Text()
+	}
+	expect := func(results string, want ...string) {
+		t.Helper()
+		for _, w := range want {
+			if !strings.Contains(results, w) {
+				t.Fatalf("results %q don't contain %q", results, w)
+			}
+		}
+	}
+
+	// alice isn't in #ops; "deploy started" has left the window
+	results := search(cr, "alice", "deploy")
+	expect(results, "2 messages match", "[alice]: Deploy done", "[alice]: deploy started")
+	if strings.Contains(results, "keys") || strings.Index(results, "done") > strings.Index(results, "started") {
+		t.Fatalf("unexpected results %q", results)
+	}
+	expect(search(cr, "bob", "deploy"), "3 messages match", "deploy keys rotated")
+	expect(search(cr, "bob", "deploy in:#ops"), "1 messages match")
+	expect(search(cr, "bob", "from:alice"), "nothing to search for")
+
+	// The index is saved at the checkpoint and loaded after a restart, or
+	// rebuilt from the history log if it can't be read
+	cr.shutdown()
+	for _, damage := range []bool{false, true} {
+		if damage {
+			if err := os.WriteFile(filepath.Join(dir, "search.idx"), []byte("garbage"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		restarted, err := NewChatRoom(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := restarted.searchIndex.Len(); n != 4 {
+			t.Fatalf("%d messages indexed after restart, want 4", n)
+		}
+		expect(search(restarted, "bob", "deploy from:alice"), "2 messages match")
+		restarted.shutdown()
+	}
+}
@@ -1,10 +1,29 @@
 package chatroom
 
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
 // This file was split into multiple files (persistence.go, run.go, handlers.go,
 // session.go, io.go). The old monolithic implementation was left here for a
 // short transitional period. Keep a small wrapper for compatibility.
 
-// StartServer starts the chat server (implemented in run.go).
+// StartServer starts the chat server with the default settings (implemented
+// in run.go).
 func StartServer() {
-	runServer()
+	StartServerWithConfig(DefaultServerConfig())
+}
+
+// StartServerWithConfig starts the chat server with cfg. It returns after
+// SIGINT or SIGTERM, once the clients are drained and the final snapshot is
+// taken; a second signal stops the server straight away.
+func StartServerWithConfig(cfg ServerConfig) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	context.AfterFunc(ctx, stop)
+
+	runServer(ctx, cfg)
 }
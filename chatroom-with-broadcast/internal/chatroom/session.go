@@ -1,12 +1,20 @@
 package chatroom
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/Caesarsage/chatroom/pkg/token"
 )
 
+const (
+	defaultSessionTTL = 1 * time.Hour
+	sessionsFile      = "sessions.json"
+)
+
 func (cr *ChatRoom) createSession(username string) *SessionInfo {
 	cr.sessionsMu.Lock()
 	defer cr.sessionsMu.Unlock()
@@ -18,15 +26,34 @@ func (cr *ChatRoom) createSession(username string) *SessionInfo {
 		ReconnectToken: tok,
 		LastSeen:       time.Now(),
 		CreatedAat:     time.Now(),
+		LastMessageID:  cr.lastMessageID(),
 	}
 
 	cr.sessions[username] = session
+	cr.saveSessions()
 
 	fmt.Printf("Created session for %s (token: %s...)\n", username, session.ReconnectToken[:8])
 
 	return session
 }
 
+// renewSession gives username's session a new reconnect token, so the old one
+// stops working, creating the session if there is none.
+func (cr *ChatRoom) renewSession(username string) *SessionInfo {
+	cr.sessionsMu.Lock()
+	session, exists := cr.sessions[username]
+	if !exists {
+		cr.sessionsMu.Unlock()
+		return cr.createSession(username)
+	}
+	defer cr.sessionsMu.Unlock()
+
+	session.ReconnectToken = token.GenerateToken()
+	cr.saveSessions()
+	fmt.Printf("Renewed session for %s (token: %s...)\n", username, session.ReconnectToken[:8])
+	return session
+}
+
 func (cr *ChatRoom) validateReconnectToken(username, token string) bool {
 	cr.sessionsMu.Lock()
 	defer cr.sessionsMu.Unlock()
@@ -40,25 +67,44 @@ func (cr *ChatRoom) validateReconnectToken(username, token string) bool {
 		return false
 	}
 
-	if time.Since(session.LastSeen) > 1*time.Hour {
+	if time.Since(session.LastSeen) > cr.settings().SessionTTL {
 		delete(cr.sessions, username)
+		cr.saveSessions()
 		return false
 	}
 
 	session.LastSeen = time.Now()
+	cr.saveSessions()
 
 	return true
 }
 
-func (cr *ChatRoom) updateSessionActivity(username string) {
+// updateSessionActivity records that username was just seen and has received
+// every message up to lastMessageID.
+func (cr *ChatRoom) updateSessionActivity(username string, lastMessageID int) {
 	cr.sessionsMu.Lock()
 	defer cr.sessionsMu.Unlock()
 
 	if session, exists := cr.sessions[username]; exists {
 		session.LastSeen = time.Now()
+		if lastMessageID > session.LastMessageID {
+			session.LastMessageID = lastMessageID
+		}
+		cr.saveSessions()
 	}
 }
 
+// sessionCursor returns the ID of the last message delivered to username.
+func (cr *ChatRoom) sessionCursor(username string) int {
+	cr.sessionsMu.Lock()
+	defer cr.sessionsMu.Unlock()
+
+	if session, exists := cr.sessions[username]; exists {
+		return session.LastMessageID
+	}
+	return cr.lastMessageID()
+}
+
 func (cr *ChatRoom) isUsernameConnected(username string) bool {
 	cr.mu.Lock()
 	defer cr.mu.Unlock()
@@ -69,7 +115,8 @@ func (cr *ChatRoom) isUsernameConnected(username string) bool {
 		}
 	}
 
-	return false
+	_, remote := cr.remoteUsers[username] // Connected to another node
+	return remote
 }
 
 // cleanupInactiveClients periodically removes sessions that haven't been seen
@@ -79,11 +126,12 @@ func (cr *ChatRoom) cleanupInactiveClients() {
 	defer ticker.Stop()
 
 	for range ticker.C {
+		idleTimeout := cr.settings().IdleTimeout
 		cr.mu.Lock()
 		var toRemove []*Client
 
 		for client := range cr.clients {
-			if client.isInactive(5 * time.Minute) {
+			if idleTimeout > 0 && client.isInactive(idleTimeout) {
 				fmt.Printf(" Removing inactive client: %s\n", client.username)
 				toRemove = append(toRemove, client)
 			}
@@ -97,3 +145,90 @@ func (cr *ChatRoom) cleanupInactiveClients() {
 	}
 }
 
+// loadSessions restores reconnect sessions saved by a previous run, dropping
+// the ones that expired while the server was down.
+func (cr *ChatRoom) loadSessions() error {
+	data, err := os.ReadFile(filepath.Join(cr.dataDir, sessionsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var sessions []*SessionInfo
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return err
+	}
+
+	cr.sessionsMu.Lock()
+	defer cr.sessionsMu.Unlock()
+
+	expired := 0
+	sessionTTL := cr.settings().SessionTTL
+	for _, session := range sessions {
+		if time.Since(session.LastSeen) > sessionTTL {
+			expired++
+			continue
+		}
+		cr.sessions[session.Username] = session
+	}
+
+	fmt.Printf("Loaded %d sessions (%d expired)\n", len(cr.sessions), expired)
+	if expired > 0 {
+		cr.saveSessions()
+	}
+	return nil
+}
+
+// saveSessions atomically rewrites the sessions file. Callers must hold
+// sessionsMu.
+func (cr *ChatRoom) saveSessions() {
+	sessions := make([]*SessionInfo, 0, len(cr.sessions))
+	for _, session := range cr.sessions {
+		sessions = append(sessions, session)
+	}
+
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(cr.dataDir, sessionsFile), data)
+	}
+	if err != nil {
+		fmt.Printf("Failed to save sessions: %v\n", err)
+	}
+}
+
+// expireSessions periodically drops sessions that have not been seen within
+// the session TTL. Sessions of connected users are kept alive.
+func (cr *ChatRoom) expireSessions() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cr.removeExpiredSessions()
+	}
+}
+
+func (cr *ChatRoom) removeExpiredSessions() {
+	cr.sessionsMu.Lock()
+	defer cr.sessionsMu.Unlock()
+
+	var removed []string
+	sessionTTL := cr.settings().SessionTTL
+	for username, session := range cr.sessions {
+		if cr.isUsernameConnected(username) {
+			session.LastSeen = time.Now()
+			continue
+		}
+		if time.Since(session.LastSeen) > sessionTTL {
+			delete(cr.sessions, username)
+			removed = append(removed, username)
+		}
+	}
+
+	if len(removed) > 0 {
+		fmt.Printf("Expired %d sessions\n", len(removed))
+		cr.dropOffline(removed)
+	}
+	cr.saveSessions()
+}
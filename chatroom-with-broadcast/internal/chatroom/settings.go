@@ -0,0 +1,451 @@
+package chatroom
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/ratelimit"
+	"github.com/Caesarsage/chatroom/internal/toml"
+)
+
+// Settings
+//
+// Every setting can come from a TOML config file, an environment variable or
+// a command-line flag, in increasing order of precedence. The flag name is
+// the setting's name; the file key replaces its dashes with underscores, and
+// the environment variable is the file key in upper case prefixed with
+// CHATROOM_, so -history-window is history_window in the file and
+// CHATROOM_HISTORY_WINDOW in the environment. Lists are arrays in the file
+// and comma-separated elsewhere.
+//
+// On SIGHUP the file and the environment are read again and the reloadable
+// settings are put into effect without dropping anyone. The others, such as
+// the listen addresses, only change on restart. Owners can see the settings
+// in effect with /config.
+
+// envPrefix starts the name of every environment variable the server reads.
+const envPrefix = "CHATROOM_"
+
+// setting is one configurable field of ServerConfig.
+type setting struct {
+	name   string
+	usage  string
+	reload bool // put into effect on SIGHUP
+	value  func(cfg *ServerConfig) settingValue
+}
+
+// fileKey is the name of the setting in the config file.
+func (s setting) fileKey() string {
+	return strings.ReplaceAll(s.name, "-", "_")
+}
+
+// envVar is the environment variable that sets the setting.
+func (s setting) envVar() string {
+	return envPrefix + strings.ToUpper(s.fileKey())
+}
+
+var settings = []setting{
+	{"addr", "TCP address for chat clients", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.ListenAddr) }},
+	{"http", "HTTP address for the WebSocket gateway and API", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.HTTPAddr) }},
+	{"ws-origins", "comma-separated web origins, besides the gateway's own, whose pages may use the WebSocket gateway", true, func(cfg *ServerConfig) settingValue { return listSetting(&cfg.WSOrigins) }},
+	{"data", "directory for the WAL, snapshots and sessions", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.DataDir) }},
+	{"history-window", "newest messages of each channel kept in memory", true, func(cfg *ServerConfig) settingValue { return intSetting(&cfg.HistoryWindow, 1) }},
+	{"snapshot-interval", "how often to take a snapshot", true, func(cfg *ServerConfig) settingValue { return durationSetting(&cfg.SnapshotInterval, false) }},
+	{"snapshot-after", "new messages needed before a periodic snapshot is taken", true, func(cfg *ServerConfig) settingValue { return intSetting(&cfg.SnapshotAfter, 1) }},
+	{"idle-timeout", "how long clients can send nothing before being disconnected (0 disables)", true, func(cfg *ServerConfig) settingValue { return durationSetting(&cfg.IdleTimeout, true) }},
+	{"login-timeout", "how long new connections have to answer the username prompt", true, func(cfg *ServerConfig) settingValue { return durationSetting(&cfg.LoginTimeout, false) }},
+	{"session-ttl", "how long reconnect tokens work after they were last used", true, func(cfg *ServerConfig) settingValue { return durationSetting(&cfg.SessionTTL, false) }},
+	{"shutdown-timeout", "how long a shutdown waits for clients to receive their queued messages", true, func(cfg *ServerConfig) settingValue { return durationSetting(&cfg.ShutdownTimeout, false) }},
+	{"queue-size", "frames each client's queue holds in memory (new clients)", true, func(cfg *ServerConfig) settingValue { return intSetting(&cfg.QueueSize, 1) }},
+	{"away-after", "how long users can be quiet before being marked away (0 disables)", true, func(cfg *ServerConfig) settingValue { return durationSetting(&cfg.AwayAfter, true) }},
+	{"offline-limit", "DMs queued for each user who is not connected", true, func(cfg *ServerConfig) settingValue { return intSetting(&cfg.OfflineLimit, 1) }},
+	{"slow-consumer", "what to do when a client falls behind: drop-oldest, disconnect, spill or block (new clients)", true, func(cfg *ServerConfig) settingValue { return policySetting(&cfg.SlowConsumer) }},
+	{"max-drops", "messages a client may miss before -slow-consumer=disconnect drops it", true, func(cfg *ServerConfig) settingValue { return intSetting(&cfg.MaxDrops, 0) }},
+	{"block-timeout", "how long -slow-consumer=block waits for a client", true, func(cfg *ServerConfig) settingValue { return durationSetting(&cfg.BlockTimeout, false) }},
+	{"message-limit", "channel messages each user may send, as <events>/<duration> or off", true, func(cfg *ServerConfig) settingValue { return limitSetting(&cfg.RateLimits.Messages) }},
+	{"channel-limits", "comma-separated #channel=<events>/<duration> message limits replacing -message-limit", true, func(cfg *ServerConfig) settingValue { return channelLimitsSetting(&cfg.RateLimits.Channels) }},
+	{"command-limit", "commands each user may send", true, func(cfg *ServerConfig) settingValue { return limitSetting(&cfg.RateLimits.Commands) }},
+	{"dm-limit", "direct messages each user may send", true, func(cfg *ServerConfig) settingValue { return limitSetting(&cfg.RateLimits.DMs) }},
+	{"connect-limit", "connections each IP address may open", true, func(cfg *ServerConfig) settingValue { return limitSetting(&cfg.RateLimits.Connects) }},
+	{"owners", "comma-separated usernames with the owner role, who can /op moderators", true, func(cfg *ServerConfig) settingValue { return listSetting(&cfg.Owners) }},
+	{"require-auth", "only allow users logged in to a registered account", false, func(cfg *ServerConfig) settingValue { return boolSetting(&cfg.RequireAuth) }},
+	{"tls-cert", "PEM certificate to serve TLS with", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.TLSCertFile) }},
+	{"tls-key", "PEM private key for -tls-cert", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.TLSKeyFile) }},
+	{"tls-client-ca", "PEM CA for optional client certificates (mutual TLS)", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.TLSClientCAFile) }},
+	{"peer-addr", "TCP address for cluster peers (enables clustering)", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.PeerAddr) }},
+	{"node-id", "this node's ID in the cluster, 0-63", false, func(cfg *ServerConfig) settingValue { return intSetting(&cfg.NodeID, 0) }},
+	{"peers", "comma-separated peer addresses of the other cluster nodes", false, func(cfg *ServerConfig) settingValue { return listSetting(&cfg.Peers) }},
+	{"cluster-secret", "secret shared by every cluster node, required with -peer-addr", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.ClusterSecret) }},
+	{"raft-addr", "TCP address for Raft replication of the message log", false, func(cfg *ServerConfig) settingValue { return stringSetting(&cfg.RaftAddr) }},
+	{"raft-peers", "comma-separated id=address of every Raft node, including this one", false, func(cfg *ServerConfig) settingValue { return raftPeersSetting(&cfg.RaftPeers) }},
+}
+
+func lookupSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// LoadServerConfig reads the settings from the config file named by -config
+// (or CHATROOM_CONFIG), the environment and the command-line args.
+func LoadServerConfig(args []string) (ServerConfig, error) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "TOML file to read settings from, again on SIGHUP")
+	parsed := DefaultServerConfig()
+	for _, s := range settings {
+		fs.Var(s.value(&parsed), s.name, s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return ServerConfig{}, err
+	}
+
+	flags := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			flags[f.Name] = f.Value.String()
+		}
+	})
+	return ServerConfig{ConfigFile: *configFile, flags: flags}.Reload()
+}
+
+// Reload reads the settings again from cfg's config file, the environment
+// and the command-line flags cfg was loaded with.
+func (cfg ServerConfig) Reload() (ServerConfig, error) {
+	next := DefaultServerConfig()
+	next.ConfigFile, next.flags = cfg.ConfigFile, cfg.flags
+
+	if next.ConfigFile != "" {
+		if err := next.readFile(); err != nil {
+			return ServerConfig{}, err
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.envVar()); ok {
+			if err := s.value(&next).Set(value); err != nil {
+				return ServerConfig{}, fmt.Errorf("%s: %v", s.envVar(), err)
+			}
+		}
+	}
+
+	for name, value := range next.flags {
+		s, _ := lookupSetting(name)
+		if err := s.value(&next).Set(value); err != nil {
+			return ServerConfig{}, fmt.Errorf("-%s: %v", name, err)
+		}
+	}
+	return next, nil
+}
+
+func (cfg *ServerConfig) readFile() error {
+	data, err := os.ReadFile(cfg.ConfigFile)
+	if err != nil {
+		return err
+	}
+	values, err := toml.Parse(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", cfg.ConfigFile, err)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s, ok := lookupSetting(strings.ReplaceAll(key, "_", "-"))
+		if !ok || s.fileKey() != key {
+			return fmt.Errorf("%s: unknown setting %s", cfg.ConfigFile, key)
+		}
+		if err := s.value(cfg).Set(fileValue(values[key])); err != nil {
+			return fmt.Errorf("%s: %s: %v", cfg.ConfigFile, key, err)
+		}
+	}
+	return nil
+}
+
+// fileValue turns a value from the config file into the form a flag takes.
+func fileValue(value any) string {
+	switch v := value.(type) {
+	case []any:
+		elems := make([]string, len(v))
+		for i, elem := range v {
+			elems[i] = fileValue(elem)
+		}
+		return strings.Join(elems, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// settings returns the settings in effect.
+func (cr *ChatRoom) settings() ServerConfig {
+	cr.configMu.Lock()
+	defer cr.configMu.Unlock()
+	return cr.config
+}
+
+// applyConfig puts cfg into effect. Settings that can't change while running
+// are kept as they were, with a note in the log if cfg changes them.
+func (cr *ChatRoom) applyConfig(cfg ServerConfig) {
+	cr.configMu.Lock()
+	for _, s := range settings {
+		if s.reload {
+			continue
+		}
+		current := s.value(&cr.config).String()
+		if s.value(&cfg).String() != current {
+			fmt.Printf("Setting %s changed; restart the server to apply it\n", s.fileKey())
+			s.value(&cfg).Set(current)
+		}
+	}
+	cr.config = cfg
+	cr.configMu.Unlock()
+
+	cr.setHistoryWindow(cfg.HistoryWindow)
+	cr.setSlowConsumerPolicy(cfg.SlowConsumer, cfg.MaxDrops, cfg.BlockTimeout)
+	cr.setRateLimits(cfg.RateLimits)
+	cr.setOwners(cfg.Owners)
+	cr.setOfflineLimit(cfg.OfflineLimit)
+	cr.setAwayAfter(cfg.AwayAfter)
+}
+
+// reloadConfig reads the configuration again and applies it, keeping the
+// current settings if it is invalid.
+func (cr *ChatRoom) reloadConfig() error {
+	cfg, err := cr.settings().Reload()
+	if err != nil {
+		return err
+	}
+	cr.applyConfig(cfg)
+	return nil
+}
+
+// reloadOnHangup reloads the configuration whenever the process gets SIGHUP.
+func (cr *ChatRoom) reloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	for range hangup {
+		if err := cr.reloadConfig(); err != nil {
+			fmt.Printf("Config reload failed, keeping the current settings: %v\n", err)
+			continue
+		}
+		fmt.Println("Configuration reloaded")
+	}
+}
+
+// handleConfigCommand handles "/config", which shows owners the settings in
+// effect.
+func (cr *ChatRoom) handleConfigCommand(client *Client) {
+	if cr.clientRole(client) != RoleOwner {
+		client.sendError("Only owners can see the configuration")
+		return
+	}
+
+	cfg := cr.settings()
+	file := cfg.ConfigFile
+	if file == "" {
+		file = "none"
+	}
+	text := fmt.Sprintf("Configuration (file: %s):\n", file)
+	for _, s := range settings {
+		text += fmt.Sprintf("  %s = %s", s.fileKey(), s.value(&cfg))
+		if !s.reload {
+			text += " (restart to change)"
+		}
+		text += "\n"
+	}
+	client.sendSystem(text)
+}
+
+// settingValue binds a setting to its field as a flag.Value.
+type settingValue struct {
+	get    func() string
+	set    func(string) error
+	isBool bool
+}
+
+func (v settingValue) String() string {
+	if v.get == nil {
+		return "" // The zero value the flag package makes for its usage text
+	}
+	return v.get()
+}
+
+func (v settingValue) Set(s string) error { return v.set(s) }
+
+func (v settingValue) IsBoolFlag() bool { return v.isBool }
+
+func stringSetting(p *string) settingValue {
+	return settingValue{
+		get: func() string { return *p },
+		set: func(s string) error { *p = s; return nil },
+	}
+}
+
+func intSetting(p *int, min int) settingValue {
+	return settingValue{
+		get: func() string { return strconv.Itoa(*p) },
+		set: func(s string) error {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("invalid number %q", s)
+			}
+			if n < min {
+				return fmt.Errorf("must be at least %d", min)
+			}
+			*p = n
+			return nil
+		},
+	}
+}
+
+// durationSetting only accepts zero if zeroOK is set.
+func durationSetting(p *time.Duration, zeroOK bool) settingValue {
+	return settingValue{
+		get: func() string { return p.String() },
+		set: func(s string) error {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("invalid duration %q", s)
+			}
+			if d < 0 || d == 0 && !zeroOK {
+				return fmt.Errorf("must be positive")
+			}
+			*p = d
+			return nil
+		},
+	}
+}
+
+func boolSetting(p *bool) settingValue {
+	return settingValue{
+		get: func() string { return strconv.FormatBool(*p) },
+		set: func(s string) error {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("invalid boolean %q", s)
+			}
+			*p = b
+			return nil
+		},
+		isBool: true,
+	}
+}
+
+func listSetting(p *[]string) settingValue {
+	return settingValue{
+		get: func() string { return strings.Join(*p, ",") },
+		set: func(s string) error {
+			*p = nil
+			if s != "" {
+				*p = strings.Split(s, ",")
+			}
+			return nil
+		},
+	}
+}
+
+func policySetting(p *SlowConsumerPolicy) settingValue {
+	return settingValue{
+		get: func() string { return string(*p) },
+		set: func(s string) error {
+			policy, err := ParseSlowConsumerPolicy(s)
+			if err != nil {
+				return err
+			}
+			*p = policy
+			return nil
+		},
+	}
+}
+
+func limitSetting(p *ratelimit.Limit) settingValue {
+	return settingValue{
+		get: p.String,
+		set: func(s string) error {
+			limit, err := ratelimit.ParseLimit(s)
+			if err != nil {
+				return err
+			}
+			*p = limit
+			return nil
+		},
+	}
+}
+
+func channelLimitsSetting(p *map[string]ratelimit.Limit) settingValue {
+	return settingValue{
+		get: func() string {
+			entries := make([]string, 0, len(*p))
+			for channel, limit := range *p {
+				entries = append(entries, fmt.Sprintf("#%s=%s", channel, limit))
+			}
+			sort.Strings(entries)
+			return strings.Join(entries, ",")
+		},
+		set: func(s string) error {
+			*p = nil
+			if s == "" {
+				return nil
+			}
+			limits := make(map[string]ratelimit.Limit)
+			for _, entry := range strings.Split(s, ",") {
+				channel, value, _ := strings.Cut(entry, "=")
+				limit, err := ratelimit.ParseLimit(value)
+				if err != nil || channel == "" {
+					return fmt.Errorf("invalid entry %q, want #channel=<events>/<duration>", entry)
+				}
+				limits[normalizeChannelName(channel)] = limit
+			}
+			*p = limits
+			return nil
+		},
+	}
+}
+
+func raftPeersSetting(p *map[int]string) settingValue {
+	return settingValue{
+		get: func() string {
+			ids := make([]int, 0, len(*p))
+			for id := range *p {
+				ids = append(ids, id)
+			}
+			sort.Ints(ids)
+			entries := make([]string, len(ids))
+			for i, id := range ids {
+				entries[i] = fmt.Sprintf("%d=%s", id, (*p)[id])
+			}
+			return strings.Join(entries, ",")
+		},
+		set: func(s string) error {
+			*p = nil
+			if s == "" {
+				return nil
+			}
+			peers := make(map[int]string)
+			for _, entry := range strings.Split(s, ",") {
+				id, addr, ok := strings.Cut(entry, "=")
+				nodeID, err := strconv.Atoi(id)
+				if !ok || err != nil {
+					return fmt.Errorf("invalid entry %q, want id=address", entry)
+				}
+				peers[nodeID] = addr
+			}
+			*p = peers
+			return nil
+		},
+	}
+}
@@ -0,0 +1,98 @@
+package chatroom
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/ratelimit"
+)
+
+func TestServerConfigSources(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "chat.toml")
+	writeConfig := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`
+addr = ":9100"
+history_window = 50
+session_ttl = "2h"
+owners = ["alice", "bob"]
+channel_limits = ["#announcements=1/1m"]
+`)
+
+	// Flags beat the environment, which beats the file
+	t.Setenv("CHATROOM_HISTORY_WINDOW", "60")
+	t.Setenv("CHATROOM_QUEUE_SIZE", "20")
+	cfg, err := LoadServerConfig([]string{"-config", path, "-queue-size", "30", "-data", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ListenAddr != ":9100" || cfg.HistoryWindow != 60 || cfg.QueueSize != 30 || cfg.SessionTTL != 2*time.Hour {
+		t.Fatalf("got %+v", cfg)
+	}
+	if strings.Join(cfg.Owners, ",") != "alice,bob" || cfg.RateLimits.Channels["announcements"] != (ratelimit.Limit{Events: 1, Per: time.Minute}) {
+		t.Fatalf("lists weren't read: %+v", cfg)
+	}
+	if cfg.LoginTimeout != defaultLoginTimeout || cfg.HTTPAddr != ":8080" {
+		t.Fatalf("unset settings lost their defaults: %+v", cfg)
+	}
+
+	for _, bad := range []string{"histroy_window = 5", "history_window = 0", "idle_timeout = \"soon\""} {
+		writeConfig(bad)
+		if _, err := cfg.Reload(); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+
+	// Reloading changes the reloadable settings and keeps the rest
+	cr, err := newChatRoom(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cr.wal.Close()
+	cr.applyConfig(cfg)
+
+	os.Unsetenv("CHATROOM_HISTORY_WINDOW")
+	writeConfig("addr = \":9200\"\nhistory_window = 70\nidle_timeout = \"0s\"\nowners = [\"alice\"]\n")
+	if err := cr.reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	got := cr.settings()
+	if got.ListenAddr != ":9100" || got.IdleTimeout != 0 || got.QueueSize != 30 {
+		t.Fatalf("after reloading got %+v", got)
+	}
+	cr.messageMu.Lock()
+	window := cr.historyWindow
+	cr.messageMu.Unlock()
+	if window != 70 {
+		t.Fatalf("history window is %d, want 70", window)
+	}
+	if cr.roleOf("alice") != RoleOwner || cr.roleOf("bob") != RoleUser {
+		t.Fatalf("after dropping bob from owners: alice is %s, bob is %s", cr.roleOf("alice"), cr.roleOf("bob"))
+	}
+
+	writeConfig("history_window = [")
+	if err := cr.reloadConfig(); err == nil || cr.settings().HistoryWindow != 70 {
+		t.Fatal("a broken config file was applied")
+	}
+
+	// Only owners can see the configuration
+	alice := &Client{username: "alice", authenticated: true, outgoing: make(chan Event, 10)}
+	carol := &Client{username: "carol", authenticated: true, outgoing: make(chan Event, 10)}
+	cr.handleConfigCommand(carol)
+	expectMessageContains(t, carol.outgoing, "Only owners", "carol")
+	cr.handleConfigCommand(alice)
+	ev := <-alice.outgoing
+	for _, want := range []string{"file: " + path, "history_window = 70\n", "addr = :9100 (restart to change)", "idle_timeout = 0s\n"} {
+		if !strings.Contains(ev.Text(), want) {
+			t.Errorf("/config output %q doesn't contain %q", ev.Text(), want)
+		}
+	}
+}
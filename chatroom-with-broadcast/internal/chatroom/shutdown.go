@@ -0,0 +1,111 @@
+package chatroom
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Graceful shutdown
+//
+// When the server's context is cancelled (by SIGINT or SIGTERM, see
+// StartServerWithConfig) it stops accepting connections and tells every
+// connected client it is going away with a shutdown frame carrying the
+// client's reconnect token. Their queues are then closed, and the writers
+// get up to ShutdownTimeout to send what is left before the remaining
+// connections are cut. Only then is the final snapshot taken. Every WAL
+// record is synced as it is appended, so a drain that runs out of time
+// loses frames in flight but never messages.
+
+// defaultShutdownTimeout is how long a shutdown waits for clients to drain.
+const defaultShutdownTimeout = 10 * time.Second
+
+// serveUntil accepts chat connections on listener until ctx is done, then
+// drains the connected clients.
+func serveUntil(ctx context.Context, listener net.Listener, chatRoom *ChatRoom) {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	serve(listener, chatRoom)
+	chatRoom.drain(chatRoom.settings().ShutdownTimeout)
+}
+
+// shutdownEvent tells username that the server is going away and how to
+// come back.
+func (cr *ChatRoom) shutdownEvent(username string) Event {
+	ev := textEvent(frameShutdown, "Server is shutting down")
+	ev.User = username
+
+	cr.sessionsMu.Lock()
+	if session := cr.sessions[username]; session != nil {
+		ev.Token = session.ReconnectToken
+	}
+	cr.sessionsMu.Unlock()
+	return ev
+}
+
+// isClosing reports whether the server is shutting down.
+func (cr *ChatRoom) isClosing() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.closing
+}
+
+// drain disconnects every local client, giving their writers up to timeout
+// to flush what is queued for them. Clients that join afterwards are turned
+// away.
+func (cr *ChatRoom) drain(timeout time.Duration) {
+	cr.mu.Lock()
+	cr.closing = true
+	clients := make([]*Client, 0, len(cr.clients))
+	for client := range cr.clients {
+		clients = append(clients, client)
+		delete(cr.clients, client) // Leaving now isn't news to anyone
+	}
+	cr.mu.Unlock()
+
+	fmt.Printf(" Draining %d clients...\n", len(clients))
+	cr.announcePresence()
+	for _, client := range clients {
+		client.send(cr.shutdownEvent(client.username))
+		client.closeQueue()
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	expired := false
+	stuck := 0
+	for _, client := range clients {
+		if client.drained == nil {
+			continue
+		}
+		if !expired {
+			select {
+			case <-client.drained:
+				continue
+			case <-deadline.C:
+				expired = true
+			}
+		}
+		select {
+		case <-client.drained:
+		default:
+			stuck++
+		}
+	}
+	if stuck > 0 {
+		fmt.Printf(" %d clients didn't drain within %s\n", stuck, timeout)
+	}
+
+	for _, client := range clients {
+		client.mu.Lock()
+		lastMessageID := client.lastMessageID
+		client.mu.Unlock()
+		cr.updateSessionActivity(client.username, lastMessageID)
+
+		if client.conn != nil {
+			client.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package chatroom
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cr.Run()
+	cr.configMu.Lock()
+	cr.config.ShutdownTimeout = 500 * time.Millisecond
+	cr.configMu.Unlock()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		serveUntil(ctx, listener, cr)
+		cr.shutdown()
+		close(stopped)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("alice\n"))
+	expectLine(t, reader, "Welcome, alice!", "alice")
+	conn.Write([]byte("last words\n"))
+	expectLine(t, reader, "[alice]: last words", "alice")
+
+	// bob stops reading after the welcome, so his writer is stuck until the
+	// deadline
+	bob, bobReader := connectPipe(t, cr)
+	bob.Write([]byte("bob\n"))
+	expectLine(t, bobReader, "Welcome, bob!", "bob")
+	waitFor(t, "bob to join", func() bool { return cr.isUsernameConnected("bob") })
+
+	started := time.Now()
+	cancel()
+	line := expectLine(t, reader, "Server is shutting down", "alice")
+	if !strings.Contains(line, "reconnect:alice:") {
+		t.Fatalf("the shutdown notice has no reconnect token: %q", line)
+	}
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatal("alice's connection stayed open")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown didn't finish")
+	}
+	if elapsed := time.Since(started); elapsed < 500*time.Millisecond {
+		t.Fatalf("shutdown took %s, so it didn't wait for bob", elapsed)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatal("the listener still accepts connections")
+	}
+
+	// The final snapshot covers everything, and alice can come back
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+	if restarted.checkpointID != restarted.lastMessageID() {
+		t.Fatalf("the snapshot covers up to #%d, want #%d", restarted.checkpointID, restarted.lastMessageID())
+	}
+	if !strings.Contains(contents(restarted.latestMessages(defaultChannel, 10)), "last words") {
+		t.Fatal("a message was lost")
+	}
+	_, token, _ := strings.Cut(strings.TrimSuffix(strings.TrimSpace(line), " ***"), "reconnect:alice:")
+	if session := restarted.sessions["alice"]; session == nil || session.ReconnectToken != token {
+		t.Fatalf("alice's token %q doesn't work after the restart", token)
+	}
+}
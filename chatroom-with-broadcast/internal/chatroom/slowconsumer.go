@@ -0,0 +1,320 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Caesarsage/chatroom/internal/metrics"
+	"github.com/Caesarsage/chatroom/internal/spool"
+)
+
+// Slow consumers
+//
+// Every frame for a client is queued on Client.outgoing, which its writer
+// drains into the connection. When a client reads slower than frames arrive
+// the queue fills up, and the server's SlowConsumerPolicy decides what
+// happens to the next frame:
+//
+//   - DropOldest makes room by dropping the oldest queued frame.
+//   - Disconnect drops the new frame, and disconnects the client once it has
+//     missed MaxDrops frames.
+//   - Spill queues the frame, and every frame after it until the client has
+//     caught up, in a file of its own under <data>/spill.
+//   - Block waits up to BlockTimeout for room, holding up the sender, and
+//     then disconnects the client.
+//
+// Frames are numbered as they are queued, and where the numbers skip the
+// writer sends a gap frame saying how many were dropped.
+//
+// Clients also keep their lag: how long the last frame written to them had
+// been queued for.
+
+// SlowConsumerPolicy is what the server does with frames for a client whose
+// queue is full.
+type SlowConsumerPolicy string
+
+const (
+	DropOldest SlowConsumerPolicy = "drop-oldest"
+	Disconnect SlowConsumerPolicy = "disconnect"
+	Spill      SlowConsumerPolicy = "spill"
+	Block      SlowConsumerPolicy = "block"
+)
+
+// ParseSlowConsumerPolicy returns the policy named s.
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(s); policy {
+	case DropOldest, Disconnect, Spill, Block:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown slow consumer policy %q (want drop-oldest, disconnect, spill or block)", s)
+}
+
+// slowConsumerConfig is the policy clients are created with.
+type slowConsumerConfig struct {
+	policy       SlowConsumerPolicy
+	maxDrops     int           // Disconnect
+	blockTimeout time.Duration // Block
+	spillDir     string        // Spill
+
+	dropped *metrics.Counter // counts dropped frames by reason
+}
+
+// defaultQueueSize is how many frames a client's queue holds in memory.
+const defaultQueueSize = 10
+
+// slowClientFraction is the share of connections picked at random to be
+// simulated slow clients (Client.isSlowClient), and slowClientDelay bounds
+// the random delay before each frame written to one.
+var (
+	slowClientFraction = 0.1
+	slowClientDelay    = 500 * time.Millisecond
+)
+
+// spillFiles numbers spill files, which outlive neither their client nor the
+// process.
+var spillFiles atomic.Int64
+
+const (
+	defaultMaxDrops     = 100
+	defaultBlockTimeout = 5 * time.Second
+)
+
+func (cr *ChatRoom) spillDir() string {
+	return filepath.Join(cr.dataDir, "spill")
+}
+
+// setSlowConsumerPolicy sets the policy for clients that connect from now
+// on.
+func (cr *ChatRoom) setSlowConsumerPolicy(policy SlowConsumerPolicy, maxDrops int, blockTimeout time.Duration) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.slowConsumer = slowConsumerConfig{
+		policy:       policy,
+		maxDrops:     maxDrops,
+		blockTimeout: blockTimeout,
+		spillDir:     cr.spillDir(),
+		dropped:      cr.metrics.dropped,
+	}
+}
+
+// newClientQueue sets up client's outgoing queue under the room's slow
+// consumer policy.
+func (cr *ChatRoom) newClientQueue(client *Client) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	client.outgoing = make(chan Event, cr.settings().QueueSize)
+	client.slowConsumer = cr.slowConsumer
+}
+
+// send queues ev for the client and reports whether it was queued. With a
+// full queue it is up to the slow consumer policy; clients without one drop
+// the new frame.
+func (c *Client) send(ev Event) bool {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	if c.queueClosed {
+		return false
+	}
+	c.queued++
+	ev.queueSeq = c.queued
+
+	if c.spill != nil && c.spill.Len() > 0 {
+		return c.spillLocked(ev) // stay behind what's already spilled
+	}
+
+	select {
+	case c.outgoing <- ev:
+		return true
+	default:
+	}
+
+	switch c.slowConsumer.policy {
+	case DropOldest:
+		// Only senders holding queueMu add frames, so this makes room
+		for {
+			select {
+			case <-c.outgoing:
+				c.noteDrop(dropQueueFull)
+			default:
+			}
+			select {
+			case c.outgoing <- ev:
+				return true
+			default:
+			}
+		}
+
+	case Disconnect:
+		if c.noteDrop(dropQueueFull) == c.slowConsumer.maxDrops {
+			c.disconnect(fmt.Sprintf("missed %d messages", c.slowConsumer.maxDrops))
+		}
+		return false
+
+	case Spill:
+		return c.spillLocked(ev)
+
+	case Block:
+		if c.disconnecting {
+			return false
+		}
+		timer := time.NewTimer(c.slowConsumer.blockTimeout)
+		defer timer.Stop()
+		select {
+		case c.outgoing <- ev:
+			return true
+		case <-timer.C:
+			c.noteDrop(dropBlockTimeout)
+			c.disconnect(fmt.Sprintf("blocked for %s", c.slowConsumer.blockTimeout))
+			return false
+		}
+	}
+	return false
+}
+
+// noteDrop counts a frame dropped for reason and returns how many the client
+// has missed in all.
+func (c *Client) noteDrop(reason string) int {
+	if c.slowConsumer.dropped != nil {
+		c.slowConsumer.dropped.Inc(reason)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dropped++
+	return c.dropped
+}
+
+// disconnect closes the connection of a client that can't keep up; the
+// reader then sees the error and the client leaves. Callers must hold
+// queueMu.
+func (c *Client) disconnect(reason string) {
+	if c.disconnecting {
+		return
+	}
+	c.disconnecting = true
+	fmt.Printf(" Disconnecting slow client %s: %s\n", c.username, reason)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// spilledFrame is a frame in a spill file.
+type spilledFrame struct {
+	QueueSeq int
+	Cursor   int
+	Event    Event
+}
+
+// spillLocked appends ev to the client's spill file. Callers must hold
+// queueMu.
+func (c *Client) spillLocked(ev Event) bool {
+	if c.spill == nil {
+		if err := os.MkdirAll(c.slowConsumer.spillDir, 0o700); err != nil {
+			fmt.Printf("Failed to create spill directory: %v\n", err)
+			c.noteDrop(dropSpillFailed)
+			return false
+		}
+		name := strconv.FormatInt(spillFiles.Add(1), 10) + ".spool"
+		queue, err := spool.Create(filepath.Join(c.slowConsumer.spillDir, name))
+		if err != nil {
+			fmt.Printf("Failed to create spill file for %s: %v\n", c.username, err)
+			c.noteDrop(dropSpillFailed)
+			return false
+		}
+		c.spill = queue
+	}
+
+	data, err := json.Marshal(spilledFrame{QueueSeq: ev.queueSeq, Cursor: ev.cursor, Event: ev})
+	if err == nil {
+		err = c.spill.Push(data)
+	}
+	if err != nil {
+		fmt.Printf("Failed to spill a frame for %s: %v\n", c.username, err)
+		c.noteDrop(dropSpillFailed)
+		return false
+	}
+	return true
+}
+
+// refill moves spilled frames back into the outgoing queue while it has
+// room. The writer calls it after each frame.
+func (c *Client) refill() {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	for !c.queueClosed && c.spill != nil && c.spill.Len() > 0 && len(c.outgoing) < cap(c.outgoing) {
+		data, _, err := c.spill.Pop()
+		if err != nil {
+			// Give up on the rest of the file
+			fmt.Printf("Failed to read the spill file of %s: %v\n", c.username, err)
+			for range c.spill.Len() {
+				c.noteDrop(dropSpillFailed)
+			}
+			c.spill.Close()
+			c.spill = nil
+			return
+		}
+
+		var frame spilledFrame
+		if err := json.Unmarshal(data, &frame); err != nil {
+			fmt.Printf("Failed to decode a spilled frame for %s: %v\n", c.username, err)
+			c.noteDrop(dropSpillFailed)
+			continue
+		}
+		frame.Event.queueSeq = frame.QueueSeq
+		frame.Event.cursor = frame.Cursor
+		c.outgoing <- frame.Event
+	}
+}
+
+// closeQueue closes the outgoing queue, stopping the writer, and discards
+// anything still spilled. Frames sent afterwards are dropped.
+func (c *Client) closeQueue() {
+	c.queueMu.Lock()
+	defer c.queueMu.Unlock()
+
+	if c.queueClosed {
+		return
+	}
+	c.queueClosed = true
+	close(c.outgoing)
+	if c.spill != nil {
+		c.spill.Close()
+	}
+}
+
+// noteWritten records the lag of a frame just written to the client, and
+// moves its cursor past the messages the frame delivered.
+func (c *Client) noteWritten(ev Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastMessageID = max(c.lastMessageID, ev.cursor)
+	c.lag = time.Since(ev.Timestamp)
+}
+
+// backlog returns how many frames are queued for the client, how long the
+// last one written had waited, and how many it has missed in all.
+func (c *Client) backlog() (queued int, lag time.Duration, dropped int) {
+	queued = len(c.outgoing)
+	// Block senders wait holding queueMu, but only Spill clients have a
+	// spill file
+	if c.slowConsumer.policy == Spill {
+		c.queueMu.Lock()
+		if c.spill != nil {
+			queued += c.spill.Len()
+		}
+		c.queueMu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if queued == 0 {
+		return 0, 0, c.dropped // caught up
+	}
+	return queued, c.lag, c.dropped
+}
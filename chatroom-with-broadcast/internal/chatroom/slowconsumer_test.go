@@ -0,0 +1,143 @@
+package chatroom
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	delay := slowClientDelay
+	slowClientDelay = 5 * time.Millisecond
+	t.Cleanup(func() { slowClientDelay = delay })
+
+	// slowClient connects a simulated slow client that nothing reads from
+	// yet, so its queue fills up, and broadcasts 30 messages to it.
+	slowClient := func(t *testing.T, policy SlowConsumerPolicy) (*Client, *bufio.Reader) {
+		cr, err := NewChatRoom(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cr.wal.Close() })
+		cr.setSlowConsumerPolicy(policy, 5, 50*time.Millisecond)
+
+		serverConn, clientConn := net.Pipe()
+		t.Cleanup(func() { clientConn.Close() })
+		client := &Client{conn: lineConn{t, serverConn}, username: "snail", isSlowClient: true}
+		cr.newClientQueue(client)
+		t.Cleanup(client.closeQueue)
+		cr.mu.Lock()
+		cr.clients[client] = true
+		cr.mu.Unlock()
+		go writeMessages(client)
+
+		for i := 0; i < 30; i++ {
+			cr.handleBroadcast(Message{From: "alice", Content: fmt.Sprint("message ", i)})
+		}
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return client, bufio.NewReader(clientConn)
+	}
+
+	// readUntil returns the lines read up to and including one containing
+	// last, or up to the end of the connection.
+	readUntil := func(t *testing.T, reader *bufio.Reader, last string) ([]string, error) {
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return lines, err
+			}
+			lines = append(lines, line)
+			if strings.Contains(line, last) {
+				return lines, nil
+			}
+		}
+	}
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		client, reader := slowClient(t, DropOldest)
+		queued, _, dropped := client.backlog()
+		if queued != defaultQueueSize || dropped == 0 {
+			t.Fatalf("backlog: %d queued, %d dropped", queued, dropped)
+		}
+
+		// The lag is measured once a message (not just a gap notice) is out
+		lines, err := readUntil(t, reader, "message ")
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		waitFor(t, "the lag to be measured", func() bool {
+			_, lag, _ := client.backlog()
+			return lag > 0
+		})
+
+		more, err := readUntil(t, reader, "message 29")
+		if err != nil {
+			t.Fatalf("reading: %v (read %q)", err, more)
+		}
+		// The writer may have taken a frame before the queue overflowed,
+		// which splits the drops between two gap notices
+		text := strings.Join(append(lines, more...), "")
+		skipped := 0
+		for _, line := range append(lines, more...) {
+			var n int
+			if _, err := fmt.Sscanf(line, "*** You fell behind: %d messages were dropped", &n); err == nil {
+				skipped += n
+			}
+		}
+		if skipped != dropped || !strings.Contains(text, "message 20") {
+			t.Fatalf("expected gap notices for %d messages and the newest ones, got %q", dropped, text)
+		}
+	})
+
+	t.Run("spill", func(t *testing.T) {
+		client, reader := slowClient(t, Spill)
+		if queued, _, dropped := client.backlog(); queued < 29 || dropped != 0 {
+			t.Fatalf("backlog: %d queued, %d dropped", queued, dropped)
+		}
+
+		lines, err := readUntil(t, reader, "message 29")
+		if err != nil {
+			t.Fatalf("reading: %v (read %q)", err, lines)
+		}
+		if len(lines) != 30 {
+			t.Fatalf("got %d lines, want all 30 messages: %q", len(lines), lines)
+		}
+		for i, line := range lines {
+			if !strings.Contains(line, fmt.Sprint("message ", i)) {
+				t.Fatalf("line %d is %q", i, line)
+			}
+		}
+	})
+
+	for _, policy := range []SlowConsumerPolicy{Disconnect, Block} {
+		t.Run(string(policy), func(t *testing.T) {
+			client, reader := slowClient(t, policy)
+			lines, err := readUntil(t, reader, "message 29")
+			if err != io.EOF {
+				t.Fatalf("client wasn't disconnected: %v (read %q)", err, lines)
+			}
+			if _, _, dropped := client.backlog(); dropped == 0 {
+				t.Fatal("no messages were dropped")
+			}
+		})
+	}
+}
+
+// lineConn fails the test if a single Write carries anything but one line,
+// which over WebSocket would turn into a message holding several frames.
+type lineConn struct {
+	t *testing.T
+	net.Conn
+}
+
+func (c lineConn) Write(p []byte) (int, error) {
+	if n := strings.Count(string(p), "\n"); n != 1 || p[len(p)-1] != '\n' {
+		c.t.Errorf("one write carried %d lines: %q", n, p)
+	}
+	return c.Conn.Write(p)
+}
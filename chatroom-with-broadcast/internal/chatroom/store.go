@@ -0,0 +1,295 @@
+package chatroom
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+
+	"github.com/Caesarsage/chatroom/internal/history"
+)
+
+// Message store
+//
+// Only the newest historyWindow messages of each channel are kept in memory,
+// in a ring buffer per channel, and only those go into snapshots. Every
+// message is also appended to the history log in <data>/history (see
+// internal/history), which indexes them by channel and ID; reads that reach
+// past a channel's window are served from there.
+//
+// The history log is synced at every checkpoint, before the WAL segments it
+// covers are removed, and rolls back to the last sync after a crash. WAL
+// replay then appends whatever is newer again.
+
+// defaultHistoryWindow is how many messages of each channel are kept in
+// memory unless configured otherwise.
+const defaultHistoryWindow = 1000
+
+// messageRing holds the newest messages of a channel in ID order. It grows
+// up to size messages and then overwrites the oldest.
+type messageRing struct {
+	buf   []Message
+	start int // index of the oldest message once the ring is full
+	size  int
+
+	// partial is set once older messages of the channel may be missing from
+	// the ring and have to be read from the history log.
+	partial bool
+}
+
+func newMessageRing(size int) *messageRing {
+	return &messageRing{size: size}
+}
+
+func (r *messageRing) len() int { return len(r.buf) }
+
+// full reports whether the ring has reached its size.
+func (r *messageRing) full() bool { return len(r.buf) >= r.size }
+
+// at returns the i-th oldest message.
+func (r *messageRing) at(i int) Message {
+	return r.buf[(r.start+i)%len(r.buf)]
+}
+
+// search returns the position of the first message with an ID of at least id.
+func (r *messageRing) search(id int) int {
+	return sort.Search(r.len(), func(i int) bool { return r.at(i).ID >= id })
+}
+
+// slice returns messages [from, to), oldest first.
+func (r *messageRing) slice(from, to int) []Message {
+	msgs := make([]Message, 0, to-from)
+	for i := from; i < to; i++ {
+		msgs = append(msgs, r.at(i))
+	}
+	return msgs
+}
+
+// insert adds msg in ID order, dropping the oldest message if the ring is
+// full. It reports false if the ID is already in the ring, or if the ring is
+// full and msg is older than everything in it.
+func (r *messageRing) insert(msg Message) bool {
+	n := r.len()
+	if n == 0 || msg.ID > r.at(n-1).ID {
+		// The common case: a new message
+		if !r.full() {
+			r.buf = append(r.buf, msg)
+		} else {
+			r.buf[r.start] = msg
+			r.start = (r.start + 1) % n
+			r.partial = true
+		}
+		return true
+	}
+
+	i := r.search(msg.ID)
+	if i < n && r.at(i).ID == msg.ID {
+		return false
+	}
+	if r.full() && i == 0 {
+		r.partial = true
+		return false
+	}
+
+	msgs := r.slice(0, n)
+	msgs = append(msgs[:i], append([]Message{msg}, msgs[i:]...)...)
+	r.keepNewest(msgs)
+	return true
+}
+
+// update applies f to the message with the given ID, if the ring holds it.
+func (r *messageRing) update(id int, f func(*Message)) {
+	if i := r.search(id); i < r.len() && r.at(i).ID == id {
+		f(&r.buf[(r.start+i)%len(r.buf)])
+	}
+}
+
+// resize changes the size of the ring, keeping the newest messages.
+func (r *messageRing) resize(size int) {
+	r.size = size
+	r.keepNewest(r.slice(0, r.len()))
+}
+
+// keepNewest replaces the contents of the ring with the newest messages of
+// msgs, which are in ID order.
+func (r *messageRing) keepNewest(msgs []Message) {
+	if len(msgs) > r.size {
+		msgs = msgs[len(msgs)-r.size:]
+		r.partial = true
+	}
+	r.buf, r.start = msgs, 0
+}
+
+// openHistory opens the history log in the data directory.
+func (cr *ChatRoom) openHistory() error {
+	log, err := history.Open(filepath.Join(cr.dataDir, "history"))
+	if err != nil {
+		return fmt.Errorf("open history: %w", err)
+	}
+	cr.history = log
+	return nil
+}
+
+// setHistoryWindow changes how many messages of each channel are kept in
+// memory.
+func (cr *ChatRoom) setHistoryWindow(size int) {
+	if size < 1 {
+		size = defaultHistoryWindow
+	}
+
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+
+	cr.historyWindow = size
+	for _, ring := range cr.windows {
+		ring.resize(size)
+	}
+}
+
+// storeMessageLocked adds msg to its channel's window, the history log and
+// the search index and advances the ID counter past it. Edit and delete
+// records are folded into the message they change. It reports false if the
+// message was already stored. Callers must hold cr.messageMu.
+func (cr *ChatRoom) storeMessageLocked(msg Message) bool {
+	if msg.Channel == "" {
+		msg.Channel = defaultChannel
+	}
+
+	// The log keeps the message as sent, the window and index as amended
+	current := msg
+	cr.foldLocked(&current)
+
+	ring := cr.windows[msg.Channel]
+	if ring == nil {
+		ring = newMessageRing(cr.historyWindow)
+		cr.windows[msg.Channel] = ring
+	}
+	inWindow := ring.insert(current)
+
+	inHistory := false
+	if data, err := json.Marshal(msg); err != nil {
+		fmt.Printf("Failed to encode message %d: %v\n", msg.ID, err)
+	} else if inHistory, err = cr.history.Append(msg.Channel, msg.ID, data); err != nil {
+		fmt.Printf("Failed to add message %d to the history log: %v\n", msg.ID, err)
+	}
+	cr.indexMessage(current)
+	if isAmendment(msg) {
+		cr.amendLocked(msg)
+	}
+
+	if msg.ID >= cr.nextMessageID {
+		cr.nextMessageID = msg.ID + 1
+	}
+	node := msg.ID % maxClusterNodes
+	if last, ok := cr.lastFromNode[node]; !ok || msg.ID > last {
+		cr.lastFromNode[node] = msg.ID
+	}
+	return inWindow || inHistory
+}
+
+// windowMessagesLocked returns every message held in memory, in ID order.
+// Callers must hold cr.messageMu.
+func (cr *ChatRoom) windowMessagesLocked() []Message {
+	var msgs []Message
+	for _, ring := range cr.windows {
+		msgs = append(msgs, ring.slice(0, ring.len())...)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].ID < msgs[j].ID })
+	return msgs
+}
+
+// windowMessages is windowMessagesLocked for callers not holding
+// cr.messageMu.
+func (cr *ChatRoom) windowMessages() []Message {
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+	return cr.windowMessagesLocked()
+}
+
+// messagesBefore returns the newest limit messages of channel with an ID
+// below before, oldest first, reading past the window from the history log.
+func (cr *ChatRoom) messagesBefore(channel string, before, limit int) []Message {
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+
+	var msgs []Message
+	ring := cr.windows[channel]
+	if ring != nil {
+		end := ring.search(before)
+		msgs = ring.slice(max(0, end-limit), end)
+		if ring.len() > 0 && ring.at(0).ID < before {
+			before = ring.at(0).ID
+		}
+	}
+
+	// Anything older than the window is only on disk
+	if len(msgs) < limit && (ring == nil || ring.partial) {
+		older := cr.readHistory(cr.history.Before(channel, before, limit-len(msgs)))
+		for i := range older {
+			cr.foldLocked(&older[i])
+		}
+		msgs = append(older, msgs...)
+	}
+	return msgs
+}
+
+// messagesAfter returns the oldest limit messages of channel with an ID
+// above after, oldest first, reading from the history log if the window
+// doesn't reach back that far.
+func (cr *ChatRoom) messagesAfter(channel string, after, limit int) []Message {
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+
+	ring := cr.windows[channel]
+	if ring == nil || (ring.partial && after < ring.at(0).ID-1) {
+		msgs := cr.readHistory(cr.history.After(channel, after, limit))
+		for i := range msgs {
+			cr.foldLocked(&msgs[i])
+		}
+		return msgs
+	}
+
+	start := ring.search(after + 1)
+	return ring.slice(start, min(ring.len(), start+limit))
+}
+
+// countAfter returns how many messages of channel have an ID above after.
+func (cr *ChatRoom) countAfter(channel string, after int) int {
+	cr.messageMu.Lock()
+	defer cr.messageMu.Unlock()
+
+	ring := cr.windows[channel]
+	if ring == nil || (ring.partial && after < ring.at(0).ID-1) {
+		n, err := cr.history.Count(channel, after)
+		if err != nil {
+			fmt.Printf("Failed to read the history log: %v\n", err)
+		}
+		return n
+	}
+	return ring.len() - ring.search(after+1)
+}
+
+// latestMessages returns the newest limit messages of channel, oldest first.
+func (cr *ChatRoom) latestMessages(channel string, limit int) []Message {
+	return cr.messagesBefore(channel, math.MaxInt, limit)
+}
+
+// readHistory decodes messages read from the history log, logging and
+// skipping what can't be read.
+func (cr *ChatRoom) readHistory(records [][]byte, err error) []Message {
+	if err != nil {
+		fmt.Printf("Failed to read the history log: %v\n", err)
+	}
+
+	msgs := make([]Message, 0, len(records))
+	for _, data := range records {
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			fmt.Printf("Skipping undecodable history record: %v\n", err)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
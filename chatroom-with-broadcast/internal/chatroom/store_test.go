@@ -0,0 +1,76 @@
+package chatroom
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func contents(msgs []Message) string {
+	var texts []string
+	for _, msg := range msgs {
+		texts = append(texts, msg.Content)
+	}
+	return fmt.Sprint(texts)
+}
+
+func TestBoundedHistory(t *testing.T) {
+	dir := t.TempDir()
+	cr, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.setHistoryWindow(3)
+	for i := 0; i < 10; i++ {
+		cr.handleBroadcast(Message{From: "alice", Content: fmt.Sprint(i)})
+	}
+
+	if n := len(cr.windowMessages()); n != 3 {
+		t.Fatalf("%d messages in memory, want 3", n)
+	}
+
+	// Reads past the window come from the history log
+	tests := []struct {
+		name string
+		got  []Message
+		want string
+	}{
+		{"latest", cr.latestMessages(defaultChannel, 5), "[5 6 7 8 9]"},
+		{"before", cr.messagesBefore(defaultChannel, 2, 5), "[0 1]"},
+		{"before window", cr.messagesBefore(defaultChannel, 8, 2), "[6 7]"},
+		{"after", cr.messagesAfter(defaultChannel, 3, 2), "[4 5]"},
+		{"after window", cr.messagesAfter(defaultChannel, 7, 5), "[8 9]"},
+	}
+	for _, tt := range tests {
+		if got := contents(tt.got); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	if n := cr.countAfter(defaultChannel, 1); n != 8 {
+		t.Errorf("countAfter(1) = %d, want 8", n)
+	}
+
+	// Snapshots only hold the window; the rest is still paged in after a
+	// restart, even with a larger window
+	cr.shutdown()
+	restarted, err := NewChatRoom(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.wal.Close()
+	if got := contents(restarted.windowMessages()); got != "[7 8 9]" {
+		t.Fatalf("restored window %s, want [7 8 9]", got)
+	}
+
+	alice := &Client{username: "alice", outgoing: make(chan Event, 10)}
+	restarted.handleHistoryCommand(alice, strings.Fields("/history before 5 3"))
+	page := (<-alice.outgoing).Text()
+	for _, want := range []string{"(older: /history #global before 2)", "[alice]: 2", "[alice]: 3", "[alice]: 4"} {
+		if !strings.Contains(page, want) {
+			t.Fatalf("history page %q doesn't contain %q", page, want)
+		}
+	}
+
+	restarted.handleHistoryCommand(alice, strings.Fields("/history before x"))
+	expectMessageContains(t, alice.outgoing, "Invalid message ID", "alice")
+}
@@ -0,0 +1,122 @@
+package chatroom
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// serverTLSConfig builds the TLS settings for both listeners, or returns nil
+// when TLS is not configured.
+func serverTLSConfig(cfg ServerConfig) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			return nil, fmt.Errorf("client CA set without a server certificate and key")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.TLSClientCAFile != "" {
+		pool, err := loadCertPool(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client CA: %w", err)
+		}
+		tlsConfig.ClientCAs = pool
+		// Certificates are optional; users without one log in as usual
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// clientTLSConfig builds the TLS settings for StartClient, or returns nil
+// when TLS is off.
+func clientTLSConfig(cfg ClientConfig) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	host, _, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.TLSCAFile != "" {
+		pool, err := loadCertPool(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load CA: %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certUsername completes the TLS handshake on conn and returns the common
+// name of the verified client certificate, or "" if the client did not
+// present one or conn is not TLS. WebSocket connections are unwrapped first.
+func certUsername(conn net.Conn) (string, error) {
+	if wrapped, ok := conn.(interface{ Underlying() net.Conn }); ok {
+		conn = wrapped.Underlying()
+	}
+
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer tlsConn.SetDeadline(time.Time{})
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", nil
+	}
+	return state.PeerCertificates[0].Subject.CommonName, nil
+}
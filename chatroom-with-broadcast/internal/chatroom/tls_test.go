@@ -0,0 +1,89 @@
+package chatroom
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Caesarsage/chatroom/pkg/devcert"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert := filepath.Join(dir, "server.crt")
+	serverKey := filepath.Join(dir, "server.key")
+	if err := devcert.GenerateServer([]string{"localhost", "127.0.0.1"}, serverCert, serverKey); err != nil {
+		t.Fatalf("GenerateServer: %v", err)
+	}
+	aliceCert := filepath.Join(dir, "alice.crt")
+	aliceKey := filepath.Join(dir, "alice.key")
+	if err := devcert.GenerateClient("alice", serverCert, serverKey, aliceCert, aliceKey); err != nil {
+		t.Fatalf("GenerateClient: %v", err)
+	}
+
+	serverTLS, err := serverTLSConfig(ServerConfig{
+		TLSCertFile:     serverCert,
+		TLSKeyFile:      serverKey,
+		TLSClientCAFile: serverCert,
+	})
+	if err != nil {
+		t.Fatalf("serverTLSConfig: %v", err)
+	}
+
+	cr, err := NewChatRoom(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("NewChatRoom: %v", err)
+	}
+	go cr.Run()
+	closeAtCleanup(t, cr)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer listener.Close()
+	go serve(tls.NewListener(listener, serverTLS), cr)
+
+	// login dials with the given client settings, answers the username prompt
+	// and returns the first line containing want
+	login := func(cfg ClientConfig, username, want string) {
+		t.Helper()
+		cfg.Addr = listener.Addr().String()
+		cfg.TLS = true
+		cfg.TLSCAFile = serverCert
+
+		clientTLS, err := clientTLSConfig(cfg)
+		if err != nil {
+			t.Fatalf("clientTLSConfig: %v", err)
+		}
+		conn, err := tls.Dial("tcp", cfg.Addr, clientTLS)
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		reader := bufio.NewReader(conn)
+		conn.Write([]byte(username + "\n"))
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if strings.Contains(line, want) {
+				return
+			}
+		}
+	}
+
+	withCert := ClientConfig{TLSCertFile: aliceCert, TLSKeyFile: aliceKey}
+	login(withCert, "", "Welcome, alice!")
+	waitUntilDisconnected(t, cr, "alice")
+	login(withCert, "bob", "Your client certificate is for alice")
+	login(ClientConfig{}, "mallory", "Welcome, mallory!")
+	waitUntilDisconnected(t, cr, "mallory")
+}
@@ -2,9 +2,15 @@ package chatroom
 
 import (
 	"net"
-	"os"
 	"sync"
 	"time"
+
+	"github.com/Caesarsage/chatroom/internal/history"
+	"github.com/Caesarsage/chatroom/internal/raft"
+	"github.com/Caesarsage/chatroom/internal/ratelimit"
+	"github.com/Caesarsage/chatroom/internal/search"
+	"github.com/Caesarsage/chatroom/internal/spool"
+	"github.com/Caesarsage/chatroom/internal/wal"
 )
 
 type Message struct {
@@ -12,17 +18,59 @@ type Message struct {
 	From      string    `json:"from"`
 	Content   string    `json:"content"`
 	Timestamp time.Time `json:"timestamp"`
-	Channel   string    `json:"channel"` // global or private:username
+	Channel   string    `json:"channel"`        // global, a named channel or private:<a>:<b>
+	Kind      string    `json:"kind,omitempty"` // empty for chat, or join/part/topic/edit/delete
+
+	Ref     int  `json:"ref,omitempty"`      // edit and delete: ID of the message they change
+	ReplyTo int  `json:"reply_to,omitempty"` // chat: ID of the message answered
+	Edited  bool `json:"edited,omitempty"`   // set when read back after an edit
+	Deleted bool `json:"deleted,omitempty"`  // set when read back after a delete
+}
+
+// Channel is a named room. Membership is tracked by username so it survives
+// reconnects and restarts; the default channel implicitly contains everyone.
+type Channel struct {
+	Name    string          `json:"name"`
+	Topic   string          `json:"topic"`
+	Members map[string]bool `json:"members"`
 }
 
 type Client struct {
-	conn         net.Conn
-	username     string
-	outgoing     chan string
-	lastActive   time.Time
-	messagesSent int
-	messagesRecv int
-	isSlowClient bool // For testing
+	conn     net.Conn
+	username string
+	outgoing chan Event
+	jsonMode bool // speaks the JSON-lines protocol
+	// authenticated is set once the client proved it owns its username
+	authenticated bool
+	lastActive    time.Time
+	messagesSent  int
+	messagesRecv  int
+	isSlowClient  bool   // For testing
+	channel       string // channel plain lines are sent to
+
+	// Presence (see presence.go), guarded by mu
+	availability Presence
+	status       string
+	autoAway     bool // set by the idle check, cleared by any activity
+	lastTyping   time.Time
+
+	// Slow consumer handling (see slowconsumer.go). queueMu orders sends
+	// and guards the rest; dropped and lag are guarded by mu.
+	queueMu       sync.Mutex
+	slowConsumer  slowConsumerConfig
+	queued        int // frames sent to the queue so far, numbering them
+	queueClosed   bool
+	disconnecting bool
+	spill         *spool.Queue
+	dropped       int           // frames dropped in all
+	lag           time.Duration // how long the last frame written had been queued
+	drained       chan struct{} // closed when the writer stops; nil for clients without one
+
+	// lastMessageID is the ID of the newest message written to the client;
+	// frames still queued or dropped don't count. When resuming is set it starts at the session's cursor and handleJoin
+	// replays everything after it instead of the usual history.
+	lastMessageID int
+	resuming      bool
 
 	// sessionID      string
 	reconnectToken string
@@ -34,33 +82,83 @@ type ChatRoom struct {
 	mu            sync.Mutex
 	join          chan *Client
 	leave         chan *Client
-	broadcast     chan string
+	broadcast     chan Message
 	listUsers     chan *Client
 	directMessage chan DirectMessage
 
 	totalMessages int
 	startTime     time.Time
+	awayAfter     time.Duration // quiet time before users are marked away (guarded by mu)
+	closing       bool          // shutting down: no new clients (guarded by mu)
+	metrics       *chatMetrics  // served on /metrics
+
+	// The settings in effect (see settings.go)
+	config   ServerConfig
+	configMu sync.Mutex
 
 	// Persistence fields...
-	messages      []Message
+	windows       map[string]*messageRing // newest messages of each channel
+	historyWindow int                     // how many messages each window holds
+	history       *history.Log
+	searchIndex   *search.Index
 	messageMu     sync.Mutex
 	nextMessageID int
-	walFile       *os.File
-	walMu         sync.Mutex
+	lastFromNode  map[int]int     // newest message ID stored from each cluster node
+	amendments    map[int]Message // newest edit or delete record of each changed message
+	checkpointID  int             // newest message ID covered by the last snapshot, -1 if none
+	wal           *wal.WAL
 	dataDir       string
 
+	channels   map[string]*Channel
+	channelsMu sync.Mutex
+
 	sessions   map[string]*SessionInfo
 	sessionsMu sync.Mutex
+
+	accounts    map[string]*Account
+	accountsMu  sync.Mutex
+	requireAuth bool // reject users who are not logged in to an account
+
+	slowConsumer slowConsumerConfig // for new clients (guarded by mu)
+
+	moderation   moderationState // roles, bans and mutes (see moderation.go)
+	moderationMu sync.Mutex
+
+	// Flood protection (see limits.go)
+	rateLimits RateLimits
+	userLimits map[string]*userLimits
+	connects   *ratelimit.Keyed
+	limitsMu   sync.Mutex
+
+	// DMs for users who aren't connected (see offline.go)
+	offline      map[string][]Event
+	offlineLimit int
+	offlineMu    sync.Mutex
+
+	// Federation; cluster is nil when running standalone.
+	cluster     *cluster
+	remoteUsers map[string]int // users connected to other nodes, by node ID (guarded by mu)
+	peerFrames  chan peerFrame
+
+	// Raft replication of the message log; raft is nil when disabled.
+	raft        *raft.Node
+	raftStorage *raft.Storage
+	proposals   *proposalQueue // messages waiting to be proposed, in order
+	committed   chan committedMessage
 }
 
 type SessionInfo struct {
-	Username       string
-	ReconnectToken string
-	LastSeen       time.Time
-	CreatedAat     time.Time
+	Username       string    `json:"username"`
+	ReconnectToken string    `json:"reconnect_token"`
+	LastSeen       time.Time `json:"last_seen"`
+	CreatedAat     time.Time `json:"created_at"`
+	LastMessageID  int       `json:"last_message_id"` // newest message delivered to the user
 }
 
+// DirectMessage is a DM on its way to the hub.
 type DirectMessage struct {
-	toClient *Client
-	message  string
+	from *Client
+	to   string
+	text string
+	ref  string // echoed back to JSON clients
 }
@@ -0,0 +1,573 @@
+// Package history is an on-disk message archive indexed by channel and ID.
+//
+// Records are opaque payloads appended to a single data file. Every channel
+// has an index of fixed-size entries
+//
+//	id     int64, big endian
+//	offset int64, big endian - where the payload starts in the data file
+//	length uint32, big endian
+//
+// kept in ID order so pages can be found by binary search. Records that
+// arrive with an ID below the newest one already indexed for their channel
+// (late messages relayed by a cluster peer) go to a small separate "late"
+// index instead, which is merged in when reading.
+//
+// Writes are not synced one by one. Sync makes everything appended so far
+// durable and records the size of every file in meta.json; Open cuts the
+// files back to those sizes, so after a crash the log is exactly as of the
+// last Sync and the caller replays anything newer from its own WAL.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Caesarsage/chatroom/internal/wal"
+)
+
+const (
+	entrySize = 20
+
+	dataFile = "messages.log"
+	metaFile = "meta.json"
+	indexDir = "index"
+
+	mainExt = ".idx"
+	lateExt = ".late"
+)
+
+// entry locates one record.
+type entry struct {
+	id     int
+	offset int64
+	length int
+}
+
+// channelIndex is what is kept in memory about a channel's indexes.
+type channelIndex struct {
+	count  int     // entries in the main index
+	lastID int     // ID of its last entry, -1 if empty
+	late   []entry // the late index, which is small
+}
+
+// meta is the layout of meta.json: the size of every file as of the last
+// Sync.
+type meta struct {
+	DataSize int64                `json:"data_size"`
+	Indexes  map[string]indexSize `json:"indexes"`
+}
+
+type indexSize struct {
+	Main int64 `json:"main"`
+	Late int64 `json:"late"`
+}
+
+// Log is an open archive. It is safe for concurrent use.
+type Log struct {
+	dir string
+
+	mu       sync.Mutex
+	data     *os.File
+	size     int64
+	channels map[string]*channelIndex
+	dirty    map[string]bool // channels appended to since the last Sync
+	lastID   int
+}
+
+// Open opens the archive in dir, creating it if needed, and rolls it back to
+// the last Sync.
+func Open(dir string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Join(dir, indexDir), 0755); err != nil {
+		return nil, err
+	}
+
+	m := meta{Indexes: make(map[string]indexSize)}
+	raw, err := os.ReadFile(filepath.Join(dir, metaFile))
+	if err == nil {
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return nil, fmt.Errorf("history: read %s: %w", metaFile, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data, err := os.OpenFile(filepath.Join(dir, dataFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := data.Truncate(m.DataSize); err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	l := &Log{
+		dir:      dir,
+		data:     data,
+		size:     m.DataSize,
+		channels: make(map[string]*channelIndex),
+		dirty:    make(map[string]bool),
+		lastID:   -1,
+	}
+	if err := l.loadIndexes(m); err != nil {
+		data.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// loadIndexes cuts every index back to its size in m, removes indexes
+// created since, and loads what is kept in memory about each channel.
+func (l *Log) loadIndexes(m meta) error {
+	entries, err := os.ReadDir(filepath.Join(l.dir, indexDir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		channel, err := url.QueryUnescape(strings.TrimSuffix(name, ext))
+		if _, known := m.Indexes[channel]; err == nil && known && (ext == mainExt || ext == lateExt) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(l.dir, indexDir, name)); err != nil {
+			return err
+		}
+	}
+
+	for channel, size := range m.Indexes {
+		if err := truncateFile(l.indexPath(channel, mainExt), size.Main); err != nil {
+			return err
+		}
+		if err := truncateFile(l.indexPath(channel, lateExt), size.Late); err != nil {
+			return err
+		}
+
+		ci := &channelIndex{count: int(size.Main / entrySize), lastID: -1}
+		if ci.count > 0 {
+			last, err := l.readEntries(channel, ci.count-1, ci.count)
+			if err != nil {
+				return err
+			}
+			ci.lastID = last[0].id
+		}
+		late, err := os.ReadFile(l.indexPath(channel, lateExt))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		ci.late = decodeEntries(late)
+
+		l.channels[channel] = ci
+		if ci.lastID > l.lastID {
+			l.lastID = ci.lastID
+		}
+	}
+	return nil
+}
+
+// Append adds a record to channel's index. It reports false, and stores
+// nothing, if the channel already has a record with that ID.
+func (l *Log) Append(channel string, id int, payload []byte) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.data == nil {
+		return false, os.ErrClosed
+	}
+
+	ci := l.channels[channel]
+	if ci == nil {
+		ci = &channelIndex{lastID: -1}
+		l.channels[channel] = ci
+	}
+
+	ext := mainExt
+	if id <= ci.lastID {
+		_, found, err := l.findLocked(channel, ci, id)
+		if err != nil || found {
+			return false, err
+		}
+		ext = lateExt
+	}
+
+	if _, err := l.data.WriteAt(payload, l.size); err != nil {
+		return false, err
+	}
+	e := entry{id: id, offset: l.size, length: len(payload)}
+	l.size += int64(len(payload))
+
+	index, err := os.OpenFile(l.indexPath(channel, ext), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer index.Close()
+	if _, err := index.Write(encodeEntry(e)); err != nil {
+		return false, err
+	}
+
+	if ext == lateExt {
+		ci.late = append(ci.late, e)
+	} else {
+		ci.count++
+		ci.lastID = id
+	}
+	if id > l.lastID {
+		l.lastID = id
+	}
+	l.dirty[channel] = true
+	return true, nil
+}
+
+// Get returns the payload of the record in channel with the given ID, if
+// there is one.
+func (l *Log) Get(channel string, id int) ([]byte, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ci := l.channels[channel]
+	if ci == nil {
+		return nil, false, nil
+	}
+	e, found, err := l.findLocked(channel, ci, id)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	payloads, err := l.readPayloadsLocked([]entry{e})
+	if err != nil {
+		return nil, false, err
+	}
+	return payloads[0], true, nil
+}
+
+// findLocked returns the entry for the record in channel with the given ID.
+func (l *Log) findLocked(channel string, ci *channelIndex, id int) (entry, bool, error) {
+	for _, e := range ci.late {
+		if e.id == id {
+			return e, true, nil
+		}
+	}
+	i, err := l.searchLocked(channel, ci, id)
+	if err != nil || i == ci.count {
+		return entry{}, false, err
+	}
+	found, err := l.readEntries(channel, i, i+1)
+	if err != nil || found[0].id != id {
+		return entry{}, false, err
+	}
+	return found[0], true, nil
+}
+
+// Before returns the payloads of the newest limit records in channel with an
+// ID below before, oldest first.
+func (l *Log) Before(channel string, before, limit int) ([][]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ci := l.channels[channel]
+	if ci == nil || limit <= 0 {
+		return nil, nil
+	}
+
+	end, err := l.searchLocked(channel, ci, before)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := l.readEntries(channel, max(0, end-limit), end)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range ci.late {
+		if e.id < before {
+			candidates = append(candidates, e)
+		}
+	}
+
+	sortEntries(candidates)
+	if len(candidates) > limit {
+		candidates = candidates[len(candidates)-limit:]
+	}
+	return l.readPayloadsLocked(candidates)
+}
+
+// After returns the payloads of the oldest limit records in channel with an
+// ID above after, oldest first.
+func (l *Log) After(channel string, after, limit int) ([][]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ci := l.channels[channel]
+	if ci == nil || limit <= 0 {
+		return nil, nil
+	}
+
+	start, err := l.searchLocked(channel, ci, after+1)
+	if err != nil {
+		return nil, err
+	}
+	candidates, err := l.readEntries(channel, start, min(ci.count, start+limit))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range ci.late {
+		if e.id > after {
+			candidates = append(candidates, e)
+		}
+	}
+
+	sortEntries(candidates)
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	return l.readPayloadsLocked(candidates)
+}
+
+// Count returns how many records in channel have an ID above after.
+func (l *Log) Count(channel string, after int) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ci := l.channels[channel]
+	if ci == nil {
+		return 0, nil
+	}
+
+	start, err := l.searchLocked(channel, ci, after+1)
+	if err != nil {
+		return 0, err
+	}
+	count := ci.count - start
+	for _, e := range ci.late {
+		if e.id > after {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Len returns the number of records in the archive.
+func (l *Log) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, ci := range l.channels {
+		n += ci.count + len(ci.late)
+	}
+	return n
+}
+
+// Channels returns the channels that have records, sorted.
+func (l *Log) Channels() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	channels := make([]string, 0, len(l.channels))
+	for channel := range l.channels {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// LastID returns the highest ID in the archive, or -1 if it is empty.
+func (l *Log) LastID() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastID
+}
+
+// Sync makes every record appended so far durable. Open rolls the archive
+// back to the last Sync.
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.data == nil {
+		return os.ErrClosed
+	}
+	return l.syncLocked()
+}
+
+func (l *Log) syncLocked() error {
+	if err := l.data.Sync(); err != nil {
+		return err
+	}
+	for channel := range l.dirty {
+		for _, ext := range []string{mainExt, lateExt} {
+			if err := syncFile(l.indexPath(channel, ext)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := wal.SyncDir(filepath.Join(l.dir, indexDir)); err != nil {
+		return err
+	}
+
+	m := meta{DataSize: l.size, Indexes: make(map[string]indexSize, len(l.channels))}
+	for channel, ci := range l.channels {
+		m.Indexes[channel] = indexSize{
+			Main: int64(ci.count) * entrySize,
+			Late: int64(len(ci.late)) * entrySize,
+		}
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	metaPath := filepath.Join(l.dir, metaFile)
+	tempPath := metaPath + ".tmp"
+	if err := os.WriteFile(tempPath, raw, 0644); err != nil {
+		return err
+	}
+	if err := syncFile(tempPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, metaPath); err != nil {
+		return err
+	}
+	if err := wal.SyncDir(l.dir); err != nil {
+		return err
+	}
+
+	l.dirty = make(map[string]bool)
+	return nil
+}
+
+// Close syncs and closes the archive.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.data == nil {
+		return nil
+	}
+	err := l.syncLocked()
+	if cerr := l.data.Close(); err == nil {
+		err = cerr
+	}
+	l.data = nil
+	return err
+}
+
+// searchLocked returns the position of the first entry in channel's main
+// index with an ID of at least id.
+func (l *Log) searchLocked(channel string, ci *channelIndex, id int) (int, error) {
+	if ci.count == 0 || id > ci.lastID {
+		return ci.count, nil
+	}
+
+	index, err := os.Open(l.indexPath(channel, mainExt))
+	if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+
+	var searchErr error
+	buf := make([]byte, entrySize)
+	i := sort.Search(ci.count, func(i int) bool {
+		if _, err := index.ReadAt(buf, int64(i)*entrySize); err != nil {
+			searchErr = err
+			return true
+		}
+		return decodeEntry(buf).id >= id
+	})
+	return i, searchErr
+}
+
+// readEntries reads entries [from, to) of channel's main index.
+func (l *Log) readEntries(channel string, from, to int) ([]entry, error) {
+	if from >= to {
+		return nil, nil
+	}
+
+	index, err := os.Open(l.indexPath(channel, mainExt))
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	buf := make([]byte, (to-from)*entrySize)
+	if _, err := index.ReadAt(buf, int64(from)*entrySize); err != nil {
+		return nil, err
+	}
+	return decodeEntries(buf), nil
+}
+
+func (l *Log) readPayloadsLocked(entries []entry) ([][]byte, error) {
+	payloads := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		payload := make([]byte, e.length)
+		if _, err := l.data.ReadAt(payload, e.offset); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("history: record %d is past the end of the data file", e.id)
+			}
+			return nil, err
+		}
+		payloads = append(payloads, payload)
+	}
+	return payloads, nil
+}
+
+func (l *Log) indexPath(channel, ext string) string {
+	return filepath.Join(l.dir, indexDir, url.QueryEscape(channel)+ext)
+}
+
+func encodeEntry(e entry) []byte {
+	buf := make([]byte, entrySize)
+	binary.BigEndian.PutUint64(buf, uint64(e.id))
+	binary.BigEndian.PutUint64(buf[8:], uint64(e.offset))
+	binary.BigEndian.PutUint32(buf[16:], uint32(e.length))
+	return buf
+}
+
+func decodeEntry(buf []byte) entry {
+	return entry{
+		id:     int(binary.BigEndian.Uint64(buf)),
+		offset: int64(binary.BigEndian.Uint64(buf[8:])),
+		length: int(binary.BigEndian.Uint32(buf[16:])),
+	}
+}
+
+func decodeEntries(buf []byte) []entry {
+	entries := make([]entry, 0, len(buf)/entrySize)
+	for len(buf) >= entrySize {
+		entries = append(entries, decodeEntry(buf))
+		buf = buf[entrySize:]
+	}
+	return entries
+}
+
+func sortEntries(entries []entry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+}
+
+// truncateFile cuts the file at path to size, if it exists.
+func truncateFile(path string, size int64) error {
+	err := os.Truncate(path, size)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// syncFile flushes the file at path to disk, if it exists.
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,119 @@
+package history
+
+import (
+	"fmt"
+	"testing"
+)
+
+func openLog(t *testing.T, dir string) *Log {
+	t.Helper()
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func appendIDs(t *testing.T, l *Log, channel string, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		if _, err := l.Append(channel, id, []byte(fmt.Sprint(id))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// list renders the payloads read back, or the error reading them.
+func list(payloads [][]byte, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	var ids []string
+	for _, p := range payloads {
+		ids = append(ids, string(p))
+	}
+	return fmt.Sprint(ids)
+}
+
+func TestPaging(t *testing.T) {
+	l := openLog(t, t.TempDir())
+	appendIDs(t, l, "a", 1, 3, 5, 7, 9)
+	appendIDs(t, l, "b", 2, 4, 6)
+	// Late arrivals below the newest ID go to the late index
+	appendIDs(t, l, "a", 4, 8)
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"newest", list(l.Before("a", 1<<62, 3)), "[7 8 9]"},
+		{"before", list(l.Before("a", 7, 3)), "[3 4 5]"},
+		{"before start", list(l.Before("a", 2, 3)), "[1]"},
+		{"after", list(l.After("a", 3, 3)), "[4 5 7]"},
+		{"after end", list(l.After("a", 9, 3)), "[]"},
+		{"other channel", list(l.Before("b", 1<<62, 10)), "[2 4 6]"},
+		{"unknown channel", list(l.After("c", -1, 10)), "[]"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+
+	if n, _ := l.Count("a", 4); n != 4 {
+		t.Errorf("Count after 4 = %d, want 4", n)
+	}
+	if l.Len() != 10 || l.LastID() != 9 {
+		t.Errorf("Len %d LastID %d, want 10 and 9", l.Len(), l.LastID())
+	}
+}
+
+func TestDuplicatesAreIgnored(t *testing.T) {
+	l := openLog(t, t.TempDir())
+	appendIDs(t, l, "a", 1, 2, 3)
+	appendIDs(t, l, "a", 0)
+
+	for _, id := range []int{0, 1, 2, 3} {
+		added, err := l.Append("a", id, []byte("again"))
+		if err != nil || added {
+			t.Fatalf("Append of stored ID %d: added %v, err %v", id, added, err)
+		}
+	}
+	if got := list(l.After("a", -1, 10)); got != "[0 1 2 3]" {
+		t.Fatalf("got %s", got)
+	}
+}
+
+func TestOpenRollsBackToSync(t *testing.T) {
+	dir := t.TempDir()
+
+	l, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendIDs(t, l, "a", 1, 2)
+	appendIDs(t, l, "b", 3)
+	if err := l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	// Never synced, as if the process crashed
+	appendIDs(t, l, "a", 4, 0)
+	appendIDs(t, l, "c", 5)
+	l.data.Close()
+
+	l = openLog(t, dir)
+	if got := list(l.After("a", -1, 10)); got != "[1 2]" {
+		t.Fatalf("a after reopening: %s", got)
+	}
+	if fmt.Sprint(l.Channels()) != "[a b]" || l.LastID() != 3 {
+		t.Fatalf("channels %v, last ID %d", l.Channels(), l.LastID())
+	}
+
+	// Appending carries on where the synced data ended
+	appendIDs(t, l, "a", 4)
+	if got := list(l.Before("a", 10, 10)); got != "[1 2 4]" {
+		t.Fatalf("a after appending: %s", got)
+	}
+}
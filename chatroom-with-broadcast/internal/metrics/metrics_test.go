@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	messages := r.Counter("messages_total", "Messages sent.", "channel")
+	errors := r.Counter("errors_total", "Errors.")
+	size := r.Gauge("size_bytes", "Size of the last one.")
+	r.GaugeFunc("clients", "Connected clients.", func() float64 { return 3 })
+	latency := r.Histogram("latency_seconds", "How long it took.", []float64{0.1, 0.01, 1})
+
+	messages.Inc("#global")
+	messages.Add(2, `say "hi"`)
+	messages.Inc("#global")
+	size.Set(1.5)
+	for _, v := range []float64{0.005, 0.01, 0.5, 2} {
+		latency.Observe(v)
+	}
+
+	var b strings.Builder
+	r.Write(&b)
+	want := `# HELP messages_total Messages sent.
+# TYPE messages_total counter
+messages_total{channel="#global"} 2
+messages_total{channel="say \"hi\""} 2
+# HELP errors_total Errors.
+# TYPE errors_total counter
+errors_total 0
+# HELP size_bytes Size of the last one.
+# TYPE size_bytes gauge
+size_bytes 1.5
+# HELP clients Connected clients.
+# TYPE clients gauge
+clients 3
+# HELP latency_seconds How long it took.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.01"} 2
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.515
+latency_seconds_count 4
+`
+	if got := b.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if messages.Value("#global") != 2 || errors.Value() != 0 || latency.Count() != 4 {
+		t.Fatal("values don't match the output")
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+	if w.Body.String() != want {
+		t.Fatal("ServeHTTP wrote something else")
+	}
+}
+
+func TestLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("a missing label value was accepted")
+		}
+	}()
+	NewRegistry().Counter("x_total", "X.", "reason").Inc()
+}
@@ -0,0 +1,635 @@
+// Package raft is a small implementation of the Raft consensus algorithm -
+// leader election, log replication and snapshots - for replicating a log of
+// opaque commands between a handful of nodes.
+//
+// Every node runs the same StateMachine. Propose appends a command to the
+// leader's log (forwarding it from followers) and returns once a majority of
+// nodes have stored it; each node then applies committed commands in log
+// order.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader = errors.New("raft: not the leader")
+	ErrNoLeader  = errors.New("raft: no leader elected")
+	ErrTimeout   = errors.New("raft: proposal timed out")
+	ErrLost      = errors.New("raft: proposal lost to a new leader")
+	ErrStopped   = errors.New("raft: node stopped")
+)
+
+// StateMachine is the state replicated by the log.
+type StateMachine interface {
+	// Apply applies a committed command. Commands are applied in log order,
+	// one at a time.
+	Apply(data []byte)
+	// Snapshot returns the state after the last applied command. It must be
+	// valid JSON.
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot.
+	Restore(data []byte) error
+}
+
+// Config configures a Node.
+type Config struct {
+	ID           int
+	Peers        []int // IDs of every node in the cluster, including ID
+	Transport    Transport
+	Storage      *Storage
+	StateMachine StateMachine
+
+	ElectionTimeout   time.Duration // followers wait between this and twice this for a leader
+	HeartbeatInterval time.Duration
+	ProposeTimeout    time.Duration
+	// SnapshotThreshold is how many applied entries are kept in the log
+	// before it is compacted into a snapshot.
+	SnapshotThreshold int
+}
+
+const defaultProposeTimeout = 5 * time.Second
+
+func (c *Config) setDefaults() {
+	if c.ElectionTimeout == 0 {
+		c.ElectionTimeout = 300 * time.Millisecond
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if c.ProposeTimeout == 0 {
+		c.ProposeTimeout = defaultProposeTimeout
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = 1000
+	}
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	default:
+		return "follower"
+	}
+}
+
+// maxBatch caps the entries sent in one AppendEntries call.
+const maxBatch = 256
+
+// Node is one member of a Raft cluster.
+type Node struct {
+	cfg Config
+
+	mu       sync.Mutex
+	role     role
+	term     int
+	votedFor int // -1 if none this term
+	leader   int // -1 if unknown
+
+	// log[0] holds the index and term of the last entry covered by the
+	// snapshot (0 and 0 without one); the real entries follow it.
+	log  []Entry
+	snap Snapshot
+
+	commitIndex int
+	lastApplied int
+
+	// Leader state
+	nextIndex  map[int]int
+	matchIndex map[int]int
+	inflight   map[int]bool // an AppendEntries or InstallSnapshot is outstanding
+
+	electionDeadline time.Time
+	nextHeartbeat    time.Time
+
+	waiters map[int]waiter // proposals waiting to be applied, by index
+
+	// applyMu is held while the state machine is being changed, so applying
+	// entries and installing snapshots never overlap.
+	applyMu    sync.Mutex
+	applyReady chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type waiter struct {
+	term int
+	done chan error
+}
+
+// NewNode loads the node's persisted state, restores the state machine from
+// the latest snapshot and starts the node as a follower.
+func NewNode(cfg Config) (*Node, error) {
+	cfg.setDefaults()
+
+	n := &Node{
+		cfg:        cfg,
+		leader:     -1,
+		nextIndex:  make(map[int]int),
+		matchIndex: make(map[int]int),
+		inflight:   make(map[int]bool),
+		waiters:    make(map[int]waiter),
+		applyReady: make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+
+	var err error
+	if n.term, n.votedFor, err = cfg.Storage.LoadState(); err != nil {
+		return nil, fmt.Errorf("load state: %w", err)
+	}
+
+	snap, found, err := cfg.Storage.LoadSnapshot()
+	if err != nil {
+		return nil, fmt.Errorf("load snapshot: %w", err)
+	}
+	if found {
+		if err := cfg.StateMachine.Restore(snap.Data); err != nil {
+			return nil, fmt.Errorf("restore snapshot: %w", err)
+		}
+		n.snap = snap
+		n.commitIndex = snap.LastIndex
+		n.lastApplied = snap.LastIndex
+	}
+
+	entries, err := cfg.Storage.LoadLog()
+	if err != nil {
+		return nil, fmt.Errorf("load log: %w", err)
+	}
+	n.log = []Entry{{Index: snap.LastIndex, Term: snap.LastTerm}}
+	for _, e := range entries {
+		if e.Index > snap.LastIndex {
+			n.log = append(n.log, e)
+		}
+	}
+
+	n.resetElectionTimerLocked()
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// Stop stops the node's background work. Pending proposals fail.
+func (n *Node) Stop() {
+	n.stopOnce.Do(func() { close(n.stop) })
+}
+
+// Status describes a node's view of the cluster.
+type Status struct {
+	ID          int    `json:"id"`
+	Role        string `json:"role"`
+	Term        int    `json:"term"`
+	Leader      int    `json:"leader"` // -1 if unknown
+	CommitIndex int    `json:"commit_index"`
+	LastApplied int    `json:"last_applied"`
+	LastIndex   int    `json:"last_index"`
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:          n.cfg.ID,
+		Role:        n.role.String(),
+		Term:        n.term,
+		Leader:      n.leader,
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+		LastIndex:   n.lastIndexLocked(),
+	}
+}
+
+// Propose replicates data and returns once a majority of nodes have stored
+// it. A follower forwards the proposal to the leader.
+func (n *Node) Propose(data []byte) error {
+	if len(data) == 0 {
+		return errors.New("raft: empty proposal")
+	}
+
+	err := n.proposeLocal(data)
+	if err != ErrNotLeader {
+		return err
+	}
+
+	n.mu.Lock()
+	leader := n.leader
+	n.mu.Unlock()
+	if leader < 0 || leader == n.cfg.ID {
+		return ErrNoLeader
+	}
+	return n.cfg.Transport.Forward(leader, data)
+}
+
+// proposeLocal appends data to the log if this node is the leader and waits
+// for it to commit.
+func (n *Node) proposeLocal(data []byte) error {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+
+	entry := Entry{Index: n.lastIndexLocked() + 1, Term: n.term, Data: data}
+	if err := n.cfg.Storage.Append([]Entry{entry}); err != nil {
+		n.mu.Unlock()
+		return fmt.Errorf("raft: persist entry: %w", err)
+	}
+	n.log = append(n.log, entry)
+
+	w := waiter{term: entry.Term, done: make(chan error, 1)}
+	n.waiters[entry.Index] = w
+	n.replicateAllLocked()
+	n.advanceCommitLocked() // a single node commits on its own
+	n.mu.Unlock()
+
+	timeout := time.NewTimer(n.cfg.ProposeTimeout)
+	defer timeout.Stop()
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-timeout.C:
+		n.mu.Lock()
+		delete(n.waiters, entry.Index)
+		n.mu.Unlock()
+		return ErrTimeout
+	case <-n.stop:
+		return ErrStopped
+	}
+}
+
+// run drives elections and heartbeats.
+func (n *Node) run() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mu.Lock()
+		now := time.Now()
+		switch {
+		case n.role == leader && !now.Before(n.nextHeartbeat):
+			n.nextHeartbeat = now.Add(n.cfg.HeartbeatInterval)
+			n.replicateAllLocked()
+		case n.role != leader && now.After(n.electionDeadline):
+			n.startElectionLocked()
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) resetElectionTimerLocked() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) startElectionLocked() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = -1
+	n.persistStateLocked()
+	n.resetElectionTimerLocked()
+
+	term := n.term
+	args := &RequestVoteArgs{
+		Term:         term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndexLocked(),
+		LastLogTerm:  n.lastTermLocked(),
+	}
+
+	votes := 1
+	if votes > len(n.cfg.Peers)/2 {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	for _, peer := range n.cfg.Peers {
+		if peer == n.cfg.ID {
+			continue
+		}
+		go func(peer int) {
+			reply, err := n.cfg.Transport.RequestVote(peer, args)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if reply.Term > n.term {
+				n.stepDownLocked(reply.Term)
+				return
+			}
+			if n.role != candidate || n.term != term || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes > len(n.cfg.Peers)/2 {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+func (n *Node) becomeLeaderLocked() {
+	n.role = leader
+	n.leader = n.cfg.ID
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndexLocked() + 1
+		n.matchIndex[peer] = 0
+	}
+
+	// Entries from earlier terms can only be committed together with one
+	// from the current term, so start the term with a no-op.
+	noop := Entry{Index: n.lastIndexLocked() + 1, Term: n.term}
+	if err := n.cfg.Storage.Append([]Entry{noop}); err != nil {
+		// A leader that can't persist its own log can't lead
+		fmt.Printf("raft %d: persist entry: %v; stepping down\n", n.cfg.ID, err)
+		n.stepDownLocked(n.term)
+		return
+	}
+	n.log = append(n.log, noop)
+
+	fmt.Printf("raft %d: leader for term %d\n", n.cfg.ID, n.term)
+	n.nextHeartbeat = time.Now().Add(n.cfg.HeartbeatInterval)
+	n.replicateAllLocked()
+	n.advanceCommitLocked()
+}
+
+// stepDownLocked becomes a follower, moving to term if it is newer.
+func (n *Node) stepDownLocked(term int) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = -1
+		n.persistStateLocked()
+	}
+	if n.role == leader {
+		n.leader = -1
+	}
+	n.role = follower
+}
+
+func (n *Node) persistStateLocked() {
+	if err := n.cfg.Storage.SaveState(n.term, n.votedFor); err != nil {
+		fmt.Printf("raft %d: persist state: %v\n", n.cfg.ID, err)
+	}
+}
+
+func (n *Node) replicateAllLocked() {
+	for _, peer := range n.cfg.Peers {
+		if peer != n.cfg.ID {
+			n.replicateLocked(peer)
+		}
+	}
+}
+
+// replicateLocked sends peer the entries it is missing, or the snapshot if
+// they have been compacted away. At most one call per peer is in flight.
+func (n *Node) replicateLocked(peer int) {
+	if n.inflight[peer] {
+		return
+	}
+	n.inflight[peer] = true
+
+	next := n.nextIndex[peer]
+	if next <= n.log[0].Index {
+		args := &InstallSnapshotArgs{Term: n.term, LeaderID: n.cfg.ID, Snapshot: n.snap}
+		go n.sendSnapshot(peer, args)
+		return
+	}
+
+	prevTerm, _ := n.termAtLocked(next - 1)
+	entries := n.log[next-n.log[0].Index:]
+	if len(entries) > maxBatch {
+		entries = entries[:maxBatch]
+	}
+	args := &AppendEntriesArgs{
+		Term:         n.term,
+		LeaderID:     n.cfg.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  prevTerm,
+		Entries:      append([]Entry(nil), entries...),
+		LeaderCommit: n.commitIndex,
+	}
+	go n.sendAppend(peer, args)
+}
+
+func (n *Node) sendAppend(peer int, args *AppendEntriesArgs) {
+	reply, err := n.cfg.Transport.AppendEntries(peer, args)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[peer] = false
+	if err != nil {
+		return // retried on the next heartbeat
+	}
+	if reply.Term > n.term {
+		n.stepDownLocked(reply.Term)
+		return
+	}
+	if n.role != leader || n.term != args.Term {
+		return
+	}
+
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		if match+1 > n.nextIndex[peer] {
+			n.nextIndex[peer] = match + 1
+		}
+		n.advanceCommitLocked()
+	} else {
+		n.nextIndex[peer] = min(max(reply.ConflictIndex, 1), n.lastIndexLocked()+1)
+	}
+
+	if n.nextIndex[peer] <= n.lastIndexLocked() {
+		n.replicateLocked(peer)
+	}
+}
+
+func (n *Node) sendSnapshot(peer int, args *InstallSnapshotArgs) {
+	reply, err := n.cfg.Transport.InstallSnapshot(peer, args)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[peer] = false
+	if err != nil {
+		return
+	}
+	if reply.Term > n.term {
+		n.stepDownLocked(reply.Term)
+		return
+	}
+	if n.role != leader || n.term != args.Term {
+		return
+	}
+
+	last := args.Snapshot.LastIndex
+	if last > n.matchIndex[peer] {
+		n.matchIndex[peer] = last
+	}
+	n.nextIndex[peer] = last + 1
+	n.replicateLocked(peer)
+}
+
+// advanceCommitLocked commits the newest entry of the current term stored
+// on a majority of nodes, and everything before it.
+func (n *Node) advanceCommitLocked() {
+	for index := n.lastIndexLocked(); index > n.commitIndex; index-- {
+		if term, _ := n.termAtLocked(index); term != n.term {
+			return
+		}
+
+		count := 1
+		for _, peer := range n.cfg.Peers {
+			if peer != n.cfg.ID && n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count > len(n.cfg.Peers)/2 {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.applyReady <- struct{}{}:
+	default:
+	}
+}
+
+// applyLoop applies committed entries in order and compacts the log.
+func (n *Node) applyLoop() {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyReady:
+		}
+		for n.applyCommitted() {
+		}
+	}
+}
+
+// applyCommitted applies the entries committed since the last call and
+// reports whether there were any.
+func (n *Node) applyCommitted() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	if n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	base := n.log[0].Index
+	entries := append([]Entry(nil), n.log[n.lastApplied+1-base:n.commitIndex+1-base]...)
+	n.mu.Unlock()
+
+	for _, e := range entries {
+		if e.Data != nil {
+			n.cfg.StateMachine.Apply(e.Data)
+		}
+
+		n.mu.Lock()
+		n.lastApplied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term == e.Term {
+				w.done <- nil
+			} else {
+				w.done <- ErrLost
+			}
+		}
+		n.mu.Unlock()
+	}
+
+	n.maybeSnapshot()
+	return true
+}
+
+// maybeSnapshot compacts the log once enough entries have been applied.
+// Callers must hold applyMu, so the state machine matches lastApplied.
+func (n *Node) maybeSnapshot() {
+	n.mu.Lock()
+	applied := n.lastApplied
+	due := applied-n.log[0].Index >= n.cfg.SnapshotThreshold
+	n.mu.Unlock()
+	if !due {
+		return
+	}
+
+	data, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		fmt.Printf("raft %d: snapshot: %v\n", n.cfg.ID, err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	term, _ := n.termAtLocked(applied)
+	snap := Snapshot{LastIndex: applied, LastTerm: term, Data: data}
+	if err := n.cfg.Storage.SaveSnapshot(snap); err != nil {
+		fmt.Printf("raft %d: save snapshot: %v\n", n.cfg.ID, err)
+		return
+	}
+	n.snap = snap
+	n.compactLocked(applied, term)
+	fmt.Printf("raft %d: compacted log up to index %d\n", n.cfg.ID, applied)
+}
+
+// compactLocked drops the entries up to and including index, keeping any
+// that follow it if the log agrees on index's term.
+func (n *Node) compactLocked(index, term int) {
+	var rest []Entry
+	if t, ok := n.termAtLocked(index); ok && t == term {
+		rest = n.log[index-n.log[0].Index+1:]
+	}
+	n.log = append([]Entry{{Index: index, Term: term}}, rest...)
+
+	if err := n.cfg.Storage.RewriteLog(n.log[1:]); err != nil {
+		fmt.Printf("raft %d: rewrite log: %v\n", n.cfg.ID, err)
+	}
+}
+
+// ==
+
+func (n *Node) lastIndexLocked() int { return n.log[len(n.log)-1].Index }
+func (n *Node) lastTermLocked() int  { return n.log[len(n.log)-1].Term }
+
+// termAtLocked returns the term of the entry at index, if the log still
+// covers it.
+func (n *Node) termAtLocked(index int) (int, bool) {
+	base := n.log[0].Index
+	if index < base || index > n.lastIndexLocked() {
+		return 0, false
+	}
+	return n.log[index-base].Term, true
+}
@@ -0,0 +1,271 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listMachine is a state machine that records the commands it applies.
+type listMachine struct {
+	mu    sync.Mutex
+	items []string
+}
+
+func (m *listMachine) Apply(data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items = append(m.items, string(data))
+}
+
+func (m *listMachine) Snapshot() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.Marshal(m.items)
+}
+
+func (m *listMachine) Restore(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items = nil
+	return json.Unmarshal(data, &m.items)
+}
+
+func (m *listMachine) list() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fmt.Sprint(m.items)
+}
+
+type testCluster struct {
+	network  *MemoryNetwork
+	nodes    map[int]*Node
+	machines map[int]*listMachine
+}
+
+func newTestCluster(t *testing.T, size, snapshotThreshold int) *testCluster {
+	t.Helper()
+
+	c := &testCluster{
+		network:  NewMemoryNetwork(),
+		nodes:    make(map[int]*Node),
+		machines: make(map[int]*listMachine),
+	}
+
+	var peers []int
+	for id := 1; id <= size; id++ {
+		peers = append(peers, id)
+	}
+
+	for _, id := range peers {
+		storage, err := OpenStorage(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { storage.Close() })
+
+		machine := &listMachine{}
+		node, err := NewNode(Config{
+			ID:                id,
+			Peers:             peers,
+			Transport:         c.network.Transport(id),
+			Storage:           storage,
+			StateMachine:      machine,
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 20 * time.Millisecond,
+			ProposeTimeout:    500 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(node.Stop)
+
+		c.network.Register(id, node)
+		c.nodes[id] = node
+		c.machines[id] = machine
+	}
+	return c
+}
+
+// waitForLeader returns the ID of the leader the connected nodes agree on.
+func (c *testCluster) waitForLeader(t *testing.T, except int) int {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := make(map[int]bool)
+		for id, node := range c.nodes {
+			if id != except {
+				leaders[node.Status().Leader] = true
+			}
+		}
+		for leader := range leaders {
+			if len(leaders) == 1 && leader != -1 && leader != except && c.nodes[leader].Status().Role == "leader" {
+				return leader
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return -1
+}
+
+// waitForState waits until every node in ids has applied exactly want.
+func (c *testCluster) waitForState(t *testing.T, want string, ids ...int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, id := range ids {
+		for c.machines[id].list() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d has %s, want %s", id, c.machines[id].list(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestReplicationThroughFollower(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	leader := c.waitForLeader(t, -1)
+
+	follower := leader%3 + 1
+	for _, item := range []string{"a", "b", "c"} {
+		if err := c.nodes[follower].Propose([]byte(item)); err != nil {
+			t.Fatalf("propose %s via follower: %v", item, err)
+		}
+	}
+
+	c.waitForState(t, "[a b c]", 1, 2, 3)
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newTestCluster(t, 3, 0)
+	old := c.waitForLeader(t, -1)
+
+	if err := c.nodes[old].Propose([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForState(t, "[before]", 1, 2, 3)
+
+	c.network.Disconnect(old)
+	leader := c.waitForLeader(t, old)
+	if err := c.nodes[leader].Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader can't commit anything on its own
+	if err := c.nodes[old].Propose([]byte("lost")); err == nil {
+		t.Fatal("isolated leader committed a proposal")
+	}
+
+	c.network.Reconnect(old)
+	c.waitForState(t, "[before after]", 1, 2, 3)
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	c := newTestCluster(t, 3, 5)
+	leader := c.waitForLeader(t, -1)
+
+	lagging := leader%3 + 1
+	c.network.Disconnect(lagging)
+
+	var want []string
+	for i := 0; i < 12; i++ {
+		item := fmt.Sprint(i)
+		if err := c.nodes[leader].Propose([]byte(item)); err != nil {
+			t.Fatalf("propose %s: %v", item, err)
+		}
+		want = append(want, item)
+	}
+	if status := c.nodes[leader].Status(); status.CommitIndex < 12 {
+		t.Fatalf("leader commit index %d, want at least 12", status.CommitIndex)
+	}
+
+	// The leader has compacted the entries away, so the lagging node can
+	// only catch up from the snapshot
+	c.network.Reconnect(lagging)
+	c.waitForState(t, fmt.Sprint(want), 1, 2, 3)
+}
+
+// slowLeader is a Handler that takes commitDelay to commit forwarded data.
+type slowLeader struct{ commitDelay time.Duration }
+
+func (h slowLeader) HandleRequestVote(*RequestVoteArgs) *RequestVoteReply { return &RequestVoteReply{} }
+func (h slowLeader) HandleAppendEntries(*AppendEntriesArgs) *AppendEntriesReply {
+	return &AppendEntriesReply{}
+}
+func (h slowLeader) HandleInstallSnapshot(*InstallSnapshotArgs) *InstallSnapshotReply {
+	return &InstallSnapshotReply{}
+}
+func (h slowLeader) HandleForward([]byte) error {
+	time.Sleep(h.commitDelay)
+	return nil
+}
+
+func TestForwardWaitsForSlowCommits(t *testing.T) {
+	defer func(rpc, forward time.Duration) { rpcTimeout, forwardTimeout = rpc, forward }(rpcTimeout, forwardTimeout)
+	rpcTimeout, forwardTimeout = 100*time.Millisecond, 400*time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go Serve(listener, slowLeader{commitDelay: 200 * time.Millisecond})
+
+	transport := NewTCPTransport(map[int]string{1: listener.Addr().String()})
+	if _, err := transport.AppendEntries(1, &AppendEntriesArgs{}); err != nil {
+		t.Fatal(err)
+	}
+	client := transport.clients[1]
+
+	if err := transport.Forward(1, []byte("slow")); err != nil {
+		t.Fatalf("a commit slower than an RPC but within the propose timeout failed: %v", err)
+	}
+
+	forwardTimeout = 50 * time.Millisecond
+	if err := transport.Forward(1, []byte("slower")); err == nil {
+		t.Fatal("Forward didn't time out")
+	}
+	if transport.clients[1] != client {
+		t.Fatal("a slow commit dropped the connection")
+	}
+}
+
+func TestLeaderStepsDownWhenItCantPersist(t *testing.T) {
+	storage, err := OpenStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Close() // every append fails
+
+	node, err := NewNode(Config{
+		ID:                1,
+		Peers:             []int{1},
+		Transport:         NewMemoryNetwork().Transport(1),
+		Storage:           storage,
+		StateMachine:      &listMachine{},
+		ElectionTimeout:   20 * time.Millisecond,
+		HeartbeatInterval: 5 * time.Millisecond,
+		ProposeTimeout:    100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Stop()
+
+	time.Sleep(200 * time.Millisecond) // several elections
+	if err := node.Propose([]byte("lost")); err == nil {
+		t.Fatal("a node that can't persist its log committed a proposal")
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if last := node.lastIndexLocked(); last != 0 {
+		t.Fatalf("log reaches index %d, but nothing was persisted", last)
+	}
+}
@@ -0,0 +1,215 @@
+package raft
+
+import "fmt"
+
+// Entry is one command in the log.
+type Entry struct {
+	Index int    `json:"index"`
+	Term  int    `json:"term"`
+	Data  []byte `json:"data,omitempty"` // nil for the no-op a new leader appends
+}
+
+// Snapshot is the state machine's state after the entry at LastIndex.
+type Snapshot struct {
+	LastIndex int    `json:"last_index"`
+	LastTerm  int    `json:"last_term"`
+	Data      []byte `json:"data"`
+}
+
+type RequestVoteArgs struct {
+	Term         int
+	CandidateID  int
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term        int
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	LeaderID     int
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []Entry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    int
+	Success bool
+	// ConflictIndex is where the leader should retry from after a failure,
+	// skipping a whole conflicting term at a time.
+	ConflictIndex int
+}
+
+type InstallSnapshotArgs struct {
+	Term     int
+	LeaderID int
+	Snapshot Snapshot
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+// Transport carries RPCs from a node to its peers.
+type Transport interface {
+	RequestVote(peer int, args *RequestVoteArgs) (*RequestVoteReply, error)
+	AppendEntries(peer int, args *AppendEntriesArgs) (*AppendEntriesReply, error)
+	InstallSnapshot(peer int, args *InstallSnapshotArgs) (*InstallSnapshotReply, error)
+	// Forward proposes data on peer, which must be the leader.
+	Forward(peer int, data []byte) error
+}
+
+// Handler answers RPCs from peers. *Node implements it.
+type Handler interface {
+	HandleRequestVote(args *RequestVoteArgs) *RequestVoteReply
+	HandleAppendEntries(args *AppendEntriesArgs) *AppendEntriesReply
+	HandleInstallSnapshot(args *InstallSnapshotArgs) *InstallSnapshotReply
+	HandleForward(data []byte) error
+}
+
+func (n *Node) HandleRequestVote(args *RequestVoteArgs) *RequestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if args.Term > n.term {
+		n.stepDownLocked(args.Term)
+	}
+	reply := &RequestVoteReply{Term: n.term}
+	if args.Term < n.term {
+		return reply
+	}
+
+	upToDate := args.LastLogTerm > n.lastTermLocked() ||
+		(args.LastLogTerm == n.lastTermLocked() && args.LastLogIndex >= n.lastIndexLocked())
+	if (n.votedFor == -1 || n.votedFor == args.CandidateID) && upToDate {
+		n.votedFor = args.CandidateID
+		n.persistStateLocked()
+		n.resetElectionTimerLocked()
+		reply.VoteGranted = true
+	}
+	return reply
+}
+
+func (n *Node) HandleAppendEntries(args *AppendEntriesArgs) *AppendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply := &AppendEntriesReply{Term: n.term}
+	if args.Term < n.term {
+		return reply
+	}
+	if args.Term > n.term || n.role != follower {
+		n.stepDownLocked(args.Term)
+	}
+	n.leader = args.LeaderID
+	n.resetElectionTimerLocked()
+	reply.Term = n.term
+
+	base := n.log[0].Index
+	prev, entries := args.PrevLogIndex, args.Entries
+	if prev < base {
+		// Everything up to the snapshot is committed, so it matches
+		skip := base - prev
+		if skip > len(entries) {
+			skip = len(entries)
+		}
+		entries = entries[skip:]
+		prev = base
+	} else {
+		if prev > n.lastIndexLocked() {
+			reply.ConflictIndex = n.lastIndexLocked() + 1
+			return reply
+		}
+		if term, _ := n.termAtLocked(prev); term != args.PrevLogTerm {
+			conflict := prev
+			for conflict > base+1 {
+				if t, _ := n.termAtLocked(conflict - 1); t != term {
+					break
+				}
+				conflict--
+			}
+			reply.ConflictIndex = conflict
+			return reply
+		}
+	}
+
+	for i, e := range entries {
+		if e.Index > n.lastIndexLocked() {
+			if err := n.cfg.Storage.Append(entries[i:]); err != nil {
+				fmt.Printf("raft %d: persist entries: %v\n", n.cfg.ID, err)
+				return reply
+			}
+			n.log = append(n.log, entries[i:]...)
+			break
+		}
+		if term, _ := n.termAtLocked(e.Index); term != e.Term {
+			// Drop the conflicting suffix and everything after it
+			n.log = append(n.log[:e.Index-base], entries[i:]...)
+			if err := n.cfg.Storage.RewriteLog(n.log[1:]); err != nil {
+				fmt.Printf("raft %d: rewrite log: %v\n", n.cfg.ID, err)
+				return reply
+			}
+			break
+		}
+	}
+
+	if commit := min(args.LeaderCommit, prev+len(entries)); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.signalApply()
+	}
+	reply.Success = true
+	return reply
+}
+
+func (n *Node) HandleInstallSnapshot(args *InstallSnapshotArgs) *InstallSnapshotReply {
+	n.mu.Lock()
+	if args.Term < n.term {
+		defer n.mu.Unlock()
+		return &InstallSnapshotReply{Term: n.term}
+	}
+	if args.Term > n.term || n.role != follower {
+		n.stepDownLocked(args.Term)
+	}
+	n.leader = args.LeaderID
+	n.resetElectionTimerLocked()
+	n.mu.Unlock()
+
+	// Replacing the state machine must not overlap with applying entries
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reply := &InstallSnapshotReply{Term: n.term}
+	snap := args.Snapshot
+	if snap.LastIndex <= n.lastApplied {
+		return reply
+	}
+
+	if err := n.cfg.Storage.SaveSnapshot(snap); err != nil {
+		fmt.Printf("raft %d: save snapshot: %v\n", n.cfg.ID, err)
+		return reply
+	}
+	if err := n.cfg.StateMachine.Restore(snap.Data); err != nil {
+		fmt.Printf("raft %d: restore snapshot: %v\n", n.cfg.ID, err)
+		return reply
+	}
+	n.snap = snap
+	n.compactLocked(snap.LastIndex, snap.LastTerm)
+	n.lastApplied = snap.LastIndex
+	if snap.LastIndex > n.commitIndex {
+		n.commitIndex = snap.LastIndex
+	}
+
+	fmt.Printf("raft %d: installed snapshot up to index %d\n", n.cfg.ID, snap.LastIndex)
+	return reply
+}
+
+func (n *Node) HandleForward(data []byte) error {
+	return n.proposeLocal(data)
+}
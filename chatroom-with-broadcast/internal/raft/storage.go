@@ -0,0 +1,187 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Storage keeps a node's term, vote, log and snapshot in a directory:
+//
+//	state.json     current term and vote
+//	log.jsonl      one entry per line, appended and synced
+//	snapshot.json  the latest snapshot
+type Storage struct {
+	dir string
+	log *os.File
+}
+
+type persistentState struct {
+	Term     int `json:"term"`
+	VotedFor int `json:"voted_for"`
+}
+
+// OpenStorage opens (creating if needed) the storage in dir.
+func OpenStorage(dir string) (*Storage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{dir: dir, log: log}, nil
+}
+
+// Close closes the log file.
+func (s *Storage) Close() error {
+	return s.log.Close()
+}
+
+func (s *Storage) LoadState() (term, votedFor int, err error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, "state.json"))
+	if os.IsNotExist(err) {
+		return 0, -1, nil
+	}
+	if err != nil {
+		return 0, -1, err
+	}
+
+	var state persistentState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, -1, err
+	}
+	return state.Term, state.VotedFor, nil
+}
+
+func (s *Storage) SaveState(term, votedFor int) error {
+	data, err := json.Marshal(persistentState{Term: term, VotedFor: votedFor})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, "state.json"), data)
+}
+
+// LoadLog returns the stored entries. A torn last line, left by a crash in
+// the middle of an append, is ignored.
+func (s *Storage) LoadLog() ([]Entry, error) {
+	file, err := os.Open(filepath.Join(s.dir, "log.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Append adds entries to the end of the log and syncs it.
+func (s *Storage) Append(entries []Entry) error {
+	var buf []byte
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+
+	if _, err := s.log.Write(buf); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// RewriteLog replaces the whole log with entries.
+func (s *Storage) RewriteLog(entries []Entry) error {
+	var buf []byte
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+
+	path := filepath.Join(s.dir, "log.jsonl")
+	if err := writeFileAtomic(path, buf); err != nil {
+		return err
+	}
+
+	s.log.Close()
+	log, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.log = log
+	return nil
+}
+
+// snapshotFile is the on-disk layout of snapshot.json. The state machine's
+// snapshot is embedded as JSON so the file stays readable.
+type snapshotFile struct {
+	LastIndex int             `json:"last_index"`
+	LastTerm  int             `json:"last_term"`
+	Data      json.RawMessage `json:"data"`
+}
+
+func (s *Storage) LoadSnapshot() (Snapshot, bool, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, "snapshot.json"))
+	if os.IsNotExist(err) {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return Snapshot{}, false, err
+	}
+	return Snapshot{LastIndex: file.LastIndex, LastTerm: file.LastTerm, Data: file.Data}, true, nil
+}
+
+func (s *Storage) SaveSnapshot(snap Snapshot) error {
+	if !json.Valid(snap.Data) {
+		return fmt.Errorf("snapshot data is not valid JSON")
+	}
+
+	data, err := json.Marshal(snapshotFile{LastIndex: snap.LastIndex, LastTerm: snap.LastTerm, Data: snap.Data})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, "snapshot.json"), data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + ".tmp"
+
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
@@ -0,0 +1,231 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// rpcTimeout bounds a single call to a peer. Forward waits for the leader
+// to commit, so it gets forwardTimeout: the leader's ProposeTimeout, by
+// default, and then some.
+var (
+	rpcTimeout     = 2 * time.Second
+	forwardTimeout = defaultProposeTimeout + rpcTimeout
+)
+
+var errUnreachable = errors.New("raft: peer unreachable")
+
+// TCPTransport sends RPCs to peers with net/rpc over TCP.
+type TCPTransport struct {
+	addrs map[int]string
+
+	mu      sync.Mutex
+	clients map[int]*rpc.Client
+}
+
+// NewTCPTransport returns a transport for the peers at addrs, by node ID.
+func NewTCPTransport(addrs map[int]string) *TCPTransport {
+	return &TCPTransport{addrs: addrs, clients: make(map[int]*rpc.Client)}
+}
+
+// Serve answers RPCs for h on listener until it is closed.
+func Serve(listener net.Listener, h Handler) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcService{h: h}); err != nil {
+		panic(err)
+	}
+	server.Accept(listener)
+}
+
+func (t *TCPTransport) RequestVote(peer int, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	reply := new(RequestVoteReply)
+	return reply, t.call(peer, "Raft.RequestVote", args, reply)
+}
+
+func (t *TCPTransport) AppendEntries(peer int, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	reply := new(AppendEntriesReply)
+	return reply, t.call(peer, "Raft.AppendEntries", args, reply)
+}
+
+func (t *TCPTransport) InstallSnapshot(peer int, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	reply := new(InstallSnapshotReply)
+	return reply, t.call(peer, "Raft.InstallSnapshot", args, reply)
+}
+
+func (t *TCPTransport) Forward(peer int, data []byte) error {
+	// A slow answer only means a slow commit, so the connection, which the
+	// other RPCs share, is kept
+	return t.callWithin(peer, "Raft.Forward", &ForwardArgs{Data: data}, &ForwardReply{}, forwardTimeout, false)
+}
+
+func (t *TCPTransport) call(peer int, method string, args, reply any) error {
+	return t.callWithin(peer, method, args, reply, rpcTimeout, true)
+}
+
+// callWithin calls method on peer and waits up to timeout for the reply,
+// dropping the connection on timeout if dropSlow is set.
+func (t *TCPTransport) callWithin(peer int, method string, args, reply any, timeout time.Duration, dropSlow bool) error {
+	client, err := t.client(peer)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if errors.Is(call.Error, rpc.ErrShutdown) {
+			t.drop(peer, client)
+		}
+		return call.Error
+	case <-time.After(timeout):
+		if dropSlow {
+			t.drop(peer, client)
+		}
+		return fmt.Errorf("raft: %s to node %d timed out", method, peer)
+	}
+}
+
+// client returns the connection to peer, dialling it if needed.
+func (t *TCPTransport) client(peer int) (*rpc.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if client := t.clients[peer]; client != nil {
+		return client, nil
+	}
+	addr, ok := t.addrs[peer]
+	if !ok {
+		return nil, fmt.Errorf("raft: unknown node %d", peer)
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, rpcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+	t.clients[peer] = client
+	return client, nil
+}
+
+func (t *TCPTransport) drop(peer int, client *rpc.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.clients[peer] == client {
+		delete(t.clients, peer)
+	}
+	client.Close()
+}
+
+type ForwardArgs struct{ Data []byte }
+type ForwardReply struct{}
+
+// rpcService adapts a Handler to net/rpc.
+type rpcService struct{ h Handler }
+
+func (s *rpcService) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	*reply = *s.h.HandleRequestVote(args)
+	return nil
+}
+
+func (s *rpcService) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	*reply = *s.h.HandleAppendEntries(args)
+	return nil
+}
+
+func (s *rpcService) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	*reply = *s.h.HandleInstallSnapshot(args)
+	return nil
+}
+
+func (s *rpcService) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	return s.h.HandleForward(args.Data)
+}
+
+// MemoryNetwork connects nodes in the same process, for tests. Nodes can be
+// cut off to simulate partitions and crashes.
+type MemoryNetwork struct {
+	mu       sync.Mutex
+	handlers map[int]Handler
+	down     map[int]bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{handlers: make(map[int]Handler), down: make(map[int]bool)}
+}
+
+// Register routes RPCs for node id to h.
+func (m *MemoryNetwork) Register(id int, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[id] = h
+}
+
+// Disconnect cuts node id off from every other node.
+func (m *MemoryNetwork) Disconnect(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down[id] = true
+}
+
+// Reconnect undoes Disconnect.
+func (m *MemoryNetwork) Reconnect(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.down, id)
+}
+
+// Transport returns the transport node from sends with.
+func (m *MemoryNetwork) Transport(from int) Transport {
+	return &memoryTransport{network: m, from: from}
+}
+
+func (m *MemoryNetwork) route(from, to int) (Handler, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.handlers[to]
+	if h == nil || m.down[from] || m.down[to] {
+		return nil, errUnreachable
+	}
+	return h, nil
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	from    int
+}
+
+func (t *memoryTransport) RequestVote(peer int, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	h, err := t.network.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleRequestVote(args), nil
+}
+
+func (t *memoryTransport) AppendEntries(peer int, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	h, err := t.network.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleAppendEntries(args), nil
+}
+
+func (t *memoryTransport) InstallSnapshot(peer int, args *InstallSnapshotArgs) (*InstallSnapshotReply, error) {
+	h, err := t.network.route(t.from, peer)
+	if err != nil {
+		return nil, err
+	}
+	return h.HandleInstallSnapshot(args), nil
+}
+
+func (t *memoryTransport) Forward(peer int, data []byte) error {
+	h, err := t.network.route(t.from, peer)
+	if err != nil {
+		return err
+	}
+	return h.HandleForward(data)
+}
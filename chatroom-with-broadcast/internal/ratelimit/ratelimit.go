@@ -0,0 +1,159 @@
+// Package ratelimit implements token buckets.
+//
+// A Limit of N per duration D is a bucket holding up to N tokens that refills
+// at N/D tokens per second; every event takes a token, so bursts of up to N
+// events are allowed and the long-run rate is bounded by N/D.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a rate of Events per Per. The zero Limit is unlimited.
+type Limit struct {
+	Events int
+	Per    time.Duration
+}
+
+// Unlimited reports whether l allows everything.
+func (l Limit) Unlimited() bool {
+	return l.Events <= 0 || l.Per <= 0
+}
+
+// ParseLimit parses a limit written as "<events>/<duration>", such as
+// "10/10s" or "3/1m". "off" and "" are unlimited.
+func ParseLimit(s string) (Limit, error) {
+	if s == "" || s == "off" {
+		return Limit{}, nil
+	}
+
+	events, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid limit %q, want <events>/<duration> such as 10/10s", s)
+	}
+	n, err := strconv.Atoi(events)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad event count", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit %q: bad duration", s)
+	}
+	return Limit{Events: n, Per: d}, nil
+}
+
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Events, l.Per)
+}
+
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Limit) UnmarshalText(text []byte) error {
+	parsed, err := ParseLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// Bucket is a token bucket. It is not safe for concurrent use.
+type Bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket for l.
+func NewBucket(l Limit) *Bucket {
+	return &Bucket{limit: l, tokens: float64(l.Events)}
+}
+
+// Allow takes a token if there is one and reports whether it did.
+func (b *Bucket) Allow() bool {
+	return b.AllowAt(time.Now())
+}
+
+// AllowAt is Allow at time now.
+func (b *Bucket) AllowAt(now time.Time) bool {
+	if b.limit.Unlimited() {
+		return true
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Full reports whether the bucket has refilled completely at time now, so
+// dropping it changes nothing.
+func (b *Bucket) Full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= float64(b.limit.Events)
+}
+
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		rate := float64(b.limit.Events) / b.limit.Per.Seconds()
+		b.tokens = min(float64(b.limit.Events), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+}
+
+// Keyed holds a bucket for each key, such as an IP address. It is safe for
+// concurrent use.
+type Keyed struct {
+	mu      sync.Mutex
+	limit   Limit
+	buckets map[string]*Bucket
+}
+
+// sweepAt is how many buckets a Keyed holds before it drops the full ones.
+const sweepAt = 1024
+
+// NewKeyed returns buckets for l.
+func NewKeyed(l Limit) *Keyed {
+	return &Keyed{limit: l, buckets: make(map[string]*Bucket)}
+}
+
+// Allow takes a token from the bucket of key and reports whether it did.
+func (k *Keyed) Allow(key string) bool {
+	return k.AllowAt(key, time.Now())
+}
+
+// AllowAt is Allow at time now.
+func (k *Keyed) AllowAt(key string, now time.Time) bool {
+	if k.limit.Unlimited() {
+		return true
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	bucket, ok := k.buckets[key]
+	if !ok {
+		if len(k.buckets) >= sweepAt {
+			for key, b := range k.buckets {
+				if b.Full(now) {
+					delete(k.buckets, key)
+				}
+			}
+		}
+		bucket = NewBucket(k.limit)
+		k.buckets[key] = bucket
+	}
+	return bucket.AllowAt(now)
+}
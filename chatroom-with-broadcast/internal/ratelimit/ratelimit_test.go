@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Limit
+		ok   bool
+	}{
+		{"10/10s", Limit{10, 10 * time.Second}, true},
+		{"3/1m", Limit{3, time.Minute}, true},
+		{"off", Limit{}, true},
+		{"", Limit{}, true},
+		{"10", Limit{}, false},
+		{"0/1s", Limit{}, false},
+		{"5/soon", Limit{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseLimit(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseLimit(%q) = %v, %v", tt.in, got, err)
+		}
+	}
+	if s := (Limit{3, time.Minute}).String(); s != "3/1m0s" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	b := NewBucket(Limit{Events: 3, Per: 3 * time.Second})
+	for i := 0; i < 3; i++ {
+		if !b.AllowAt(at(0)) {
+			t.Fatalf("burst event %d refused", i)
+		}
+	}
+	if b.AllowAt(at(500 * time.Millisecond)) {
+		t.Fatal("allowed an event from an empty bucket")
+	}
+	if !b.AllowAt(at(time.Second)) || b.AllowAt(at(time.Second)) {
+		t.Fatal("expected exactly one token after a second")
+	}
+	if b.Full(at(3*time.Second)) || !b.Full(at(4*time.Second)) {
+		t.Fatal("bucket should refill over 3 seconds")
+	}
+	if b.AllowAt(at(time.Hour)); b.tokens != 2 {
+		t.Fatalf("%v tokens after a long wait, want the burst of 3 less one", b.tokens)
+	}
+
+	if unlimited := NewBucket(Limit{}); !unlimited.AllowAt(at(0)) || !unlimited.AllowAt(at(0)) {
+		t.Fatal("unlimited bucket refused an event")
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	now := time.Now()
+	k := NewKeyed(Limit{Events: 1, Per: time.Minute})
+	if !k.AllowAt("a", now) || k.AllowAt("a", now) || !k.AllowAt("b", now) {
+		t.Fatal("keys should have their own buckets")
+	}
+	if !k.AllowAt("a", now.Add(time.Minute)) {
+		t.Fatal("bucket didn't refill")
+	}
+}
@@ -0,0 +1,304 @@
+// Package search is an in-memory inverted index over chat messages.
+//
+// Every indexed message (a document) is identified by its message ID. The
+// index maps each term to the sorted IDs of the documents containing it and
+// keeps the channel, sender and time of every document for filtering. It is
+// saved to disk with Save and read back with Load, so only messages added
+// since the last save have to be indexed again after a restart.
+package search
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Doc is what the index keeps about an indexed message.
+type Doc struct {
+	Channel string
+	From    string
+	Time    time.Time
+}
+
+// Hit is a message matching a query.
+type Hit struct {
+	ID      int
+	Channel string
+}
+
+// Index is an inverted index. It is safe for concurrent use.
+type Index struct {
+	mu       sync.Mutex
+	postings map[string][]int
+	docs     map[int]Doc
+}
+
+// saved is the on-disk layout of an index.
+type saved struct {
+	Postings map[string][]int
+	Docs     map[int]Doc
+}
+
+// New returns an empty index.
+func New() *Index {
+	return &Index{
+		postings: make(map[string][]int),
+		docs:     make(map[int]Doc),
+	}
+}
+
+// Load reads an index written by Save.
+func Load(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var s saved
+	if err := gob.NewDecoder(file).Decode(&s); err != nil {
+		return nil, fmt.Errorf("search: decode %s: %w", path, err)
+	}
+
+	ix := New()
+	if s.Postings != nil {
+		ix.postings = s.Postings
+	}
+	if s.Docs != nil {
+		ix.docs = s.Docs
+	}
+	return ix, nil
+}
+
+// Save writes the index to path, replacing it atomically.
+func (ix *Index) Save(path string) error {
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ix.mu.Lock()
+	err = gob.NewEncoder(file).Encode(saved{Postings: ix.postings, Docs: ix.docs})
+	ix.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	file.Close()
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Add indexes the text of message id. It reports false, and changes
+// nothing, if the message is already indexed.
+func (ix *Index) Add(id int, doc Doc, text string) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, ok := ix.docs[id]; ok {
+		return false
+	}
+	ix.docs[id] = doc
+
+	for _, term := range Tokenize(text) {
+		ids := ix.postings[term]
+		// Messages are almost always indexed in ID order
+		i := len(ids)
+		if i > 0 && ids[i-1] >= id {
+			i = sort.SearchInts(ids, id)
+			if ids[i] == id {
+				continue // Left over from a text it was removed under
+			}
+		}
+		ids = append(ids, 0)
+		copy(ids[i+1:], ids[i:])
+		ids[i] = id
+		ix.postings[term] = ids
+	}
+	return true
+}
+
+// Remove drops message id, whose indexed text was text, from the index. It
+// reports false if the message wasn't indexed.
+func (ix *Index) Remove(id int, text string) bool {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if _, ok := ix.docs[id]; !ok {
+		return false
+	}
+	delete(ix.docs, id)
+
+	for _, term := range Tokenize(text) {
+		ids := ix.postings[term]
+		i := sort.SearchInts(ids, id)
+		if i == len(ids) || ids[i] != id {
+			continue
+		}
+		if len(ids) == 1 {
+			delete(ix.postings, term)
+			continue
+		}
+		ix.postings[term] = append(ids[:i], ids[i+1:]...)
+	}
+	return true
+}
+
+// Len returns the number of indexed messages.
+func (ix *Index) Len() int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return len(ix.docs)
+}
+
+// Search returns the newest limit messages matching q in channels allow
+// accepts, newest first, and how many matched in all.
+func (ix *Index) Search(q Query, allow func(channel string) bool, limit int) ([]Hit, int) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	if len(q.Terms) == 0 {
+		return nil, 0
+	}
+
+	// Walk the shortest posting list, newest first, checking the others
+	lists := make([][]int, 0, len(q.Terms))
+	for _, term := range q.Terms {
+		ids, ok := ix.postings[term]
+		if !ok {
+			return nil, 0
+		}
+		lists = append(lists, ids)
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+
+	var hits []Hit
+	total := 0
+	for i := len(lists[0]) - 1; i >= 0; i-- {
+		id := lists[0][i]
+		if !containsAll(lists[1:], id) {
+			continue
+		}
+		doc := ix.docs[id]
+		if !q.matches(doc) || !allow(doc.Channel) {
+			continue
+		}
+		total++
+		if len(hits) < limit {
+			hits = append(hits, Hit{ID: id, Channel: doc.Channel})
+		}
+	}
+	return hits, total
+}
+
+func containsAll(lists [][]int, id int) bool {
+	for _, ids := range lists {
+		i := sort.SearchInts(ids, id)
+		if i == len(ids) || ids[i] != id {
+			return false
+		}
+	}
+	return true
+}
+
+// Tokenize splits text into the distinct lowercase words and numbers it
+// contains.
+func Tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	seen := make(map[string]bool, len(fields))
+	terms := fields[:0]
+	for _, f := range fields {
+		if !seen[f] {
+			seen[f] = true
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// Query is a parsed search.
+type Query struct {
+	Terms   []string
+	From    string    // only messages from this user
+	Channel string    // only messages in this channel
+	Before  time.Time // only messages sent before this, if set
+	After   time.Time // only messages sent at or after this, if set
+}
+
+// ParseQuery parses "terms [from:user] [in:#channel] [before:date]
+// [after:date]". Dates are YYYY-MM-DD in local time; before excludes that
+// day and after includes it.
+func ParseQuery(s string) (Query, error) {
+	var q Query
+	var words []string
+
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok || value == "" {
+			words = append(words, field)
+			continue
+		}
+
+		key = strings.ToLower(key)
+		switch key {
+		case "from":
+			q.From = value
+		case "in":
+			q.Channel = strings.ToLower(strings.TrimPrefix(value, "#"))
+		case "before", "after":
+			day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+			if err != nil {
+				return q, fmt.Errorf("invalid date %q, want YYYY-MM-DD", value)
+			}
+			if key == "before" {
+				q.Before = day
+			} else {
+				q.After = day
+			}
+		default:
+			words = append(words, field)
+		}
+	}
+
+	q.Terms = Tokenize(strings.Join(words, " "))
+	if len(q.Terms) == 0 {
+		return q, fmt.Errorf("nothing to search for")
+	}
+	return q, nil
+}
+
+func (q Query) matches(doc Doc) bool {
+	switch {
+	case q.From != "" && !strings.EqualFold(doc.From, q.From):
+		return false
+	case q.Channel != "" && doc.Channel != q.Channel:
+		return false
+	case !q.Before.IsZero() && !doc.Time.Before(q.Before):
+		return false
+	case !q.After.IsZero() && doc.Time.Before(q.After):
+		return false
+	}
+	return true
+}
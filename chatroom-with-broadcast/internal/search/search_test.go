@@ -0,0 +1,105 @@
+package search
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	got := fmt.Sprint(Tokenize("Deploy v2, then DEPLOY again; café-bar!"))
+	if want := "[deploy v2 then again café bar]"; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery("Release notes from:Bob in:#Go after:2024-03-01 before:2024-04-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(q.Terms) != "[release notes]" || q.From != "Bob" || q.Channel != "go" {
+		t.Fatalf("unexpected query: %+v", q)
+	}
+	if q.After.Format(time.DateOnly) != "2024-03-01" || q.Before.Format(time.DateOnly) != "2024-04-01" {
+		t.Fatalf("unexpected dates: %+v", q)
+	}
+
+	for _, s := range []string{"from:bob", "hello before:yesterday"} {
+		if _, err := ParseQuery(s); err == nil {
+			t.Errorf("ParseQuery(%q) succeeded", s)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	day := time.Date(2024, 3, 10, 12, 0, 0, 0, time.Local)
+	ix := New()
+	add := func(id int, channel, from string, days int, text string) {
+		ix.Add(id, Doc{Channel: channel, From: from, Time: day.AddDate(0, 0, days)}, text)
+	}
+	add(1, "global", "alice", 0, "the build is broken")
+	add(3, "go", "bob", 1, "build fixed")
+	add(2, "global", "bob", 2, "who broke the build?")
+	add(4, "secret", "carol", 3, "build secrets")
+	if ix.Add(1, Doc{}, "again") || ix.Len() != 4 {
+		t.Fatal("re-adding a message changed the index")
+	}
+
+	notSecret := func(channel string) bool { return channel != "secret" }
+	tests := []struct {
+		query string
+		limit int
+		want  string
+	}{
+		{"build", 10, "[3 2 1] 3"},
+		{"build", 2, "[3 2] 3"},
+		{"BUILD the", 10, "[2 1] 2"},
+		{"build from:BOB", 10, "[3 2] 2"},
+		{"build in:#global", 10, "[2 1] 2"},
+		{"build after:2024-03-11", 10, "[3 2] 2"},
+		{"build before:2024-03-11", 10, "[1] 1"},
+		{"secrets", 10, "[] 0"},
+		{"nothing", 10, "[] 0"},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, total := ix.Search(q, notSecret, tt.limit)
+		ids := []int{}
+		for _, hit := range hits {
+			ids = append(ids, hit.ID)
+		}
+		if got := fmt.Sprint(ids, " ", total); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "search.idx")
+	if err := ix.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := ParseQuery("broke")
+	if hits, _ := loaded.Search(q, notSecret, 10); loaded.Len() != 4 || len(hits) != 1 || hits[0].ID != 2 {
+		t.Fatalf("loaded index: %d messages, hits %v", loaded.Len(), hits)
+	}
+
+	// Removing a message takes it out of every posting list
+	if !loaded.Remove(2, "who broke the build?") || loaded.Remove(2, "") || loaded.Len() != 3 {
+		t.Fatal("Remove didn't remove exactly once")
+	}
+	if hits, _ := loaded.Search(q, notSecret, 10); len(hits) != 0 {
+		t.Fatalf("removed message still matches: %v", hits)
+	}
+	q, _ = ParseQuery("build")
+	if hits, total := loaded.Search(q, notSecret, 10); total != 2 {
+		t.Fatalf("build: hits %v, total %d", hits, total)
+	}
+}
@@ -0,0 +1,100 @@
+// Package spool is a FIFO queue of byte records kept in a file, for data
+// that doesn't fit in memory for long. Each record is stored as
+//
+//	length uint32, big endian
+//	payload
+//
+// A queue belongs to a single process and doesn't survive it: the file is
+// truncated whenever the queue runs empty and removed by Close.
+package spool
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Queue is a file-backed FIFO queue. It is safe for concurrent use.
+type Queue struct {
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	readOff int64 // offset of the oldest record
+	size    int64 // end of the newest record
+	len     int
+}
+
+// Create creates an empty queue in the file at path, replacing any file
+// already there.
+func Create(path string) (*Queue, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{file: file, path: path}, nil
+}
+
+// Push adds a record to the back of the queue.
+func (q *Queue) Push(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	if _, err := q.file.WriteAt(buf, q.size); err != nil {
+		return err
+	}
+	q.size += int64(len(buf))
+	q.len++
+	return nil
+}
+
+// Pop removes and returns the record at the front of the queue. It reports
+// false if the queue is empty.
+func (q *Queue) Pop() ([]byte, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.len == 0 {
+		return nil, false, nil
+	}
+
+	var header [4]byte
+	if _, err := q.file.ReadAt(header[:], q.readOff); err != nil {
+		return nil, false, fmt.Errorf("spool: read %s: %w", q.path, err)
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := q.file.ReadAt(data, q.readOff+4); err != nil {
+		return nil, false, fmt.Errorf("spool: read %s: %w", q.path, err)
+	}
+	q.readOff += int64(4 + len(data))
+	q.len--
+
+	// Start over once everything has been read, so the file only grows
+	// while the consumer is behind
+	if q.len == 0 {
+		q.readOff, q.size = 0, 0
+		if err := q.file.Truncate(0); err != nil {
+			return data, true, err
+		}
+	}
+	return data, true, nil
+}
+
+// Len returns the number of records in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.len
+}
+
+// Close discards the queue and removes its file.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return errors.Join(q.file.Close(), os.Remove(q.path))
+}
@@ -0,0 +1,62 @@
+package spool
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.spool")
+	q, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pop := func() string {
+		t.Helper()
+		data, ok, err := q.Pop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return "<empty>"
+		}
+		return string(data)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := q.Push([]byte(fmt.Sprint("record ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := pop(); got != "record 0" {
+		t.Fatalf("got %q, want record 0", got)
+	}
+	q.Push([]byte("record 3"))
+	for i := 1; i <= 3; i++ {
+		if got, want := pop(), fmt.Sprint("record ", i); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	if got := pop(); got != "<empty>" || q.Len() != 0 {
+		t.Fatalf("got %q from a drained queue of length %d", got, q.Len())
+	}
+
+	// A drained queue gives its space back
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatalf("drained queue file: %v, %v", info, err)
+	}
+	q.Push([]byte(""))
+	if got := pop(); got != "" {
+		t.Fatalf("got %q, want an empty record", got)
+	}
+
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("queue file still exists after Close: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+// Package toml parses the subset of TOML the server's config file uses.
+//
+// A document is a list of "key = value" lines with # comments. Keys are bare
+// (letters, digits, '_' and '-'), and values are strings ("basic" with
+// escapes or 'literal'), integers, booleans or arrays of those, which may
+// span lines. Tables, floats and dates are not supported.
+package toml
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse reads a document and returns its values by key. Values are string,
+// int64, bool or []any.
+func Parse(data []byte) (map[string]any, error) {
+	p := &parser{src: string(data), line: 1}
+	values := make(map[string]any)
+
+	for {
+		p.skipSpace(true)
+		if p.eof() {
+			return values, nil
+		}
+		if p.peek() == '[' {
+			return nil, p.errorf("tables are not supported")
+		}
+
+		key := p.key()
+		if key == "" {
+			return nil, p.errorf("expected a key, found %q", p.peek())
+		}
+		p.skipSpace(false)
+		if !p.consume('=') {
+			return nil, p.errorf("expected '=' after %s", key)
+		}
+		p.skipSpace(false)
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := values[key]; dup {
+			return nil, p.errorf("%s is set twice", key)
+		}
+		values[key] = value
+
+		p.skipSpace(false)
+		if !p.eof() && !p.consume('\n') {
+			return nil, p.errorf("unexpected %q after the value of %s", p.peek(), key)
+		}
+		p.line++
+	}
+}
+
+type parser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	return p.src[p.pos]
+}
+
+func (p *parser) consume(c byte) bool {
+	if p.eof() || p.peek() != c {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+// skipSpace skips blanks and comments, and newlines too if newlines is set.
+func (p *parser) skipSpace(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+func isKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *parser) key() string {
+	start := p.pos
+	for !p.eof() && isKeyChar(p.peek()) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *parser) value() (any, error) {
+	if p.eof() {
+		return nil, p.errorf("missing value")
+	}
+
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.str(c)
+	case c == '[':
+		return p.array()
+	case c == '+' || c == '-' || c >= '0' && c <= '9':
+		return p.integer()
+	}
+
+	word := p.key()
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return nil, p.errorf("unsupported value %q", word)
+}
+
+// str reads a string on a single line: a basic string if quote is a double
+// quote, a literal one if it is a single quote.
+func (p *parser) str(quote byte) (string, error) {
+	if strings.HasPrefix(p.src[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+
+	start := p.pos
+	p.pos++
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		if c == '\\' && quote == '"' && !p.eof() {
+			p.pos++
+			continue
+		}
+		if c == quote {
+			break
+		}
+	}
+
+	raw := p.src[start:p.pos]
+	if quote == '\'' {
+		return raw[1 : len(raw)-1], nil
+	}
+	s, err := strconv.Unquote(raw)
+	if err != nil {
+		return "", p.errorf("invalid string %s", raw)
+	}
+	return s, nil
+}
+
+func (p *parser) array() ([]any, error) {
+	p.pos++ // '['
+	values := []any{}
+	for {
+		p.skipSpace(true)
+		if p.consume(']') {
+			return values, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		p.skipSpace(true)
+		if p.consume(']') {
+			return values, nil
+		}
+		if !p.consume(',') {
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *parser) integer() (int64, error) {
+	start := p.pos
+	p.pos++
+	// Take in anything that could be part of a float or date, to reject it
+	for !p.eof() && (isKeyChar(p.peek()) || p.peek() == '.' || p.peek() == ':') {
+		p.pos++
+	}
+
+	word := p.src[start:p.pos]
+	n, err := strconv.ParseInt(strings.ReplaceAll(word, "_", ""), 10, 64)
+	if err != nil {
+		return 0, p.errorf("unsupported number %q", word)
+	}
+	return n, nil
+}
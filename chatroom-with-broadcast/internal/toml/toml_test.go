@@ -0,0 +1,62 @@
+package toml
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc := `
+# The chat server
+addr = ":9000"   # chat clients
+history-window = 1_000
+require_auth = true
+data = 'C:\chat'
+greeting = "hi\t\"there\""
+owners = [
+	"alice", # the first owner
+	"bob",
+]
+empty = []
+`
+	got, err := Parse([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"addr":           ":9000",
+		"history-window": int64(1000),
+		"require_auth":   true,
+		"data":           `C:\chat`,
+		"greeting":       "hi\t\"there\"",
+		"owners":         []any{"alice", "bob"},
+		"empty":          []any{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Parse = %#v, want %#v", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want string
+	}{
+		{"addr", "line 1: expected '='"},
+		{"a = 1\nb = \"open", "line 2: unterminated string"},
+		{"a = 1\na = 2", "line 2: a is set twice"},
+		{"[server]\naddr = 1", "tables are not supported"},
+		{"ratio = 0.5", "unsupported number"},
+		{"when = 2024-01-01", "unsupported number"},
+		{"a = yes", "unsupported value"},
+		{"a = 1 2", "unexpected"},
+		{"a = [1, 2", "expected ',' or ']'"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.doc))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) = %v, want an error containing %q", tt.doc, err, tt.want)
+		}
+	}
+}
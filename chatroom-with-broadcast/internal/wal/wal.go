@@ -0,0 +1,318 @@
+// Package wal is a segmented, checksummed write-ahead log. Each record is
+// stored as
+//
+//	length   uint32, big endian - size of the payload
+//	checksum uint32, big endian - CRC-32C of the payload
+//	payload
+//
+// Records are appended to numbered segment files (00000001.wal, ...), and a
+// new segment is started once the current one reaches the segment size. A
+// crash in the middle of an append leaves a torn record at the end of the
+// last segment, which Open cuts off. Damaged records with valid ones after
+// them are skipped instead.
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	headerSize = 8
+
+	// MaxRecordSize bounds a single payload.
+	MaxRecordSize = 16 << 20
+
+	// DefaultSegmentSize is the size at which a new segment is started.
+	DefaultSegmentSize = 4 << 20
+
+	segmentExt = ".wal"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL is an open log. It is safe for concurrent use.
+type WAL struct {
+	dir         string
+	segmentSize int64
+
+	mu   sync.Mutex
+	file *os.File
+	seq  int   // number of the segment being appended to
+	size int64 // bytes in that segment
+}
+
+// Report describes what Open found while replaying the log.
+type Report struct {
+	Segments  int // segment files read
+	Valid     int // records replayed
+	Truncated int // torn records cut off the end of the log
+	Corrupt   int // records skipped because their checksum didn't match
+
+	TruncatedBytes int64
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%d segments: %d valid, %d truncated, %d corrupt records",
+		r.Segments, r.Valid, r.Truncated, r.Corrupt)
+}
+
+// Open replays every record in dir in order, calling fn with each valid
+// payload, cuts off a torn tail and opens the last segment for appending.
+// The directory is created if needed. A segmentSize of 0 means
+// DefaultSegmentSize.
+func Open(dir string, segmentSize int64, fn func(payload []byte)) (*WAL, Report, error) {
+	var report Report
+
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, report, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, report, err
+	}
+
+	w := &WAL{dir: dir, segmentSize: segmentSize, seq: 1}
+	for i, seq := range segments {
+		last := i == len(segments)-1
+		end, err := replaySegment(w.segmentPath(seq), last, fn, &report)
+		if err != nil {
+			return nil, report, err
+		}
+		report.Segments++
+		w.seq, w.size = seq, end
+	}
+
+	file, err := os.OpenFile(w.segmentPath(w.seq), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, report, err
+	}
+	w.file = file
+	return w, report, nil
+}
+
+// replaySegment calls fn for every valid record in the segment at path and
+// returns the offset just past the last record kept. A torn record at the
+// end of the last segment is truncated away. A record whose length can't be
+// trusted is only torn if no valid record follows it; otherwise replay
+// resumes at the next one.
+func replaySegment(path string, last bool, fn func([]byte), report *Report) (int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	off := 0
+	for off < len(data) {
+		rest := data[off:]
+		if len(rest) < headerSize {
+			break // torn header
+		}
+
+		length := int(binary.BigEndian.Uint32(rest))
+		checksum := binary.BigEndian.Uint32(rest[4:])
+		// Empty records are never written, so a zero length is unused space
+		// (such as a zero-filled tail) rather than a record
+		if length == 0 || length > MaxRecordSize || headerSize+length > len(rest) {
+			next := nextRecord(data, off+1)
+			if next < 0 {
+				break // torn payload, or garbage up to the end
+			}
+			report.Corrupt++
+			off = next
+			continue
+		}
+
+		payload := rest[headerSize : headerSize+length]
+		if crc32.Checksum(payload, castagnoli) != checksum {
+			if headerSize+length == len(rest) {
+				break // the last record was only partly written
+			}
+			report.Corrupt++
+			off += headerSize + length
+			continue
+		}
+
+		fn(payload)
+		report.Valid++
+		off += headerSize + length
+	}
+
+	if off == len(data) {
+		return int64(off), nil
+	}
+
+	// Whatever follows off can't be read
+	if !last {
+		report.Corrupt++
+		return int64(off), nil
+	}
+
+	report.Truncated++
+	report.TruncatedBytes += int64(len(data) - off)
+	if err := os.Truncate(path, int64(off)); err != nil {
+		return 0, fmt.Errorf("truncate torn tail: %w", err)
+	}
+	return int64(off), nil
+}
+
+// nextRecord returns the offset of the first record at or after off whose
+// checksum matches, or -1 if there is none.
+func nextRecord(data []byte, off int) int {
+	for ; off+headerSize <= len(data); off++ {
+		rest := data[off:]
+		length := int(binary.BigEndian.Uint32(rest))
+		if length == 0 || length > MaxRecordSize || headerSize+length > len(rest) {
+			continue
+		}
+		if crc32.Checksum(rest[headerSize:headerSize+length], castagnoli) == binary.BigEndian.Uint32(rest[4:]) {
+			return off
+		}
+	}
+	return -1
+}
+
+// Append writes payload as one record and syncs it to disk, starting a new
+// segment first if the current one is full.
+func (w *WAL) Append(payload []byte) error {
+	if len(payload) == 0 {
+		return errors.New("wal: empty record")
+	}
+	if len(payload) > MaxRecordSize {
+		return errors.New("wal: record too large")
+	}
+
+	record := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, castagnoli))
+	copy(record[headerSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if w.size > 0 && w.size+int64(len(record)) > w.segmentSize {
+		if err := w.rollLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(record)
+	w.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// rollLocked closes the current segment and starts the next one.
+func (w *WAL) rollLocked() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.segmentPath(w.seq+1), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.seq++
+	w.size = 0
+	return SyncDir(w.dir)
+}
+
+// Rotate starts a new segment and returns its number. Every record
+// appended before Rotate is in an older segment.
+func (w *WAL) Rotate() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if err := w.rollLocked(); err != nil {
+		return 0, err
+	}
+	return w.seq, nil
+}
+
+// RemoveBefore deletes the segments numbered below seq.
+func (w *WAL) RemoveBefore(seq int) error {
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s < seq {
+			if err := os.Remove(w.segmentPath(s)); err != nil {
+				return err
+			}
+		}
+	}
+	return SyncDir(w.dir)
+}
+
+// Close closes the current segment.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+func (w *WAL) segmentPath(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%08d%s", seq, segmentExt))
+}
+
+// listSegments returns the numbers of the segments in dir, in order.
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// SyncDir makes file creations, renames and removals in dir durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
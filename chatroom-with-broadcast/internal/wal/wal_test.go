@@ -0,0 +1,165 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openAll(t *testing.T, dir string, segmentSize int64) (*WAL, Report, []string) {
+	t.Helper()
+
+	var records []string
+	w, report, err := Open(dir, segmentSize, func(payload []byte) {
+		records = append(records, string(payload))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	return w, report, records
+}
+
+func appendAll(t *testing.T, w *WAL, records ...string) {
+	t.Helper()
+	for _, r := range records {
+		if err := w.Append([]byte(r)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSegmentRollover(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _, _ := openAll(t, dir, 64)
+	var want []string
+	for i := 0; i < 20; i++ {
+		want = append(want, fmt.Sprintf("record %02d", i))
+	}
+	appendAll(t, w, want...)
+	w.Close()
+
+	segments, _ := listSegments(dir)
+	if len(segments) < 2 {
+		t.Fatalf("expected several segments, got %v", segments)
+	}
+
+	_, report, got := openAll(t, dir, 64)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+	if report.Valid != 20 || report.Segments != len(segments) || report.Truncated != 0 || report.Corrupt != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestTornTailIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _, _ := openAll(t, dir, 0)
+	appendAll(t, w, "first", "second")
+	w.Close()
+
+	// Simulate a crash halfway through writing a third record
+	path := filepath.Join(dir, "00000001.wal")
+	info, _ := os.Stat(path)
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write([]byte{0, 0, 0, 20, 1, 2, 3, 4, 't', 'h', 'i'})
+	file.Close()
+
+	w, report, got := openAll(t, dir, 0)
+	if fmt.Sprint(got) != "[first second]" {
+		t.Fatalf("replayed %v", got)
+	}
+	if report.Truncated != 1 || report.TruncatedBytes != 11 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatalf("segment is %d bytes, want %d", after.Size(), info.Size())
+	}
+
+	// New records go after the cut, and read back cleanly
+	appendAll(t, w, "third")
+	w.Close()
+	if _, report, got := openAll(t, dir, 0); fmt.Sprint(got) != "[first second third]" || report.Truncated != 0 {
+		t.Fatalf("replayed %v, report %+v", got, report)
+	}
+}
+
+func TestCorruptRecordIsSkipped(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _, _ := openAll(t, dir, 0)
+	appendAll(t, w, "alpha", "bravo", "charlie")
+	w.Close()
+
+	// Flip a bit in the payload of the middle record
+	path := filepath.Join(dir, "00000001.wal")
+	data, _ := os.ReadFile(path)
+	data[headerSize+len("alpha")+headerSize] ^= 0x01
+	os.WriteFile(path, data, 0644)
+
+	_, report, got := openAll(t, dir, 0)
+	if fmt.Sprint(got) != "[alpha charlie]" {
+		t.Fatalf("replayed %v", got)
+	}
+	if report.Valid != 2 || report.Corrupt != 1 || report.Truncated != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
+
+func TestBadLengthInTheMiddleIsSkipped(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _, _ := openAll(t, dir, 0)
+	appendAll(t, w, "alpha", "bravo", "charlie", "delta")
+	w.Close()
+
+	// Corrupt the length of the second record, so it seems to run past the
+	// end of the segment
+	path := filepath.Join(dir, "00000001.wal")
+	data, _ := os.ReadFile(path)
+	copy(data[headerSize+len("alpha"):], []byte{0xff, 0xff, 0, 0})
+	os.WriteFile(path, data, 0644)
+
+	w, report, got := openAll(t, dir, 0)
+	if fmt.Sprint(got) != "[alpha charlie delta]" {
+		t.Fatalf("replayed %v", got)
+	}
+	if report.Corrupt != 1 || report.Truncated != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if after, _ := os.Stat(path); after.Size() != int64(len(data)) {
+		t.Fatalf("segment was cut to %d bytes, want %d", after.Size(), len(data))
+	}
+
+	// Appends still go after the last record
+	appendAll(t, w, "echo")
+	w.Close()
+	if _, _, got := openAll(t, dir, 0); fmt.Sprint(got) != "[alpha charlie delta echo]" {
+		t.Fatalf("replayed %v", got)
+	}
+}
+
+func TestRotateAndRemoveBefore(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _, _ := openAll(t, dir, 0)
+	appendAll(t, w, "one", "two")
+	seq, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, w, "three")
+	if err := w.RemoveBefore(seq); err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, w, "four")
+	w.Close()
+
+	if _, _, got := openAll(t, dir, 0); fmt.Sprint(got) != "[three four]" {
+		t.Fatalf("replayed %v", got)
+	}
+}
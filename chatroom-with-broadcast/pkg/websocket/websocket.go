@@ -0,0 +1,372 @@
+// Package websocket is a small RFC 6455 implementation for line-oriented
+// text protocols. A Conn satisfies net.Conn: every Write is sent as one text
+// message and every received message is read back as one line.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes from RFC 6455 section 5.2.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// maxMessageSize bounds a single (possibly fragmented) message.
+const maxMessageSize = 1 << 20
+
+var (
+	ErrMessageTooLarge = errors.New("websocket: message too large")
+	// ErrBadMasking is returned for a frame from a client that isn't
+	// masked, or from a server that is (RFC 6455 section 5.1).
+	ErrBadMasking = errors.New("websocket: frame masking is wrong for its sender")
+)
+
+// Conn is a WebSocket connection.
+type Conn struct {
+	conn     net.Conn
+	br       *bufio.Reader
+	isClient bool // clients mask the frames they send
+
+	readBuf []byte // rest of the message being read
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// Upgrade performs the server side of the opening handshake and takes over
+// the underlying connection.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("websocket: not an upgrade request")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("websocket: unsupported version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("websocket: missing key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: conn, br: rw.Reader}, nil
+}
+
+// Dial opens a client connection to a ws:// URL.
+func Dial(rawURL string) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("websocket: unsupported scheme %q", u.Scheme)
+	}
+
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn, u)
+}
+
+// NewClient performs the client side of the opening handshake over conn,
+// which may already be wrapped in TLS.
+func NewClient(conn net.Conn, u *url.URL) (*Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	path := u.RequestURI()
+	request := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + u.Host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket: handshake failed: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, errors.New("websocket: bad Sec-WebSocket-Accept")
+	}
+
+	return &Conn{conn: conn, br: br, isClient: true}, nil
+}
+
+// Read reads the next message, or the rest of the current one. Every message
+// is terminated with a newline so line readers see one line per message.
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+			msg = append(msg, '\n')
+		}
+		c.readBuf = msg
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Write sends p as a single text message.
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and closes the underlying connection.
+func (c *Conn) Close() error {
+	c.writeFrame(opClose, []byte{0x03, 0xE8}) // 1000: normal closure
+	return c.conn.Close()
+}
+
+// Underlying returns the connection the WebSocket runs over.
+func (c *Conn) Underlying() net.Conn { return c.conn }
+
+func (c *Conn) LocalAddr() net.Addr                { return c.conn.LocalAddr() }
+func (c *Conn) RemoteAddr() net.Addr               { return c.conn.RemoteAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.conn.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.conn.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+// readMessage returns the payload of the next text or binary message,
+// answering pings and reassembling fragments along the way.
+func (c *Conn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeFrame(opClose, payload)
+			c.conn.Close()
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				return nil, errors.New("websocket: new message inside a fragmented one")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				return nil, errors.New("websocket: unexpected continuation frame")
+			}
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %#x", opcode)
+		}
+
+		if len(message)+len(payload) > maxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, payload...)
+
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.br, header[:]); err != nil {
+		return
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	if masked == c.isClient {
+		err = ErrBadMasking
+		return
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > maxMessageSize {
+		err = ErrMessageTooLarge
+		return
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(c.br, mask[:]); err != nil {
+			return
+		}
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.br, payload); err != nil {
+		return
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		c.closed = true
+	}
+
+	frame := []byte{0x80 | opcode}
+
+	maskBit := byte(0)
+	if c.isClient {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.isClient {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := start; i < len(frame); i++ {
+			frame[i] ^= mask[(i-start)%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether the comma-separated header name contains
+// token, ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}